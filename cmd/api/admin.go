@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := app.store.User.GetAll(r.Context())
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.jsonResponse(w, http.StatusOK, users); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// deleteUserHandler deletes a user along with their memberships and
+// sessions, which revokes every token issued to them, and the documents
+// they own. Their open websocket connections are closed, and so are the
+// rooms of the deleted documents.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The memberships go with the user, so find the documents they may
+	// have open first.
+	ctx := r.Context()
+	memberships, err := app.store.Member.ListForUser(ctx, userID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.store.User.Delete(ctx, userID); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	for _, member := range memberships {
+		if member.Role != store.RoleOwner {
+			app.applyRole(ctx, member.DocID, userID, "")
+			continue
+		}
+		if err := app.hub.CloseRoom(ctx, member.DocID, websocket.CloseDocumentDeleted, "document deleted", false); err != nil {
+			app.logger.Warnw("failed to close room of deleted document", "docID", member.DocID, "error", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listRoomsHandler lists the rooms live on this instance. Other instances
+// report their own.
+func (app *application) listRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.jsonResponse(w, http.StatusOK, app.hub.ListRooms()); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// closeRoomHandler saves a document's live room and disconnects its
+// clients, wherever it is open. Clients that reconnect get a fresh room.
+func (app *application) closeRoomHandler(w http.ResponseWriter, r *http.Request) {
+	docID := chi.URLParam(r, "docID")
+	err := app.hub.CloseRoom(r.Context(), docID, websocket.CloseRoomClosed, "closed by an administrator", true)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+func TestDeleteUserClosesTheirConnections(t *testing.T) {
+	api := newTestAPI(t)
+	_, aliceToken := api.signup(t, "alice")
+	bobID, bobToken := api.signup(t, "bob")
+	docID := api.createDocument(t, aliceToken, "hello")
+	member := SetMemberPayload{UserID: bobID, Role: store.RoleEditor}
+	if status := api.do(t, http.MethodPut, "/v1/documents/"+docID+"/members", aliceToken, member, nil); status != http.StatusOK {
+		t.Fatalf("adding member: status %d", status)
+	}
+
+	alice := api.connect(t, aliceToken, docID)
+	bob := api.connect(t, bobToken, docID)
+	if status := api.admin(t, http.MethodDelete, "/v1/admin/users/"+strconv.FormatInt(bobID, 10)); status != http.StatusNoContent {
+		t.Fatalf("deleting user: status %d", status)
+	}
+
+	bob.expectClose(websocket.CloseAccessRevoked)
+	if msg := alice.expectPresence(websocket.PresenceLeave); msg.UserID != strconv.FormatInt(bobID, 10) {
+		t.Fatalf("user %s left, want %d", msg.UserID, bobID)
+	}
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+docID, bobToken, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("deleted user's token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestDeleteUserWithoutDocuments(t *testing.T) {
+	api := newTestAPI(t)
+	userID, _ := api.signup(t, "alice")
+	path := "/v1/admin/users/" + strconv.FormatInt(userID, 10)
+	if status := api.admin(t, http.MethodDelete, path); status != http.StatusNoContent {
+		t.Fatalf("deleting user: status %d", status)
+	}
+	if status := api.admin(t, http.MethodDelete, path); status != http.StatusNotFound {
+		t.Fatalf("deleting user again: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeleteUserDeletesTheDocumentsTheyOwn(t *testing.T) {
+	api := newTestAPI(t)
+	aliceID, aliceToken := api.signup(t, "alice")
+	bobID, bobToken := api.signup(t, "bob")
+	aliceDoc := api.createDocument(t, aliceToken, "alice's")
+	bobDoc := api.createDocument(t, bobToken, "bob's")
+	member := SetMemberPayload{UserID: aliceID, Role: store.RoleEditor}
+	if status := api.do(t, http.MethodPut, "/v1/documents/"+bobDoc+"/members", bobToken, member, nil); status != http.StatusOK {
+		t.Fatalf("adding member: status %d", status)
+	}
+	member = SetMemberPayload{UserID: bobID, Role: store.RoleEditor}
+	if status := api.do(t, http.MethodPut, "/v1/documents/"+aliceDoc+"/members", aliceToken, member, nil); status != http.StatusOK {
+		t.Fatalf("adding member: status %d", status)
+	}
+
+	bob := api.connect(t, bobToken, aliceDoc)
+	if status := api.admin(t, http.MethodDelete, "/v1/admin/users/"+strconv.FormatInt(aliceID, 10)); status != http.StatusNoContent {
+		t.Fatalf("deleting user: status %d", status)
+	}
+
+	// No one is left to manage alice's document, so it goes with her.
+	bob.expectClose(websocket.CloseDocumentDeleted)
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+aliceDoc, bobToken, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("getting the owner's document: status %d, want %d", status, http.StatusNotFound)
+	}
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+bobDoc, bobToken, nil, nil); status != http.StatusOK {
+		t.Fatalf("getting the document they were a member of: status %d", status)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	gorillaws "github.com/gorilla/websocket"
 	"github.com/vlkhvnn/DocCollab/internal/auth"
 	"github.com/vlkhvnn/DocCollab/internal/store"
 	"github.com/vlkhvnn/DocCollab/internal/websocket"
@@ -21,12 +27,22 @@ type application struct {
 	logger        *zap.SugaredLogger
 	authenticator auth.Authenticator
 	hub           *websocket.Hub
+	upgrader      gorillaws.Upgrader
 }
 
 type config struct {
-	addr string
-	db   dbconfig
-	auth authConfig
+	addr            string
+	allowedOrigins  []string
+	shutdownTimeout time.Duration
+	db              dbconfig
+	auth            authConfig
+	ws              websocket.Config
+	broker          brokerConfig
+}
+
+type brokerConfig struct {
+	kind     string
+	leaseTTL time.Duration
 }
 
 type dbconfig struct {
@@ -34,6 +50,7 @@ type dbconfig struct {
 	maxOpenConns int
 	maxIdleConns int
 	maxIdleTime  string
+	autoMigrate  bool
 }
 
 type authConfig struct {
@@ -47,36 +64,88 @@ type basicConfig struct {
 }
 
 type tokenConfig struct {
-	secret string
-	exp    time.Duration
-	iss    string
+	secret     string
+	keysDir    string
+	signingKID string
+	exp        time.Duration
+	refreshExp time.Duration
+	iss        string
+	aud        string
 }
 
 func (app *application) mount() *chi.Mux {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestLogger(redactTokenFormatter{
+		&middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+	}))
 	r.Use(middleware.Recoverer)
 	// Set up CORS middleware:
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedOrigins:   app.config.allowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value for the Access-Control-Max-Age header.
 	}))
 
+	r.Get("/.well-known/jwks.json", app.jwksHandler)
+
 	r.Route("/v1", func(r chi.Router) {
 		r.Get("/health", app.healthCheckHandler)
-		r.Get("/ws", app.serveWs)
+		r.With(app.AuthTokenMiddleware(websocketToken)).Get("/ws", app.serveWs)
 
 		// Public authentication routes.
 		r.Route("/auth", func(r chi.Router) {
 			r.Post("/register", app.signupHandler)
 			r.Post("/token", app.createTokenHandler)
+			r.Post("/refresh", app.refreshTokenHandler)
+			r.Post("/logout", app.logoutHandler)
+		})
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(app.BasicAuthMiddleware)
+
+			r.Get("/debug/vars", expvar.Handler().ServeHTTP)
+			r.Route("/users", func(r chi.Router) {
+				r.Get("/", app.listUsersHandler)
+				r.Delete("/{userID}", app.deleteUserHandler)
+			})
+			r.Route("/rooms", func(r chi.Router) {
+				r.Get("/", app.listRoomsHandler)
+				r.Delete("/{docID}", app.closeRoomHandler)
+			})
 		})
 
-		r.Post("/document", app.createDocumentHandler)
+		// Kept for clients created before the documents resource existed.
+		r.With(app.AuthTokenMiddleware(bearerToken)).Post("/document", app.createDocumentHandler)
+
+		r.Route("/documents", func(r chi.Router) {
+			r.Use(app.AuthTokenMiddleware(bearerToken))
+
+			r.Get("/", app.listDocumentsHandler)
+			r.Post("/", app.createDocumentHandler)
+
+			r.Route("/{docID}", func(r chi.Router) {
+				r.Get("/", app.getDocumentHandler)
+				r.Patch("/", app.updateDocumentHandler)
+				r.Delete("/", app.deleteDocumentHandler)
+
+				r.Route("/revisions", func(r chi.Router) {
+					r.Get("/", app.listRevisionsHandler)
+					r.Get("/{revision}", app.getRevisionHandler)
+					r.Post("/{revision}/restore", app.restoreRevisionHandler)
+				})
+
+				r.Get("/presence", app.getPresenceHandler)
+
+				r.Route("/members", func(r chi.Router) {
+					r.Get("/", app.listMembersHandler)
+					r.Put("/", app.setMemberHandler)
+					r.Delete("/{userID}", app.removeMemberHandler)
+				})
+			})
+		})
 	})
 	return r
 }
@@ -89,10 +158,33 @@ func (app *application) run(mux *chi.Mux) error {
 		ReadTimeout:  10 * time.Second,
 		IdleTimeout:  time.Minute,
 	}
-	log.Printf("server is listening on %s", app.config.addr)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Infow("shutting down server", "signal", s.String())
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		// Websocket connections are hijacked, so srv.Shutdown does not see
+		// them; the hub closes them and saves the rooms first.
+		if err := app.hub.Shutdown(ctx); err != nil {
+			app.logger.Errorw("failed to drain rooms", "error", err.Error())
+		}
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	app.logger.Infow("server is listening", "addr", app.config.addr)
 	err := srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
+	if err := <-shutdown; err != nil {
+		return err
+	}
+	app.logger.Infow("server stopped", "addr", app.config.addr)
 	return nil
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/auth"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	testAdminUser = "admin"
+	testAdminPass = "secret"
+)
+
+// testAPI is the whole API on memory storage and a memory broker.
+type testAPI struct {
+	app    *application
+	srv    *httptest.Server
+	broker websocket.Broker
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	storage := store.NewMemoryStorage()
+	cfg := config{
+		auth: authConfig{
+			basic: basicConfig{user: testAdminUser, pass: testAdminPass},
+			token: tokenConfig{secret: "test", exp: time.Hour, refreshExp: time.Hour, iss: "doccollab", aud: "doccollab-api"},
+		},
+		ws: websocket.Config{
+			PersistDebounce:  10 * time.Millisecond,
+			PersistMaxDelay:  50 * time.Millisecond,
+			PingPeriod:       time.Minute,
+			PongWait:         2 * time.Minute,
+			HandshakeTimeout: 5 * time.Second,
+			WriteWait:        5 * time.Second,
+			MaxMessageSize:   1 << 20,
+			SendQueueSize:    64,
+		},
+	}
+	broker := websocket.NewMemoryBroker()
+	hub, err := websocket.NewHub(&storage, broker, cfg.ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		config:        cfg,
+		store:         storage,
+		logger:        zap.NewNop().Sugar(),
+		authenticator: auth.NewJWTAuthenticator(auth.NewHMACKeySet(cfg.auth.token.secret), cfg.auth.token.aud, cfg.auth.token.iss, storage.Session),
+		hub:           hub,
+		upgrader:      newUpgrader(nil),
+	}
+	srv := httptest.NewServer(app.mount())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+		srv.Close()
+	})
+	return &testAPI{app: app, srv: srv, broker: broker}
+}
+
+// request builds a request to path with body encoded as JSON, if any.
+func (a *testAPI) request(t *testing.T, method, path string, body any) *http.Request {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, a.srv.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// do sends a request with token as its bearer token, decodes the data of
+// the response into out, if given, and returns the status.
+func (a *testAPI) do(t *testing.T, method, path, token string, body, out any) int {
+	t.Helper()
+	req := a.request(t, method, path, body)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return a.send(t, req, out)
+}
+
+// admin sends a request with the admin's basic auth credentials.
+func (a *testAPI) admin(t *testing.T, method, path string) int {
+	t.Helper()
+	req := a.request(t, method, path, nil)
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	return a.send(t, req, nil)
+}
+
+func (a *testAPI) send(t *testing.T, req *http.Request, out any) int {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		envelope := struct{ Data any }{Data: out}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// signup registers a user called name and logs them in, returning their
+// ID and access token.
+func (a *testAPI) signup(t *testing.T, name string) (int64, string) {
+	t.Helper()
+	var user store.User
+	payload := RegisterUserPayload{Username: name, Email: name + "@example.com", Password: "password"}
+	if status := a.do(t, http.MethodPost, "/v1/auth/register", "", payload, &user); status != http.StatusCreated {
+		t.Fatalf("registering %s: status %d", name, status)
+	}
+	var tokens TokenResponse
+	login := CreateUserTokenPayload{Email: payload.Email, Password: payload.Password}
+	if status := a.do(t, http.MethodPost, "/v1/auth/token", "", login, &tokens); status != http.StatusCreated {
+		t.Fatalf("logging in %s: status %d", name, status)
+	}
+	return user.ID, tokens.AccessToken
+}
+
+// createDocument creates a document with content as the owner of token.
+func (a *testAPI) createDocument(t *testing.T, token, content string) string {
+	t.Helper()
+	var doc store.Document
+	payload := CreateDocumentPayload{Content: content}
+	if status := a.do(t, http.MethodPost, "/v1/documents", token, payload, &doc); status != http.StatusCreated {
+		t.Fatalf("creating document: status %d", status)
+	}
+	return doc.DocID
+}
+
+// wsConn is a websocket connection to the test API.
+type wsConn struct {
+	t    *testing.T
+	conn *gorillaws.Conn
+}
+
+// connect opens a websocket to docID with token and reads up to the
+// initial sync.
+func (a *testAPI) connect(t *testing.T, token, docID string) *wsConn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(a.srv.URL, "http") + "/v1/ws?docID=" + docID + "&token=" + token
+	conn, _, err := gorillaws.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &wsConn{t: t, conn: conn}
+	if err := conn.WriteJSON(&websocket.Message{Type: websocket.TypeHello, Versions: []int{websocket.ProtocolVersion}}); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(websocket.TypeHello)
+	c.expect(websocket.TypeSync)
+	return c
+}
+
+// expect reads messages until one of type msgType arrives, skipping
+// presence updates.
+func (c *wsConn) expect(msgType string) *websocket.Message {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg websocket.Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return &msg
+		}
+		if msg.Type != websocket.TypePresence {
+			c.t.Fatalf("got %s message %q, want %s", msg.Type, msg.Text, msgType)
+		}
+	}
+}
+
+// expectPresence reads until a presence message with event arrives.
+func (c *wsConn) expectPresence(event string) *websocket.Message {
+	c.t.Helper()
+	for {
+		if msg := c.expect(websocket.TypePresence); msg.Event == event {
+			return msg
+		}
+	}
+}
+
+// expectClose reads until the connection is closed and checks the code.
+func (c *wsConn) expectClose(code int) {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := c.conn.ReadMessage()
+		var closeErr *gorillaws.CloseError
+		switch {
+		case errors.As(err, &closeErr):
+			if closeErr.Code != code {
+				c.t.Fatalf("closed with %d, want %d", closeErr.Code, code)
+			}
+			return
+		case err != nil:
+			c.t.Fatalf("waiting for close %d: %v", code, err)
+		}
+	}
+}
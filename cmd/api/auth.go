@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/vlkhvnn/DocCollab/internal/store"
 )
 
@@ -20,6 +26,19 @@ type CreateUserTokenPayload struct {
 	Password string `json:"password" validate:"required,min=3,max=72"`
 }
 
+type RefreshTokenPayload struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// TokenResponse is what logging in and refreshing return. The access token
+// expires at ExpiresAt; the refresh token gets a new pair until it expires
+// or the login is revoked.
+type TokenResponse struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
 func (app *application) signupHandler(w http.ResponseWriter, r *http.Request) {
 	var payload RegisterUserPayload
 	if err := readJSON(w, r, &payload); err != nil {
@@ -45,10 +64,12 @@ func (app *application) signupHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	if err := app.store.User.Create(ctx, user); err != nil {
-		if err == store.ErrDuplicateEmail || err == store.ErrDuplicateUsername {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		} else {
-			http.Error(w, "Could not create user", http.StatusInternalServerError)
+		var constraintErr *store.ConstraintError
+		switch {
+		case errors.As(err, &constraintErr):
+			app.conflictResponse(w, r, constraintErr)
+		default:
+			app.internalServerError(w, r, err)
 		}
 		return
 	}
@@ -84,20 +105,171 @@ func (app *application) createTokenHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	session, refreshToken, err := app.newSession()
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	session.UserID = user.ID
+	session.Family = uuid.NewString()
+	tokens, err := app.issueTokens(session, refreshToken)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.store.Session.Create(r.Context(), session); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	app.writeTokens(w, r, tokens)
+}
+
+// refreshTokenHandler exchanges a refresh token for a new access token and
+// a new refresh token. Each refresh token works once; presenting one again
+// revokes the login it belongs to. The old token is only used up if the
+// new access token could be signed.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var payload RefreshTokenPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	session, refreshToken, err := app.newSession()
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	var tokens *TokenResponse
+	err = app.store.Session.Rotate(r.Context(), hashRefreshToken(payload.RefreshToken), session, func(session *store.Session) (err error) {
+		tokens, err = app.issueTokens(session, refreshToken)
+		return err
+	})
+	if err != nil {
+		switch err {
+		case store.ErrNotFound, store.ErrSessionExpired, store.ErrSessionRevoked:
+			app.unauthorizedErrorResponse(w, r, err)
+		case store.ErrSessionReused:
+			app.logger.Warnw("refresh token reused, session revoked", "userID", session.UserID, "family", session.Family)
+			app.unauthorizedErrorResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	app.writeTokens(w, r, tokens)
+}
+
+// logoutHandler revokes the login the refresh token belongs to, along with
+// every access token issued for it.
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	var payload RefreshTokenPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if err := app.store.Session.Revoke(r.Context(), hashRefreshToken(payload.RefreshToken)); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.unauthorizedErrorResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newSession generates a refresh token and the session recording it. The
+// caller fills in the user and family and stores the session.
+func (app *application) newSession() (*store.Session, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session := &store.Session{
+		TokenHash: hashRefreshToken(token),
+		AccessJTI: uuid.NewString(),
+		ExpiresAt: time.Now().Add(app.config.auth.token.refreshExp),
+	}
+	return session, token, nil
+}
+
+// hashRefreshToken returns what is stored in place of a refresh token, so
+// a leaked sessions table cannot be used to log in.
+func hashRefreshToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// issueTokens signs a new access token for session, to be handed out with
+// its refresh token once the session is stored.
+func (app *application) issueTokens(session *store.Session, refreshToken string) (*TokenResponse, error) {
+	now := time.Now()
+	expiresAt := now.Add(app.config.auth.token.exp)
 	claims := jwt.MapClaims{
-		"sub": user.ID,
-		"exp": time.Now().Add(app.config.auth.token.exp).Unix(),
-		"iat": time.Now().Unix(),
-		"nbf": time.Now().Unix(),
+		"sub": strconv.FormatInt(session.UserID, 10),
+		"jti": session.AccessJTI,
+		"exp": expiresAt.Unix(),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
 		"iss": app.config.auth.token.iss,
-		"aud": app.config.auth.token.iss,
+		"aud": app.config.auth.token.aud,
 	}
 	token, err := app.authenticator.GenerateToken(claims)
 	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// writeTokens responds with tokens issued for a stored session.
+func (app *application) writeTokens(w http.ResponseWriter, r *http.Request, tokens *TokenResponse) {
+	if err := app.jsonResponse(w, http.StatusCreated, tokens); err != nil {
 		app.internalServerError(w, r, err)
-		return
 	}
-	if err := app.jsonResponse(w, http.StatusCreated, token); err != nil {
+}
+
+// userIDFromToken returns the user ID stored in the sub claim of a validated
+// token. Tokens issued before sub became a string carry it as a number.
+func userIDFromToken(token *jwt.Token) (int64, error) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, errors.New("unexpected token claims")
+	}
+	var sub string
+	switch v := claims["sub"].(type) {
+	case string:
+		sub = v
+	case float64:
+		sub = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	userID, err := strconv.ParseInt(sub, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sub claim: %w", err)
+	}
+	return userID, nil
+}
+
+// jwksHandler publishes the public keys access tokens are signed with, so
+// other services can verify them without sharing a secret.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := writeJSON(w, http.StatusOK, app.authenticator.JWKS()); err != nil {
 		app.internalServerError(w, r, err)
 	}
 }
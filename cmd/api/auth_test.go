@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vlkhvnn/DocCollab/internal/auth"
+)
+
+// tokenClaims returns the claims of an access token without verifying it.
+func tokenClaims(t *testing.T, token string) jwt.MapClaims {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestAccessTokenSubject(t *testing.T) {
+	api := newTestAPI(t)
+	aliceID, token := api.signup(t, "alice")
+	claims := tokenClaims(t, token)
+	if _, ok := claims["sub"].(string); !ok {
+		t.Fatalf("sub is %T, want a string", claims["sub"])
+	}
+	if claims["iss"] != "doccollab" || claims["aud"] != "doccollab-api" {
+		t.Fatalf("issued by %v for %v", claims["iss"], claims["aud"])
+	}
+
+	// Tokens issued before sub became a string are honored until they
+	// expire.
+	docID := api.createDocument(t, token, "hello")
+	claims["sub"] = float64(aliceID)
+	legacy, err := api.app.authenticator.GenerateToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+docID, legacy, nil, nil); status != http.StatusOK {
+		t.Fatalf("token with a numeric sub: status %d", status)
+	}
+}
+
+// login logs the user called name in again, returning a new pair of tokens.
+func (a *testAPI) login(t *testing.T, name string) *TokenResponse {
+	t.Helper()
+	var tokens TokenResponse
+	payload := CreateUserTokenPayload{Email: name + "@example.com", Password: "password"}
+	if status := a.do(t, http.MethodPost, "/v1/auth/token", "", payload, &tokens); status != http.StatusCreated {
+		t.Fatalf("logging in %s: status %d", name, status)
+	}
+	return &tokens
+}
+
+// refresh exchanges refreshToken for a new pair of tokens and returns the
+// status along with them.
+func (a *testAPI) refresh(t *testing.T, refreshToken string) (int, *TokenResponse) {
+	t.Helper()
+	var tokens TokenResponse
+	status := a.do(t, http.MethodPost, "/v1/auth/refresh", "", RefreshTokenPayload{RefreshToken: refreshToken}, &tokens)
+	return status, &tokens
+}
+
+// authorized reports whether the API accepts token.
+func (a *testAPI) authorized(t *testing.T, token string) bool {
+	t.Helper()
+	return a.do(t, http.MethodGet, "/v1/documents", token, nil, nil) == http.StatusOK
+}
+
+func TestLoginChecksCredentials(t *testing.T) {
+	api := newTestAPI(t)
+	api.signup(t, "alice")
+	for _, payload := range []CreateUserTokenPayload{
+		{Email: "alice@example.com", Password: "wrong"},
+		{Email: "nobody@example.com", Password: "password"},
+	} {
+		if status := api.do(t, http.MethodPost, "/v1/auth/token", "", payload, nil); status != http.StatusUnauthorized {
+			t.Errorf("logging in as %s with %q: status %d, want %d", payload.Email, payload.Password, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	api := newTestAPI(t)
+	api.signup(t, "alice")
+	first := api.login(t, "alice")
+
+	status, second := api.refresh(t, first.RefreshToken)
+	if status != http.StatusCreated {
+		t.Fatalf("refreshing: status %d", status)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Fatal("refreshing returned the same tokens")
+	}
+	if !api.authorized(t, second.AccessToken) {
+		t.Fatal("refreshed access token was refused")
+	}
+	status, third := api.refresh(t, second.RefreshToken)
+	if status != http.StatusCreated {
+		t.Fatalf("refreshing again: status %d", status)
+	}
+
+	// Presenting a used refresh token again means it may have been stolen,
+	// so the whole login is revoked, including the tokens issued since.
+	if status, _ := api.refresh(t, first.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("reusing a refresh token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := api.refresh(t, third.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("refreshing after reuse: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if api.authorized(t, third.AccessToken) {
+		t.Fatal("access token of a revoked login was accepted")
+	}
+
+	// Other logins of the same user are unaffected.
+	other := api.login(t, "alice")
+	if !api.authorized(t, other.AccessToken) {
+		t.Fatal("access token of another login was refused")
+	}
+}
+
+func TestRefreshRefusesBadTokens(t *testing.T) {
+	api := newTestAPI(t)
+	api.signup(t, "alice")
+	if status, _ := api.refresh(t, "nonsense"); status != http.StatusUnauthorized {
+		t.Fatalf("unknown refresh token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := api.refresh(t, ""); status != http.StatusBadRequest {
+		t.Fatalf("missing refresh token: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	api.app.config.auth.token.refreshExp = time.Millisecond
+	tokens := api.login(t, "alice")
+	time.Sleep(10 * time.Millisecond)
+	if status, _ := api.refresh(t, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("expired refresh token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLogoutRevokesTheLogin(t *testing.T) {
+	api := newTestAPI(t)
+	api.signup(t, "alice")
+	tokens := api.login(t, "alice")
+	other := api.login(t, "alice")
+
+	if status := api.do(t, http.MethodPost, "/v1/auth/logout", "", RefreshTokenPayload{RefreshToken: tokens.RefreshToken}, nil); status != http.StatusNoContent {
+		t.Fatalf("logging out: status %d", status)
+	}
+	if api.authorized(t, tokens.AccessToken) {
+		t.Fatal("access token was accepted after logging out")
+	}
+	if status, _ := api.refresh(t, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("refreshing after logging out: status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if !api.authorized(t, other.AccessToken) {
+		t.Fatal("logging out revoked another login")
+	}
+	if status := api.do(t, http.MethodPost, "/v1/auth/logout", "", RefreshTokenPayload{RefreshToken: "nonsense"}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("logging out with an unknown token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	api := newTestAPI(t)
+	resp, err := http.Get(api.srv.URL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc == "" {
+		t.Fatal("the key set is served without caching headers")
+	}
+	// The test API signs with a shared secret, which is never published.
+	var jwks auth.JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
+	}
+	if jwks.Keys == nil || len(jwks.Keys) != 0 {
+		t.Fatalf("published %+v, want an empty key list", jwks.Keys)
+	}
+}
@@ -1,54 +1,242 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
 )
 
 type CreateDocumentPayload struct {
-	Content string `json:"content"`
+	Content       string `json:"content"`
+	MergeStrategy string `json:"merge_strategy" validate:"omitempty,oneof=ot crdt"`
 }
 
+type UpdateDocumentPayload struct {
+	Content *string `json:"content" validate:"required"`
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// liveContentTimeout bounds how long a read waits for the live rooms of
+// its documents on other instances before settling for stored content.
+const liveContentTimeout = time.Second
+
 func (app *application) createDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	// Check Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		app.unauthorizedErrorResponse(w, r, errors.New("missing authorization header"))
+	userID := getUserFromContext(r).ID
+
+	// Decode payload (the docID is generated here)
+	var payload CreateDocumentPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	doc := &store.Document{
+		DocID:         uuid.New().String(),
+		Content:       payload.Content,
+		MergeStrategy: payload.MergeStrategy,
+	}
+	if doc.MergeStrategy == "" {
+		doc.MergeStrategy = websocket.StrategyOT
+	}
+
+	ctx := r.Context()
+	if err := app.store.Document.CreateDocument(ctx, doc, userID); err != nil {
+		var constraintErr *store.ConstraintError
+		switch {
+		case errors.As(err, &constraintErr):
+			app.conflictResponse(w, r, constraintErr)
+		default:
+			app.internalServerError(w, r, err)
+		}
 		return
 	}
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-	tokenStr = strings.TrimSpace(tokenStr)
-	_, err := app.authenticator.ValidateToken(tokenStr)
+
+	// Return the created document as JSON.
+	app.jsonResponse(w, http.StatusCreated, doc)
+}
+
+func (app *application) listDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	limit, offset, err := parsePagination(r)
 	if err != nil {
-		app.unauthorizedErrorResponse(w, r, errors.New("invalid token"))
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	// Decode payload (only content is provided by the client)
-	var payload CreateDocumentPayload
+	docs, err := app.store.Document.ListDocumentsForUser(r.Context(), userID, limit, offset)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	app.withLiveContent(r.Context(), docs...)
+	if err := app.jsonResponse(w, http.StatusOK, docs); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) getDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleViewer); !ok {
+		return
+	}
+
+	doc, err := app.store.Document.GetDocumentByDocID(r.Context(), docID)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	app.withLiveContent(r.Context(), doc)
+	if err := app.jsonResponse(w, http.StatusOK, doc); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) updateDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleEditor); !ok {
+		return
+	}
+
+	var payload UpdateDocumentPayload
 	if err := readJSON(w, r, &payload); err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
 
-	newDocID := uuid.New().String()
-
+	// Connected editors must see the change, so it goes through the live
+	// room when there is one, on whichever instance. The room persists it.
 	ctx := r.Context()
-	if err := app.store.Document.CreateDocument(ctx, newDocID, payload.Content); err != nil {
-		app.internalServerError(w, r, err)
+	err := app.hub.Replace(ctx, docID, *payload.Content, userID)
+	if errors.Is(err, websocket.ErrNoRoom) {
+		_, err = app.store.Document.UpdateDocument(ctx, docID, *payload.Content, userID)
+	}
+	if err != nil {
+		var constraintErr *store.ConstraintError
+		switch {
+		case err == store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		case errors.As(err, &constraintErr):
+			app.conflictResponse(w, r, constraintErr)
+		default:
+			app.internalServerError(w, r, err)
+		}
 		return
 	}
 
-	// Retrieve the document (to get timestamps, etc.)
-	doc, err := app.store.Document.GetDocumentByDocID(ctx, newDocID)
+	doc, err := app.store.Document.GetDocumentByDocID(ctx, docID)
 	if err != nil {
 		app.internalServerError(w, r, err)
 		return
 	}
+	doc.Content = *payload.Content
+	if err := app.jsonResponse(w, http.StatusOK, doc); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
 
-	// Return the created document as JSON.
-	app.jsonResponse(w, http.StatusCreated, doc)
+func (app *application) deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleOwner); !ok {
+		return
+	}
+
+	if err := app.store.Document.DeleteDocument(r.Context(), docID); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	if err := app.hub.CloseRoom(r.Context(), docID, websocket.CloseDocumentDeleted, "document deleted", false); err != nil {
+		// The document is gone either way; its clients find out when their
+		// room next touches the store.
+		app.logger.Warnw("failed to close room of deleted document", "docID", docID, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withLiveContent replaces the stored content of docs with that of their
+// live rooms, which may hold edits that have not been persisted yet. A room
+// that cannot be reached within liveContentTimeout, for example because
+// its instance has crashed, leaves the stored content in place.
+func (app *application) withLiveContent(ctx context.Context, docs ...*store.Document) {
+	ctx, cancel := context.WithTimeout(ctx, liveContentTimeout)
+	defer cancel()
+	for _, doc := range docs {
+		content, err := app.hub.Content(ctx, doc.DocID)
+		switch {
+		case errors.Is(err, websocket.ErrNoRoom):
+		case err != nil:
+			app.logger.Warnw("serving stored content of unreachable room", "docID", doc.DocID, "error", err)
+		default:
+			doc.Content = content
+		}
+	}
+}
+
+// parsePagination reads the limit and offset query parameters.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit, offset = defaultPageLimit, 0
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// authorizeDocument checks that userID holds at least min on docID. If not,
+// it writes the error response and returns false. Non-members get a 404 so
+// document IDs cannot be probed.
+func (app *application) authorizeDocument(w http.ResponseWriter, r *http.Request, docID string, userID int64, min store.Role) (store.Role, bool) {
+	role, err := app.store.Member.GetRole(r.Context(), docID, userID)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return "", false
+	}
+	if !role.AtLeast(min) {
+		app.forbiddenResponse(w, r)
+		return "", false
+	}
+	return role, true
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+func TestReadsFallBackToStoredContentWhenTheRoomIsUnreachable(t *testing.T) {
+	api := newTestAPI(t)
+	_, token := api.signup(t, "alice")
+	docID := api.createDocument(t, token, "stored")
+
+	// Another instance took the document and crashed without releasing it.
+	if _, err := api.broker.Acquire(context.Background(), docID, "crashed"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var doc store.Document
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+docID, token, nil, &doc); status != http.StatusOK {
+		t.Fatalf("getting the document: status %d", status)
+	}
+	if doc.Content != "stored" {
+		t.Fatalf("got %q, want the stored content", doc.Content)
+	}
+	var docs []store.Document
+	if status := api.do(t, http.MethodGet, "/v1/documents", token, nil, &docs); status != http.StatusOK {
+		t.Fatalf("listing documents: status %d", status)
+	}
+	if len(docs) != 1 || docs[0].Content != "stored" {
+		t.Fatalf("listed %+v, want the stored content", docs)
+	}
+	if elapsed := time.Since(start); elapsed > 4*liveContentTimeout {
+		t.Fatalf("reads took %s", elapsed)
+	}
+}
+
+// share makes userID a member of docID with role, as the owner of token.
+func (a *testAPI) share(t *testing.T, token, docID string, userID int64, role store.Role) {
+	t.Helper()
+	payload := SetMemberPayload{UserID: userID, Role: role}
+	if status := a.do(t, http.MethodPut, "/v1/documents/"+docID+"/members", token, payload, nil); status != http.StatusOK {
+		t.Fatalf("sharing %s as %s: status %d", docID, role, status)
+	}
+}
+
+func TestDocumentResource(t *testing.T) {
+	api := newTestAPI(t)
+	_, token := api.signup(t, "alice")
+	docID := api.createDocument(t, token, "hello")
+	path := "/v1/documents/" + docID
+
+	var doc store.Document
+	if status := api.do(t, http.MethodGet, path, token, nil, &doc); status != http.StatusOK {
+		t.Fatalf("getting the document: status %d", status)
+	}
+	if doc.DocID != docID || doc.Content != "hello" {
+		t.Fatalf("got %+v", doc)
+	}
+
+	content := "goodbye"
+	if status := api.do(t, http.MethodPatch, path, token, UpdateDocumentPayload{Content: &content}, &doc); status != http.StatusOK {
+		t.Fatalf("updating the document: status %d", status)
+	}
+	if doc.Content != content {
+		t.Fatalf("update returned %q, want %q", doc.Content, content)
+	}
+	doc = store.Document{}
+	api.do(t, http.MethodGet, path, token, nil, &doc)
+	if doc.Content != content {
+		t.Fatalf("got %q after the update, want %q", doc.Content, content)
+	}
+	if status := api.do(t, http.MethodPatch, path, token, struct{}{}, nil); status != http.StatusBadRequest {
+		t.Fatalf("updating without content: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status := api.do(t, http.MethodDelete, path, token, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("deleting the document: status %d", status)
+	}
+	if status := api.do(t, http.MethodGet, path, token, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("getting the deleted document: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestListDocuments(t *testing.T) {
+	api := newTestAPI(t)
+	_, alice := api.signup(t, "alice")
+	_, bob := api.signup(t, "bob")
+	for range 3 {
+		api.createDocument(t, alice, "alice's")
+	}
+	api.createDocument(t, bob, "bob's")
+
+	var docs []store.Document
+	if status := api.do(t, http.MethodGet, "/v1/documents", alice, nil, &docs); status != http.StatusOK {
+		t.Fatalf("listing documents: status %d", status)
+	}
+	if len(docs) != 3 {
+		t.Fatalf("listed %d documents, want 3", len(docs))
+	}
+	for _, doc := range docs {
+		if doc.Content != "alice's" {
+			t.Fatalf("listed %q, which is not alice's", doc.Content)
+		}
+	}
+
+	var page []store.Document
+	if status := api.do(t, http.MethodGet, "/v1/documents?limit=2&offset=2", alice, nil, &page); status != http.StatusOK {
+		t.Fatalf("listing a page: status %d", status)
+	}
+	if len(page) != 1 || page[0].DocID != docs[2].DocID {
+		t.Fatalf("got page %+v, want the third document", page)
+	}
+
+	for _, query := range []string{"limit=0", "limit=101", "limit=x", "offset=-1"} {
+		if status := api.do(t, http.MethodGet, "/v1/documents?"+query, alice, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDocumentAuthorization(t *testing.T) {
+	api := newTestAPI(t)
+	_, alice := api.signup(t, "alice")
+	bobID, bob := api.signup(t, "bob")
+	_, carol := api.signup(t, "carol")
+	docID := api.createDocument(t, alice, "hello")
+	api.share(t, alice, docID, bobID, store.RoleViewer)
+	path := "/v1/documents/" + docID
+	content := "changed"
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   any
+		want   int
+	}{
+		{name: "viewer reads", method: http.MethodGet, path: path, token: bob, want: http.StatusOK},
+		{name: "viewer updates", method: http.MethodPatch, path: path, token: bob, body: UpdateDocumentPayload{Content: &content}, want: http.StatusForbidden},
+		{name: "viewer deletes", method: http.MethodDelete, path: path, token: bob, want: http.StatusForbidden},
+		{name: "non-member reads", method: http.MethodGet, path: path, token: carol, want: http.StatusNotFound},
+		{name: "non-member deletes", method: http.MethodDelete, path: path, token: carol, want: http.StatusNotFound},
+		{name: "missing document", method: http.MethodGet, path: "/v1/documents/missing", token: alice, want: http.StatusNotFound},
+		{name: "no token", method: http.MethodGet, path: path, want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := api.do(t, tc.method, tc.path, tc.token, tc.body, nil); status != tc.want {
+				t.Fatalf("got status %d, want %d", status, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeleteDocumentDisconnectsItsClients(t *testing.T) {
+	api := newTestAPI(t)
+	_, token := api.signup(t, "alice")
+	docID := api.createDocument(t, token, "hello")
+	conn := api.connect(t, token, docID)
+
+	if status := api.do(t, http.MethodDelete, "/v1/documents/"+docID, token, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("deleting the document: status %d", status)
+	}
+	conn.expectClose(websocket.CloseDocumentDeleted)
+	if _, ok := api.app.hub.Lookup(docID); ok {
+		t.Fatal("the deleted document's room is still open")
+	}
+}
+
+func TestReadsServeLiveContent(t *testing.T) {
+	api := newTestAPI(t)
+	_, token := api.signup(t, "alice")
+	docID := api.createDocument(t, token, "hello")
+	conn := api.connect(t, token, docID)
+	op := &websocket.Message{Type: websocket.TypeOp, Revision: 0, Position: 0, Text: "oh, "}
+	if err := conn.conn.WriteJSON(op); err != nil {
+		t.Fatal(err)
+	}
+	conn.expect(websocket.TypeAck)
+
+	var doc store.Document
+	api.do(t, http.MethodGet, "/v1/documents/"+docID, token, nil, &doc)
+	if doc.Content != "oh, hello" {
+		t.Fatalf("got %q, want the room's content", doc.Content)
+	}
+}
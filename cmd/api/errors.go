@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
 )
 
 func (app *application) internalServerError(w http.ResponseWriter, r *http.Request, err error) {
@@ -24,6 +27,30 @@ func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request,
 	writeJSONError(w, http.StatusNotFound, "not found")
 }
 
+// conflictResponse reports a write the database's constraints rejected,
+// naming the field at fault, when known, so clients can point at it.
+func (app *application) conflictResponse(w http.ResponseWriter, r *http.Request, err *store.ConstraintError) {
+	app.logger.Warnw("conflict", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+
+	problem := "is not allowed"
+	switch {
+	case errors.Is(err, store.ErrUniqueViolation):
+		problem = "already exists"
+	case errors.Is(err, store.ErrForeignKeyViolation):
+		problem = "does not exist"
+	}
+	type envelope struct {
+		Error  string            `json:"error"`
+		Fields map[string]string `json:"fields,omitempty"`
+	}
+	body := &envelope{Error: "a value " + problem}
+	if err.Field != "" {
+		body.Error = err.Field + " " + problem
+		body.Fields = map[string]string{err.Field: problem}
+	}
+	writeJSON(w, http.StatusConflict, body)
+}
+
 func (app *application) unauthorizedErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logger.Warnf("unauthorized error", "method", r.Method, "path", r.URL.Path, "error", err.Error())
 	writeJSONError(w, http.StatusUnauthorized, "unauthorizedd")
@@ -35,6 +62,11 @@ func (app *application) unauthorizedBasicErrorResponse(w http.ResponseWriter, r
 	writeJSONError(w, http.StatusUnauthorized, "unauthorizedd")
 }
 
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Warnw("service unavailable", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+	writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter string) {
 	app.logger.Warnw("rate limit exceeded", "method", r.Method, "path", r.URL.Path)
 	w.Header().Set("Retry-After", retryAfter)
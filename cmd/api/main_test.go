@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/db"
+)
+
+func TestCheckSchema(t *testing.T) {
+	conn, err := db.New("sqlite://"+filepath.Join(t.TempDir(), "api.db"), 1, 1, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := checkSchema(conn, db.SQLite, false); err == nil {
+		t.Fatal("started on an unmigrated database")
+	}
+	if err := checkSchema(conn, db.SQLite, true); err != nil {
+		t.Fatalf("migrating at startup: %v", err)
+	}
+	if err := checkSchema(conn, db.SQLite, false); err != nil {
+		t.Fatalf("starting on a migrated database: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+type SetMemberPayload struct {
+	UserID int64      `json:"user_id" validate:"required"`
+	Role   store.Role `json:"role" validate:"required,oneof=editor commenter viewer"`
+}
+
+func (app *application) listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleViewer); !ok {
+		return
+	}
+
+	members, err := app.store.Member.List(r.Context(), docID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.jsonResponse(w, http.StatusOK, members); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) setMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleOwner); !ok {
+		return
+	}
+
+	var payload SetMemberPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	if _, err := app.store.User.GetById(ctx, payload.UserID); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	current, err := app.store.Member.GetRole(ctx, docID, payload.UserID)
+	if err != nil && err != store.ErrNotFound {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if current == store.RoleOwner {
+		app.badRequestResponse(w, r, errors.New("the owner's role cannot be changed"))
+		return
+	}
+
+	member := &store.Member{
+		DocID:  docID,
+		UserID: payload.UserID,
+		Role:   payload.Role,
+	}
+	if err := app.store.Member.Set(ctx, member); err != nil {
+		var constraintErr *store.ConstraintError
+		switch {
+		case errors.As(err, &constraintErr):
+			app.conflictResponse(w, r, constraintErr)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	app.applyRole(ctx, docID, member.UserID, member.Role)
+	if err := app.jsonResponse(w, http.StatusOK, member); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleOwner); !ok {
+		return
+	}
+
+	memberID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if memberID == userID {
+		app.badRequestResponse(w, r, errors.New("the owner cannot be removed"))
+		return
+	}
+
+	if err := app.store.Member.Remove(r.Context(), docID, memberID); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	app.applyRole(r.Context(), docID, memberID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyRole holds userID's open connections to docID to the role they now
+// have, closing them if role is empty, so that websocket clients get no
+// more access than the REST API gives them. If their room cannot be
+// reached it is closed instead, and its clients reconnect with their
+// stored role.
+func (app *application) applyRole(ctx context.Context, docID string, userID int64, role store.Role) {
+	err := app.hub.SetRole(ctx, docID, userID, role)
+	if err == nil {
+		return
+	}
+	app.logger.Warnw("failed to update role on open connections, closing room", "docID", docID, "userID", userID, "error", err)
+	err = app.hub.CloseRoom(ctx, docID, websocket.CloseRoomClosed, "membership changed", true)
+	if err != nil {
+		app.logger.Errorw("failed to close room after membership change", "docID", docID, "error", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+// TestMembershipChangesReachOpenConnections checks that a websocket client
+// is held to the same role as the REST API gives its user, as the role
+// changes while it is connected.
+func TestMembershipChangesReachOpenConnections(t *testing.T) {
+	api := newTestAPI(t)
+	_, aliceToken := api.signup(t, "alice")
+	bobID, bobToken := api.signup(t, "bob")
+	docID := api.createDocument(t, aliceToken, "hello")
+	members := "/v1/documents/" + docID + "/members"
+	setRole := func(role store.Role) {
+		t.Helper()
+		payload := SetMemberPayload{UserID: bobID, Role: role}
+		if status := api.do(t, http.MethodPut, members, aliceToken, payload, nil); status != http.StatusOK {
+			t.Fatalf("setting role %s: status %d", role, status)
+		}
+	}
+	splice := func(bob *wsConn, revision int, text string) {
+		t.Helper()
+		op := &websocket.Message{Type: websocket.TypeOp, Revision: revision, Position: 0, Text: text}
+		if err := bob.conn.WriteJSON(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setRole(store.RoleEditor)
+	bob := api.connect(t, bobToken, docID)
+	splice(bob, 0, "1")
+	bob.expect(websocket.TypeAck)
+
+	setRole(store.RoleViewer)
+	if msg := bob.expect(websocket.TypeRole); msg.Role != store.RoleViewer {
+		t.Fatalf("got role %q, want %q", msg.Role, store.RoleViewer)
+	}
+	splice(bob, 1, "2")
+	if msg := bob.expect(websocket.TypeError); msg.Code != websocket.CodeReadOnly {
+		t.Fatalf("got error %q, want %q", msg.Code, websocket.CodeReadOnly)
+	}
+	update := UpdateDocumentPayload{Content: new(string)}
+	if status := api.do(t, http.MethodPatch, "/v1/documents/"+docID, bobToken, update, nil); status != http.StatusForbidden {
+		t.Fatalf("viewer updating over REST: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	setRole(store.RoleEditor)
+	if msg := bob.expect(websocket.TypeRole); msg.Role != store.RoleEditor {
+		t.Fatalf("got role %q, want %q", msg.Role, store.RoleEditor)
+	}
+	splice(bob, 1, "3")
+	bob.expect(websocket.TypeAck)
+
+	var doc store.Document
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+docID, aliceToken, nil, &doc); status != http.StatusOK {
+		t.Fatalf("getting document: status %d", status)
+	}
+	if doc.Content != "31hello" {
+		t.Fatalf("content is %q, want %q", doc.Content, "31hello")
+	}
+
+	if status := api.do(t, http.MethodDelete, members+"/"+strconv.FormatInt(bobID, 10), aliceToken, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("removing member: status %d", status)
+	}
+	bob.expectClose(websocket.CloseAccessRevoked)
+	if status := api.do(t, http.MethodGet, "/v1/documents/"+docID, bobToken, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("removed member over REST: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestOwnerKeepsTheirRole(t *testing.T) {
+	api := newTestAPI(t)
+	aliceID, aliceToken := api.signup(t, "alice")
+	docID := api.createDocument(t, aliceToken, "hello")
+	members := "/v1/documents/" + docID + "/members"
+
+	demote := SetMemberPayload{UserID: aliceID, Role: store.RoleEditor}
+	if status := api.do(t, http.MethodPut, members, aliceToken, demote, nil); status != http.StatusBadRequest {
+		t.Fatalf("demoting the owner: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := api.do(t, http.MethodDelete, members+"/"+strconv.FormatInt(aliceID, 10), aliceToken, nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("removing the owner: status %d, want %d", status, http.StatusBadRequest)
+	}
+	role, err := api.app.store.Member.GetRole(context.Background(), docID, aliceID)
+	if err != nil || role != store.RoleOwner {
+		t.Fatalf("owner's role is %q, %v", role, err)
+	}
+}
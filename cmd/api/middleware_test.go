@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/auth"
+)
+
+func TestAuthTokenMiddleware(t *testing.T) {
+	api := newTestAPI(t)
+	_, alice := api.signup(t, "alice")
+	bobID, bob := api.signup(t, "bob")
+	if status := api.admin(t, http.MethodDelete, "/v1/admin/users/"+strconv.FormatInt(bobID, 10)); status != http.StatusNoContent {
+		t.Fatalf("deleting bob: status %d", status)
+	}
+
+	expiredClaims := tokenClaims(t, alice)
+	expiredClaims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expired, err := api.app.authenticator.GenerateToken(expiredClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := auth.NewJWTAuthenticator(auth.NewHMACKeySet("other"), "doccollab-api", "doccollab", nil).GenerateToken(tokenClaims(t, alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "valid", header: "Bearer " + alice, want: http.StatusOK},
+		{name: "no header", want: http.StatusUnauthorized},
+		{name: "no token", header: "Bearer ", want: http.StatusUnauthorized},
+		{name: "malformed", header: "Bearer nonsense", want: http.StatusUnauthorized},
+		{name: "expired", header: "Bearer " + expired, want: http.StatusUnauthorized},
+		{name: "signed with another key", header: "Bearer " + forged, want: http.StatusUnauthorized},
+		{name: "deleted user", header: "Bearer " + bob, want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := api.request(t, http.MethodGet, "/v1/documents", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if status := api.send(t, req, nil); status != tc.want {
+				t.Fatalf("got status %d, want %d", status, tc.want)
+			}
+		})
+	}
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	api := newTestAPI(t)
+	for _, tc := range []struct {
+		name       string
+		user, pass string
+		want       int
+	}{
+		{name: "valid", user: testAdminUser, pass: testAdminPass, want: http.StatusOK},
+		{name: "no credentials", want: http.StatusUnauthorized},
+		{name: "wrong password", user: testAdminUser, pass: "wrong", want: http.StatusUnauthorized},
+		{name: "wrong user", user: "root", pass: testAdminPass, want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := api.request(t, http.MethodGet, "/v1/admin/users", nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.pass)
+			}
+			if status := api.send(t, req, nil); status != tc.want {
+				t.Fatalf("got status %d, want %d", status, tc.want)
+			}
+		})
+	}
+
+	// Without configured credentials, nobody is let in.
+	api.app.config.auth.basic = basicConfig{}
+	if status := api.admin(t, http.MethodGet, "/v1/admin/users"); status != http.StatusUnauthorized {
+		t.Fatalf("unconfigured basic auth: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+func (app *application) getPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleViewer); !ok {
+		return
+	}
+
+	users, err := app.hub.Presence(r.Context(), docID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.jsonResponse(w, http.StatusOK, users); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
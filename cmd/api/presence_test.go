@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+func TestPresenceEndpoint(t *testing.T) {
+	api := newTestAPI(t)
+	aliceID, alice := api.signup(t, "alice")
+	_, bob := api.signup(t, "bob")
+	docID := api.createDocument(t, alice, "hello")
+	path := "/v1/documents/" + docID + "/presence"
+
+	var users []websocket.Presence
+	if status := api.do(t, http.MethodGet, path, alice, nil, &users); status != http.StatusOK {
+		t.Fatalf("getting presence: status %d", status)
+	}
+	if len(users) != 0 {
+		t.Fatalf("presence of a closed document is %+v, want nobody", users)
+	}
+
+	api.connect(t, alice, docID)
+	api.do(t, http.MethodGet, path, alice, nil, &users)
+	want := websocket.Presence{UserID: aliceID, Username: "alice", Connections: 1}
+	if len(users) != 1 || users[0] != want {
+		t.Fatalf("presence is %+v, want %+v", users, want)
+	}
+
+	if status := api.do(t, http.MethodGet, path, bob, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("non-member getting presence: status %d, want %d", status, http.StatusNotFound)
+	}
+}
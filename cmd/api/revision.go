@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+func (app *application) listRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleViewer); !ok {
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	revisions, err := app.store.Revision.List(r.Context(), docID, limit, offset)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.jsonResponse(w, http.StatusOK, revisions); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) getRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleViewer); !ok {
+		return
+	}
+
+	rev, ok := app.revisionFromRequest(w, r, docID)
+	if !ok {
+		return
+	}
+	if err := app.jsonResponse(w, http.StatusOK, rev); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserFromContext(r).ID
+	docID := chi.URLParam(r, "docID")
+	if _, ok := app.authorizeDocument(w, r, docID, userID, store.RoleEditor); !ok {
+		return
+	}
+
+	rev, ok := app.revisionFromRequest(w, r, docID)
+	if !ok {
+		return
+	}
+
+	// A live room has to drop its in-memory state and resync its clients,
+	// so it performs the restore itself, on whichever instance it is open.
+	ctx := r.Context()
+	err := app.hub.Restore(ctx, docID, rev.Content, userID)
+	if errors.Is(err, websocket.ErrNoRoom) {
+		_, err = app.store.Document.UpdateDocument(ctx, docID, rev.Content, userID)
+	}
+	if err != nil {
+		var constraintErr *store.ConstraintError
+		switch {
+		case errors.As(err, &constraintErr):
+			app.conflictResponse(w, r, constraintErr)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	doc, err := app.store.Document.GetDocumentByDocID(ctx, docID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if err := app.jsonResponse(w, http.StatusCreated, doc); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// revisionFromRequest loads the revision named in the URL. If it cannot,
+// it writes the error response and returns false.
+func (app *application) revisionFromRequest(w http.ResponseWriter, r *http.Request, docID string) (*store.Revision, bool) {
+	number, err := strconv.ParseInt(chi.URLParam(r, "revision"), 10, 64)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+	rev, err := app.store.Revision.Get(r.Context(), docID, number)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return nil, false
+	}
+	return rev, true
+}
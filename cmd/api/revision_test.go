@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+	"github.com/vlkhvnn/DocCollab/internal/websocket"
+)
+
+func TestRevisionHistory(t *testing.T) {
+	api := newTestAPI(t)
+	_, token := api.signup(t, "alice")
+	docID := api.createDocument(t, token, "v1")
+	path := "/v1/documents/" + docID
+	for _, content := range []string{"v2", "v3"} {
+		if status := api.do(t, http.MethodPatch, path, token, UpdateDocumentPayload{Content: &content}, nil); status != http.StatusOK {
+			t.Fatalf("updating to %s: status %d", content, status)
+		}
+	}
+
+	var revisions []store.Revision
+	if status := api.do(t, http.MethodGet, path+"/revisions", token, nil, &revisions); status != http.StatusOK {
+		t.Fatalf("listing revisions: status %d", status)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("listed %d revisions, want 3", len(revisions))
+	}
+	for i, rev := range revisions {
+		if want := int64(3 - i); rev.Revision != want || rev.Content != "" {
+			t.Fatalf("listed revision %d with content %q at %d, want revision %d without content", rev.Revision, rev.Content, i, want)
+		}
+	}
+
+	var rev store.Revision
+	if status := api.do(t, http.MethodGet, path+"/revisions/1", token, nil, &rev); status != http.StatusOK {
+		t.Fatalf("getting revision 1: status %d", status)
+	}
+	if rev.Revision != 1 || rev.Content != "v1" {
+		t.Fatalf("got revision %d with %q, want revision 1 with %q", rev.Revision, rev.Content, "v1")
+	}
+	if status := api.do(t, http.MethodGet, path+"/revisions/9", token, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("getting a missing revision: status %d, want %d", status, http.StatusNotFound)
+	}
+	if status := api.do(t, http.MethodGet, path+"/revisions/first", token, nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("getting a malformed revision: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	var doc store.Document
+	if status := api.do(t, http.MethodPost, path+"/revisions/1/restore", token, nil, &doc); status != http.StatusCreated {
+		t.Fatalf("restoring revision 1: status %d", status)
+	}
+	if doc.Content != "v1" || doc.Revision != 4 {
+		t.Fatalf("restored to %q at revision %d, want %q at revision 4", doc.Content, doc.Revision, "v1")
+	}
+	rev = store.Revision{}
+	api.do(t, http.MethodGet, path+"/revisions/4", token, nil, &rev)
+	if rev.Content != "v1" {
+		t.Fatalf("revision 4 has %q, want the restored %q", rev.Content, "v1")
+	}
+}
+
+func TestRestoreResyncsConnectedClients(t *testing.T) {
+	api := newTestAPI(t)
+	_, token := api.signup(t, "alice")
+	docID := api.createDocument(t, token, "hello")
+	conn := api.connect(t, token, docID)
+	op := &websocket.Message{Type: websocket.TypeOp, Revision: 0, Position: 5, Text: " world"}
+	if err := conn.conn.WriteJSON(op); err != nil {
+		t.Fatal(err)
+	}
+	conn.expect(websocket.TypeAck)
+
+	if status := api.do(t, http.MethodPost, "/v1/documents/"+docID+"/revisions/1/restore", token, nil, nil); status != http.StatusCreated {
+		t.Fatalf("restoring revision 1: status %d", status)
+	}
+	if msg := conn.expect(websocket.TypeSync); msg.Text != "hello" {
+		t.Fatalf("resynced to %q, want %q", msg.Text, "hello")
+	}
+	var doc store.Document
+	api.do(t, http.MethodGet, "/v1/documents/"+docID, token, nil, &doc)
+	if doc.Content != "hello" {
+		t.Fatalf("got %q after the restore, want %q", doc.Content, "hello")
+	}
+}
+
+func TestRestoreNeedsAnEditor(t *testing.T) {
+	api := newTestAPI(t)
+	_, alice := api.signup(t, "alice")
+	bobID, bob := api.signup(t, "bob")
+	docID := api.createDocument(t, alice, "hello")
+	api.share(t, alice, docID, bobID, store.RoleViewer)
+
+	path := "/v1/documents/" + docID + "/revisions"
+	if status := api.do(t, http.MethodGet, path+"/1", bob, nil, nil); status != http.StatusOK {
+		t.Fatalf("viewer reading a revision: status %d", status)
+	}
+	if status := api.do(t, http.MethodPost, path+"/1/restore", bob, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("viewer restoring a revision: status %d, want %d", status, http.StatusForbidden)
+	}
+}
@@ -3,10 +3,61 @@ package main
 import (
 	"log"
 	"net/http"
+	"strings"
 
+	"github.com/go-chi/chi/v5/middleware"
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/store"
 	"github.com/vlkhvnn/DocCollab/internal/websocket"
 )
 
+// tokenSubprotocol is the Sec-WebSocket-Protocol value browsers offer,
+// followed by the token itself, when they cannot set an Authorization header.
+const tokenSubprotocol = "access_token"
+
+// newUpgrader returns an upgrader that only accepts browser connections from
+// allowedOrigins. Requests without an Origin header are not from browsers
+// and are let through.
+func newUpgrader(allowedOrigins []string) gorillaws.Upgrader {
+	return gorillaws.Upgrader{
+		Subprotocols: []string{tokenSubprotocol},
+		CheckOrigin: func(r *http.Request) bool {
+			// Deliberately allowed: browsers always send an Origin with a
+			// websocket handshake, so only other clients, such as servers
+			// and command line tools, leave it out. The check guards
+			// against other sites' pages using a browser's credentials;
+			// other clients could send any Origin, and still need a token.
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, allowed := range allowedOrigins {
+				if strings.EqualFold(origin, allowed) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// websocketToken extracts the bearer token of a websocket upgrade request
+// from the Authorization header, the Sec-WebSocket-Protocol header or the
+// token query parameter, in that order. The query parameter is redacted
+// from the request log by redactTokenFormatter.
+func websocketToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	protocols := gorillaws.Subprotocols(r)
+	for i, p := range protocols {
+		if p == tokenSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
 func (app *application) serveWs(w http.ResponseWriter, r *http.Request) {
 	docID := r.URL.Query().Get("docID")
 	if docID == "" {
@@ -14,20 +65,61 @@ func (app *application) serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	user := getUserFromContext(r)
+	role, ok := app.authorizeDocument(w, r, docID, user.ID, store.RoleViewer)
+	if !ok {
+		return
+	}
+
+	_, loadErr := app.hub.GetRoom(r.Context(), docID)
+	switch loadErr {
+	case store.ErrNotFound:
+		app.notFoundResponse(w, r, loadErr)
+		return
+	case websocket.ErrShuttingDown:
+		app.serviceUnavailableResponse(w, r, loadErr)
+		return
+	}
+
+	conn, err := app.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
+	if loadErr != nil {
+		websocket.Reject(conn, docID, loadErr)
+		return
+	}
 
-	client := &websocket.Client{
-		Conn: conn,
-		Send: make(chan []byte, 256),
+	client := websocket.NewClient(conn, user, role, app.hub.Config)
+	if err := client.Handshake(docID); err != nil {
+		log.Printf("WebSocket handshake for %s failed: %v", docID, err)
+		return
 	}
 
-	room := app.hub.GetRoom(docID)
-	room.Register <- client
+	// The room may have gone idle since it was loaded above.
+	room, err := app.hub.Join(r.Context(), docID, client)
+	if err != nil {
+		websocket.Reject(conn, docID, err)
+		return
+	}
 
 	go client.ReadPump(room)
 	go client.WritePump()
 }
+
+// redactTokenFormatter logs requests with the value of the token query
+// parameter replaced, so that access tokens do not end up in the logs.
+type redactTokenFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f redactTokenFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	if q := r.URL.Query(); q.Has("token") {
+		q.Set("token", "REDACTED")
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+		r.RequestURI = r.URL.RequestURI()
+	}
+	return f.LogFormatter.NewLogEntry(r)
+}
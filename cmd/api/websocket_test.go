@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	gorillaws "github.com/gorilla/websocket"
+)
+
+func TestRequestLogRedactsTheToken(t *testing.T) {
+	var buf bytes.Buffer
+	formatter := redactTokenFormatter{&middleware.DefaultLogFormatter{Logger: log.New(&buf, "", 0), NoColor: true}}
+	r := httptest.NewRequest(http.MethodGet, "/v1/ws?docID=doc&token=secret", nil)
+	formatter.NewLogEntry(r).Write(http.StatusSwitchingProtocols, 0, nil, time.Millisecond, nil)
+
+	logged := buf.String()
+	if strings.Contains(logged, "secret") || !strings.Contains(logged, "docID=doc") {
+		t.Fatalf("logged %q", logged)
+	}
+	if r.URL.Query().Get("token") != "secret" {
+		t.Fatal("the request itself lost its token")
+	}
+}
+
+// dialWS opens a websocket with query and header and returns the status of
+// the handshake response.
+func (a *testAPI) dialWS(t *testing.T, query string, header http.Header) int {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(a.srv.URL, "http") + "/v1/ws?" + query
+	conn, resp, err := gorillaws.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestWebsocketAuthentication(t *testing.T) {
+	api := newTestAPI(t)
+	_, alice := api.signup(t, "alice")
+	_, bob := api.signup(t, "bob")
+	docID := api.createDocument(t, alice, "hello")
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		header http.Header
+		want   int
+	}{
+		{name: "no token", query: "docID=" + docID, want: http.StatusUnauthorized},
+		{name: "invalid token", query: "docID=" + docID + "&token=nonsense", want: http.StatusUnauthorized},
+		{name: "query parameter", query: "docID=" + docID + "&token=" + alice, want: http.StatusSwitchingProtocols},
+		{name: "authorization header", query: "docID=" + docID, header: http.Header{"Authorization": {"Bearer " + alice}}, want: http.StatusSwitchingProtocols},
+		{name: "subprotocol", query: "docID=" + docID, header: http.Header{"Sec-Websocket-Protocol": {tokenSubprotocol + ", " + alice}}, want: http.StatusSwitchingProtocols},
+		{name: "not a member", query: "docID=" + docID + "&token=" + bob, want: http.StatusNotFound},
+		{name: "no document", query: "token=" + alice, want: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := api.dialWS(t, tc.query, tc.header); got != tc.want {
+				t.Fatalf("got status %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	api := newTestAPI(t)
+	_, alice := api.signup(t, "alice")
+	docID := api.createDocument(t, alice, "hello")
+	query := "docID=" + docID + "&token=" + alice
+
+	if got := api.dialWS(t, query, http.Header{"Origin": {"https://evil.example"}}); got != http.StatusForbidden {
+		t.Fatalf("foreign origin: got status %d, want %d", got, http.StatusForbidden)
+	}
+	if got := api.dialWS(t, query, nil); got != http.StatusSwitchingProtocols {
+		t.Fatalf("no origin: got status %d, want %d", got, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestUpgraderChecksOrigin(t *testing.T) {
+	upgrader := newUpgrader([]string{"https://docs.example"})
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "", want: true},
+		{origin: "https://docs.example", want: true},
+		{origin: "HTTPS://DOCS.EXAMPLE", want: true},
+		{origin: "https://docs.example.evil", want: false},
+		{origin: "http://docs.example", want: false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := upgrader.CheckOrigin(r); got != tc.want {
+			t.Errorf("origin %q: got %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migrations so the API can apply them
+// itself. Each dialect has its own directory, named after it, holding the
+// same numbered migrations. Files follow the golang-migrate naming the
+// Makefile targets use.
+package migrations
+
+import "embed"
+
+//go:embed postgres/*.sql sqlite/*.sql
+var FS embed.FS
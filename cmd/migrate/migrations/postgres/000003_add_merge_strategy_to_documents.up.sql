@@ -0,0 +1,3 @@
+ALTER TABLE documents
+  ADD COLUMN IF NOT EXISTS merge_strategy TEXT NOT NULL DEFAULT 'ot'
+  CHECK (merge_strategy IN ('ot', 'crdt'));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS document_revisions;
+
+ALTER TABLE documents DROP COLUMN IF EXISTS revision;
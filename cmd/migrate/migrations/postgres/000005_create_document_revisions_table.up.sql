@@ -0,0 +1,11 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS revision bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS document_revisions (
+  id bigserial PRIMARY KEY,
+  doc_id TEXT NOT NULL REFERENCES documents (doc_id) ON DELETE CASCADE,
+  revision bigint NOT NULL,
+  content TEXT NOT NULL,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (doc_id, revision)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS room_owners (
+  doc_id TEXT PRIMARY KEY,
+  instance TEXT NOT NULL,
+  expires_at timestamp(0) with time zone NOT NULL
+);
+
+-- Broker messages too large for a NOTIFY payload, kept briefly for
+-- listeners to fetch.
+CREATE UNLOGGED TABLE IF NOT EXISTS broker_payloads (
+  id bigserial PRIMARY KEY,
+  payload bytea NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_broker_payloads_created_at ON broker_payloads (created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE documents
+  ADD COLUMN IF NOT EXISTS merge_state BYTEA;
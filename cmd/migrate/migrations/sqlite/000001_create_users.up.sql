@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS users(
+    id INTEGER PRIMARY KEY,
+    email TEXT COLLATE NOCASE UNIQUE NOT NULL,
+    username varchar(255) UNIQUE NOT NULL,
+    password blob NOT NULL,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
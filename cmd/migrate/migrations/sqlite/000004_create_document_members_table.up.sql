@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS document_members (
+  doc_id TEXT NOT NULL REFERENCES documents (doc_id) ON DELETE CASCADE,
+  user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'commenter', 'viewer')),
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (doc_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_document_members_user_id ON document_members (user_id);
@@ -0,0 +1,11 @@
+ALTER TABLE documents ADD COLUMN revision bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS document_revisions (
+  id INTEGER PRIMARY KEY,
+  doc_id TEXT NOT NULL REFERENCES documents (doc_id) ON DELETE CASCADE,
+  revision bigint NOT NULL,
+  content TEXT NOT NULL,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (doc_id, revision)
+);
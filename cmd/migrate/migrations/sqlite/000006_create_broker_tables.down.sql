@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS broker_payloads;
+DROP TABLE IF EXISTS room_owners;
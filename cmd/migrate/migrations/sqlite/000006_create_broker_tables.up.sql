@@ -0,0 +1,15 @@
+-- Only the Postgres broker uses these tables; a SQLite database belongs to
+-- a single instance. They are kept so both dialects share schema versions.
+CREATE TABLE IF NOT EXISTS room_owners (
+  doc_id TEXT PRIMARY KEY,
+  instance TEXT NOT NULL,
+  expires_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS broker_payloads (
+  id INTEGER PRIMARY KEY,
+  payload blob NOT NULL,
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_broker_payloads_created_at ON broker_payloads (created_at);
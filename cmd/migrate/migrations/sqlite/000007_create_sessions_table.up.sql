@@ -0,0 +1,16 @@
+-- One row per refresh token. Refreshing rotates the row into a new one in
+-- the same family, so a family is a single login.
+CREATE TABLE IF NOT EXISTS sessions (
+  id INTEGER PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  family TEXT NOT NULL,
+  token_hash blob NOT NULL UNIQUE,
+  access_jti TEXT NOT NULL UNIQUE,
+  expires_at timestamp NOT NULL,
+  rotated_at timestamp,
+  revoked_at timestamp,
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_family ON sessions (family);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
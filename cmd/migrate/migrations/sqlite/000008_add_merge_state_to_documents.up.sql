@@ -0,0 +1,2 @@
+ALTER TABLE documents
+  ADD COLUMN merge_state BLOB;
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/cmd/migrate/migrations"
+	"github.com/vlkhvnn/DocCollab/internal/db"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// newTestStorage returns storage on a freshly migrated SQLite database.
+func newTestStorage(t *testing.T) store.Storage {
+	t.Helper()
+	conn, err := db.New("sqlite://"+filepath.Join(t.TempDir(), "seed.db"), 1, 1, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.Migrate(context.Background(), conn, db.SQLite, migrations.FS); err != nil {
+		t.Fatal(err)
+	}
+	return store.NewSQLiteStorage(conn)
+}
+
+// dump describes everything seeded into storage, leaving out timestamps
+// and password hashes.
+func dump(t *testing.T, storage store.Storage) string {
+	t.Helper()
+	ctx := context.Background()
+	users, err := storage.User.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, user := range users {
+		lines = append(lines, fmt.Sprintf("user %d %s %s", user.ID, user.Username, user.Email))
+		docs, err := storage.Document.ListDocumentsForUser(ctx, user.ID, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range docs {
+			role, err := storage.Member.GetRole(ctx, doc.DocID, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, fmt.Sprintf("member %s %d %s", doc.DocID, user.ID, role))
+			if role != store.RoleOwner {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("doc %s %s revision %d %q", doc.DocID, doc.MergeStrategy, doc.Revision, doc.Content))
+			revisions, err := storage.Revision.List(ctx, doc.DocID, 1000, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rev := range revisions {
+				lines = append(lines, fmt.Sprintf("revision %s %d by %d", doc.DocID, rev.Revision, *rev.UserID))
+			}
+		}
+	}
+	slices.Sort(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestSeedIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	seed := func(seed uint64) string {
+		storage := newTestStorage(t)
+		if err := newSeeder(storage, seed).run(ctx, 5, 8, 3, 2); err != nil {
+			t.Fatal(err)
+		}
+		return dump(t, storage)
+	}
+	first := seed(7)
+	if again := seed(7); again != first {
+		t.Fatalf("the same seed gave different data:\n%s\n\nand\n\n%s", first, again)
+	}
+	if other := seed(8); other == first {
+		t.Fatal("another seed gave the same data")
+	}
+	if !strings.Contains(first, "doc ") {
+		t.Fatalf("no documents were seeded:\n%s", first)
+	}
+}
+
+func TestSeedRefusesADatabaseWithUsers(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+	if err := newSeeder(storage, 1).run(ctx, 2, 1, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	before := dump(t, storage)
+	if err := newSeeder(storage, 2).run(ctx, 2, 1, 1, 1); err == nil {
+		t.Fatal("seeded a database that already had users")
+	}
+	if after := dump(t, storage); after != before {
+		t.Fatalf("the refused run changed the database:\n%s", after)
+	}
+}
+
+func TestSeedStaysWithinItsLimits(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestStorage(t)
+	const users, docs, maxRevisions, maxMembers = 4, 12, 3, 2
+	if err := newSeeder(storage, 3).run(ctx, users, docs, maxRevisions, maxMembers); err != nil {
+		t.Fatal(err)
+	}
+
+	seeded, err := storage.User.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeded) != users {
+		t.Fatalf("seeded %d users, want %d", len(seeded), users)
+	}
+	if err := seeded[0].Password.Compare(seedPassword); err != nil {
+		t.Fatalf("seeded users cannot log in with the seed password: %v", err)
+	}
+
+	owned := 0
+	for _, user := range seeded {
+		list, err := storage.Document.ListDocumentsForUser(ctx, user.ID, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range list {
+			if role, err := storage.Member.GetRole(ctx, doc.DocID, user.ID); err != nil || role != store.RoleOwner {
+				continue
+			}
+			owned++
+			if doc.MergeStrategy != "ot" && doc.MergeStrategy != "crdt" {
+				t.Errorf("%s has merge strategy %q", doc.DocID, doc.MergeStrategy)
+			}
+			if doc.Revision > 1+maxRevisions {
+				t.Errorf("%s is at revision %d, want at most %d", doc.DocID, doc.Revision, 1+maxRevisions)
+			}
+			members, err := storage.Member.List(ctx, doc.DocID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(members) > 1+maxMembers {
+				t.Errorf("%s has %d members, want at most %d", doc.DocID, len(members), 1+maxMembers)
+			}
+		}
+	}
+	if owned != docs {
+		t.Fatalf("seeded %d documents, want %d", owned, docs)
+	}
+}
@@ -1,8 +1,22 @@
 package auth
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"context"
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
 
 type Authenticator interface {
 	GenerateToken(claims jwt.Claims) (string, error)
-	ValidateToken(token string) (*jwt.Token, error)
+	ValidateToken(ctx context.Context, token string) (*jwt.Token, error)
+	JWKS() JWKS
+}
+
+// RevocationChecker reports whether the token with the given jti has been
+// revoked, for instance by logging out.
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
 }
@@ -1,43 +1,83 @@
 package auth
 
 import (
-	"fmt"
+	"context"
+	"errors"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type JWTAuthenticator struct {
-	secret string
-	aud    string
-	iss    string
+	keys        *KeySet
+	aud         string
+	iss         string
+	revocations RevocationChecker
 }
 
-func NewJWTAuthenticator(secret, aud, iss string) *JWTAuthenticator {
+func NewJWTAuthenticator(keys *KeySet, aud, iss string, revocations RevocationChecker) *JWTAuthenticator {
 	return &JWTAuthenticator{
-		secret: secret,
-		aud:    aud,
-		iss:    iss,
+		keys:        keys,
+		aud:         aud,
+		iss:         iss,
+		revocations: revocations,
 	}
 }
 
+// GenerateToken signs claims with the signing key, naming it in the kid
+// header so the token still verifies after the next rotation.
 func (a *JWTAuthenticator) GenerateToken(claims jwt.Claims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(a.secret))
+	key := a.keys.signing
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
-func (a *JWTAuthenticator) ValidateToken(token string) (*jwt.Token, error) {
-	return jwt.Parse(token, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+
+// ValidateToken checks the token's signature against the key its kid names
+// and its claims, then that it has not been revoked. Tokens without a jti
+// were issued before sessions existed and cannot be revoked; they are
+// accepted until they expire.
+func (a *JWTAuthenticator) ValidateToken(ctx context.Context, token string) (*jwt.Token, error) {
+	jwtToken, err := jwt.Parse(token, func(t *jwt.Token) (any, error) {
+		key, err := a.keys.lookup(t)
+		if err != nil {
+			return nil, err
 		}
-		return []byte(a.secret), nil
+		return key.public, nil
 	},
 		jwt.WithExpirationRequired(),
 		jwt.WithAudience(a.aud),
-		jwt.WithIssuer(a.aud),
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+		jwt.WithIssuer(a.iss),
+		jwt.WithValidMethods(a.keys.methods()),
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := jwtToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("unexpected token claims")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return jwtToken, nil
+	}
+	revoked, err := a.revocations.IsRevoked(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return jwtToken, nil
+}
+
+// JWKS returns the public keys tokens may be verified with.
+func (a *JWTAuthenticator) JWKS() JWKS {
+	return a.keys.JWKS()
 }
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// revoked is a RevocationChecker revoking the jtis set to true. Unknown
+// jtis are not revoked.
+type revoked map[string]bool
+
+func (r revoked) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	return r[jti], nil
+}
+
+func testClaims(iss, aud string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub": "1",
+		"jti": "jti",
+		"exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(),
+		"iss": iss,
+		"aud": aud,
+	}
+}
+
+func TestValidateTokenChecksIssuerAndAudience(t *testing.T) {
+	a := NewJWTAuthenticator(NewHMACKeySet("secret"), "api", "issuer", revoked{})
+	for _, tc := range []struct {
+		name     string
+		iss, aud string
+		ok       bool
+	}{
+		{name: "matching", iss: "issuer", aud: "api", ok: true},
+		{name: "other issuer", iss: "other", aud: "api"},
+		{name: "other audience", iss: "issuer", aud: "other"},
+		{name: "issuer and audience swapped", iss: "api", aud: "issuer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := a.GenerateToken(testClaims(tc.iss, tc.aud))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.ValidateToken(context.Background(), token); (err == nil) != tc.ok {
+				t.Fatalf("got %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestValidateTokenChecksRevocation(t *testing.T) {
+	a := NewJWTAuthenticator(NewHMACKeySet("secret"), "api", "issuer", revoked{"jti": true})
+	token, err := a.GenerateToken(testClaims("issuer", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ValidateToken(context.Background(), token); err != ErrTokenRevoked {
+		t.Fatalf("got %v, want ErrTokenRevoked", err)
+	}
+
+	// Tokens from before sessions existed have no jti to revoke.
+	claims := testClaims("issuer", "api")
+	delete(claims, "jti")
+	if token, err = a.GenerateToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ValidateToken(context.Background(), token); err != nil {
+		t.Fatalf("token without a jti: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA key accepted for signing or verifying.
+const minRSABits = 2048
+
+// Key is one key tokens are signed or verified with. Keys without a
+// private half are retired: they only verify tokens issued before a
+// rotation, until those expire.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	private any
+	public  any
+}
+
+// KeySet holds every key a token may have been signed with, by kid, and
+// the one new tokens are signed with.
+//
+// To rotate, add a new key, make it the signing key and keep the old one
+// (or just its public half) until the longest-lived token signed with it
+// has expired. The old key stays in the JWKS meanwhile so other services
+// keep verifying those tokens.
+type KeySet struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// NewHMACKeySet returns a key set that signs and verifies with a shared
+// secret only. Its tokens carry no kid.
+func NewHMACKeySet(secret string) *KeySet {
+	key := hmacKey(secret)
+	return &KeySet{keys: map[string]*Key{key.ID: key}, signing: key}
+}
+
+// LoadKeySet loads the PEM files in dir as keys, each named by its file
+// name without the .pem extension. Files may hold a PKCS #8 or PKCS #1
+// private key, RSA or Ed25519, or a PKIX public key for a retired key.
+//
+// New tokens are signed with signingKID or, if it is empty, with the
+// private key whose ID sorts last, so naming keys by date rotates them.
+// A non-empty secret keeps tokens signed before asymmetric keys were
+// introduced, which carry no kid, verifiable.
+func LoadKeySet(dir, signingKID, secret string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	set := &KeySet{keys: make(map[string]*Key)}
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading key %s: %w", path, err)
+		}
+		set.keys[key.ID] = key
+		if key.private != nil && signingKID == "" {
+			set.signing = key
+		}
+	}
+	if signingKID != "" {
+		set.signing = set.keys[signingKID]
+		if set.signing == nil || set.signing.private == nil {
+			return nil, fmt.Errorf("no private key with kid %q in %s", signingKID, dir)
+		}
+	}
+	if set.signing == nil {
+		return nil, fmt.Errorf("no private keys in %s", dir)
+	}
+	if secret != "" {
+		legacy := hmacKey(secret)
+		set.keys[legacy.ID] = legacy
+	}
+	return set, nil
+}
+
+func hmacKey(secret string) *Key {
+	return &Key{Method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	var private, public any
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := private.(crypto.Signer); ok {
+		public = signer.Public()
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), ".pem"), private: private, public: public}
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key has %d bits, need at least %d", pub.N.BitLen(), minRSABits)
+		}
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+	return key, nil
+}
+
+// lookup returns the key a token names in its kid header.
+func (s *KeySet) lookup(t *jwt.Token) (*Key, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("kid %q does not sign with %s", kid, t.Method.Alg())
+	}
+	return key, nil
+}
+
+// methods returns the algorithms of the keys in the set.
+func (s *KeySet) methods() []string {
+	var methods []string
+	for _, key := range s.keys {
+		if !slices.Contains(methods, key.Method.Alg()) {
+			methods = append(methods, key.Method.Alg())
+		}
+	}
+	return methods
+}
+
+// JWK is a public key in JSON Web Key form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// N and E are the modulus and exponent of an RSA key.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv and X are the curve and public key of an Ed25519 key.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key, sorted by kid.
+// Shared secrets are never published.
+func (s *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range s.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
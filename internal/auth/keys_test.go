@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes der as a PEM block of blockType to dir/kid.pem.
+func writePEM(t *testing.T, dir, kid, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writePrivateKey writes key to dir/kid.pem in PKCS #8 form.
+func writePrivateKey(t *testing.T, dir, kid string, key any) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "PRIVATE KEY", der)
+}
+
+// writePublicKey writes the public key of a retired key to dir/kid.pem.
+func writePublicKey(t *testing.T, dir, kid string, key any) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "PUBLIC KEY", der)
+}
+
+func newRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func loadAuthenticator(t *testing.T, dir, signingKID, secret string) *JWTAuthenticator {
+	t.Helper()
+	keys, err := LoadKeySet(dir, signingKID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewJWTAuthenticator(keys, "api", "issuer", revoked{})
+}
+
+// signedWith returns the kid and algorithm in the header of token.
+func signedWith(t *testing.T, token string) (kid, alg string) {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ = parsed.Header["kid"].(string)
+	return kid, parsed.Method.Alg()
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t, 2048)
+	writePrivateKey(t, dir, "2024-01", rsaKey)
+	before := loadAuthenticator(t, dir, "", "secret")
+	old, err := before.GenerateToken(testClaims("issuer", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, alg := signedWith(t, old); kid != "2024-01" || alg != "RS256" {
+		t.Fatalf("signed with %s %s, want 2024-01 RS256", kid, alg)
+	}
+	legacy, err := NewJWTAuthenticator(NewHMACKeySet("secret"), "api", "issuer", revoked{}).GenerateToken(testClaims("issuer", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to an Ed25519 key, keeping only the public half of the old one.
+	writePrivateKey(t, dir, "2024-06", newEd25519Key(t))
+	writePublicKey(t, dir, "2024-01", &rsaKey.PublicKey)
+	after := loadAuthenticator(t, dir, "", "secret")
+	current, err := after.GenerateToken(testClaims("issuer", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, alg := signedWith(t, current); kid != "2024-06" || alg != "EdDSA" {
+		t.Fatalf("signed with %s %s after rotating, want 2024-06 EdDSA", kid, alg)
+	}
+	for name, token := range map[string]string{"current": current, "retired": old, "shared secret": legacy} {
+		if _, err := after.ValidateToken(ctx, token); err != nil {
+			t.Errorf("token signed with the %s key: %v", name, err)
+		}
+	}
+
+	// Picking the signing key by kid overrides the newest.
+	pinned := loadAuthenticator(t, dir, "2024-06", "")
+	token, err := pinned.GenerateToken(testClaims("issuer", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := signedWith(t, token); kid != "2024-06" {
+		t.Fatalf("signed with %s, want 2024-06", kid)
+	}
+	if _, err := pinned.ValidateToken(ctx, legacy); err == nil {
+		t.Fatal("token signed with a shared secret verified without one")
+	}
+}
+
+func TestJWKSPublishesAsymmetricKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t, 2048)
+	edKey := newEd25519Key(t)
+	writePrivateKey(t, dir, "b-ed25519", edKey)
+	writePublicKey(t, dir, "a-rsa", &rsaKey.PublicKey)
+	jwks := loadAuthenticator(t, dir, "", "secret").JWKS()
+
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("published %d keys, want the two asymmetric ones", len(jwks.Keys))
+	}
+	rsaJWK, edJWK := jwks.Keys[0], jwks.Keys[1]
+	if rsaJWK.Kid != "a-rsa" || rsaJWK.Kty != "RSA" || rsaJWK.Alg != "RS256" || rsaJWK.E != "AQAB" || rsaJWK.N == "" {
+		t.Fatalf("RSA key published as %+v", rsaJWK)
+	}
+	if edJWK.Kid != "b-ed25519" || edJWK.Kty != "OKP" || edJWK.Crv != "Ed25519" || edJWK.Alg != "EdDSA" || edJWK.X == "" {
+		t.Fatalf("Ed25519 key published as %+v", edJWK)
+	}
+	if got := NewHMACKeySet("secret").JWKS(); len(got.Keys) != 0 {
+		t.Fatalf("shared secret published as %+v", got.Keys)
+	}
+}
+
+func TestValidateTokenRefusesUnknownKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t, 2048)
+	writePrivateKey(t, dir, "rsa", rsaKey)
+	a := loadAuthenticator(t, dir, "", "secret")
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims("issuer", "api"))
+	unknown.Header["kid"] = "missing"
+	token, err := unknown.SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ValidateToken(ctx, token); err == nil {
+		t.Fatal("token naming an unknown kid verified")
+	}
+
+	// A token claiming to be signed with the RSA key's public half as an
+	// HMAC secret must not verify.
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims("issuer", "api"))
+	confused.Header["kid"] = "rsa"
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err = confused.SignedString(der); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ValidateToken(ctx, token); err == nil {
+		t.Fatal("token with the wrong algorithm for its kid verified")
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		setup      func(t *testing.T, dir string)
+		signingKID string
+	}{
+		{name: "no keys", setup: func(t *testing.T, dir string) {}},
+		{name: "only retired keys", setup: func(t *testing.T, dir string) {
+			writePublicKey(t, dir, "old", newEd25519Key(t).Public())
+		}},
+		{name: "unknown signing kid", signingKID: "missing", setup: func(t *testing.T, dir string) {
+			writePrivateKey(t, dir, "current", newEd25519Key(t))
+		}},
+		{name: "retired signing kid", signingKID: "old", setup: func(t *testing.T, dir string) {
+			writePrivateKey(t, dir, "current", newEd25519Key(t))
+			writePublicKey(t, dir, "old", newEd25519Key(t).Public())
+		}},
+		{name: "short RSA key", setup: func(t *testing.T, dir string) {
+			writePEM(t, dir, "weak", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(newRSAKey(t, 1024)))
+		}},
+		{name: "not PEM", setup: func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, "junk.pem"), []byte("junk"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "unsupported block", setup: func(t *testing.T, dir string) {
+			writePEM(t, dir, "cert", "CERTIFICATE", []byte("cert"))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tc.setup(t, dir)
+			if _, err := LoadKeySet(dir, tc.signingKID, ""); err == nil {
+				t.Fatal("loaded the key set")
+			}
+		})
+	}
+}
+
+func TestLoadKeySetReadsPKCS1Keys(t *testing.T) {
+	dir := t.TempDir()
+	writePEM(t, dir, "rsa", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(newRSAKey(t, 2048)))
+	a := loadAuthenticator(t, dir, "", "")
+	token, err := a.GenerateToken(testClaims("issuer", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ValidateToken(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,11 +3,64 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 )
 
+// Dialect is the SQL database an address points at. Its value names both
+// its database/sql driver and the directory its migrations are in.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// sqliteParams are added to every SQLite connection. Foreign keys are off
+// by default, and taking the write lock when a transaction begins keeps
+// read-then-write transactions from failing with SQLITE_BUSY halfway.
+const sqliteParams = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
+// DialectOf returns the dialect addr is for, by its scheme: postgres:// or
+// postgresql:// for Postgres and sqlite://path for a SQLite file.
+// Addresses without a scheme are Postgres key=value connection strings.
+func DialectOf(addr string) (Dialect, error) {
+	dialect, _, err := parseAddr(addr)
+	return dialect, err
+}
+
+func parseAddr(addr string) (Dialect, string, error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		return Postgres, addr, nil
+	}
+	switch scheme {
+	case "postgres", "postgresql":
+		return Postgres, addr, nil
+	case "sqlite":
+		path, params, _ := strings.Cut(rest, "?")
+		if path == "" {
+			return "", "", fmt.Errorf("database address %q has no file path", addr)
+		}
+		dsn := "file:" + path + "?" + sqliteParams
+		if params != "" {
+			dsn += "&" + params
+		}
+		return SQLite, dsn, nil
+	default:
+		return "", "", fmt.Errorf("unsupported database scheme %q", scheme)
+	}
+}
+
+// New opens a connection pool to the database at addr, with the driver
+// for its dialect. Callers import the drivers.
 func New(addr string, maxOpenConns int, maxIdleConns int, maxIdleTime string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", addr)
+	dialect, dsn, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(string(dialect), dsn)
 	if err != nil {
 		return nil, err
 	}
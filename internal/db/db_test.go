@@ -0,0 +1,39 @@
+package db
+
+import "testing"
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr    string
+		dialect Dialect
+		dsn     string
+		err     string
+	}{
+		{addr: "postgres://admin@localhost/doccollab", dialect: Postgres, dsn: "postgres://admin@localhost/doccollab"},
+		{addr: "postgresql://localhost/doccollab", dialect: Postgres, dsn: "postgresql://localhost/doccollab"},
+		{addr: "host=localhost dbname=doccollab", dialect: Postgres, dsn: "host=localhost dbname=doccollab"},
+		{addr: "sqlite://doccollab.db", dialect: SQLite, dsn: "file:doccollab.db?" + sqliteParams},
+		{addr: "sqlite:///var/lib/doccollab.db?mode=ro", dialect: SQLite, dsn: "file:/var/lib/doccollab.db?" + sqliteParams + "&mode=ro"},
+		{addr: "sqlite://", err: `database address "sqlite://" has no file path`},
+		{addr: "mysql://localhost/doccollab", err: `unsupported database scheme "mysql"`},
+	} {
+		t.Run(tc.addr, func(t *testing.T) {
+			dialect, dsn, err := parseAddr(tc.addr)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dialect != tc.dialect || dsn != tc.dsn {
+				t.Fatalf("got %s %q, want %s %q", dialect, dsn, tc.dialect, tc.dsn)
+			}
+			if dialect, _ := DialectOf(tc.addr); dialect != tc.dialect {
+				t.Fatalf("DialectOf gave %s, want %s", dialect, tc.dialect)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationLockID is the advisory lock that keeps instances starting
+// together from migrating at the same time.
+const migrationLockID = 7_262_021
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations reads the migrations in fsys, named as golang-migrate
+// names them: 000001_create_users.up.sql and its .down.sql, in order.
+func LoadMigrations(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the dialect's migrations in fsys that the database has
+// not had yet. fsys holds a directory of migrations per dialect, named
+// after it. Each runs in a transaction along with recording its version in
+// schema_migrations, the table the migrate CLI uses, so the two can be
+// mixed.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect, fsys fs.FS) error {
+	migrations, err := loadDialectMigrations(dialect, fsys)
+	if err != nil {
+		return err
+	}
+
+	// Advisory locks belong to a session, so everything runs on one
+	// connection. SQLite has none, but a SQLite database belongs to a
+	// single instance anyway.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if dialect == Postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	current, dirty, err := schemaVersion(ctx, conn, dialect)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("database schema is dirty at version %d; fix it by hand and force the version", current)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m *Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, m.Version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CheckSchemaVersion returns an error unless the database has had exactly
+// the migrations in fsys applied, cleanly. Running against an older or a
+// newer schema than the code was written for fails in ways that are hard
+// to trace back, so the API refuses to start instead.
+func CheckSchemaVersion(ctx context.Context, db *sql.DB, dialect Dialect, fsys fs.FS) error {
+	migrations, err := loadDialectMigrations(dialect, fsys)
+	if err != nil {
+		return err
+	}
+	var want uint64
+	if len(migrations) > 0 {
+		want = migrations[len(migrations)-1].Version
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	current, dirty, err := schemaVersion(ctx, conn, dialect)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dirty:
+		return fmt.Errorf("database schema is dirty at version %d", current)
+	case current != want:
+		return fmt.Errorf("database schema is at version %d, this build needs version %d", current, want)
+	}
+	return nil
+}
+
+// loadDialectMigrations loads the migrations in the dialect's directory of
+// fsys.
+func loadDialectMigrations(dialect Dialect, fsys fs.FS) ([]*Migration, error) {
+	sub, err := fs.Sub(fsys, string(dialect))
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(sub)
+}
+
+// schemaVersion returns the version recorded in schema_migrations, zero if
+// nothing has been migrated yet.
+func schemaVersion(ctx context.Context, conn *sql.Conn, dialect Dialect) (uint64, bool, error) {
+	query := `SELECT to_regclass('schema_migrations') IS NOT NULL`
+	if dialect == SQLite {
+		query = `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`
+	}
+	var exists bool
+	err := conn.QueryRowContext(ctx, query).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var (
+		version uint64
+		dirty   bool
+	)
+	err = conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
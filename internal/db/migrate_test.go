@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/vlkhvnn/DocCollab/cmd/migrate/migrations"
+	_ "modernc.org/sqlite"
+)
+
+// newSQLite opens an empty SQLite database.
+func newSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	conn, err := New("sqlite://"+filepath.Join(t.TempDir(), "test.db"), 1, 1, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sqliteMigrations returns a file system with the SQLite migrations given
+// by file name and content.
+func sqliteMigrations(files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys["sqlite/"+name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return fsys
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000002_add_email.up.sql":      {Data: []byte("ALTER TABLE users ADD email text")},
+		"000001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id int)")},
+		"000001_create_users.down.sql": {Data: []byte("DROP TABLE users")},
+		"README.md":                    {Data: []byte("not a migration")},
+	}
+	got, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("loaded %d migrations, want 2", len(got))
+	}
+	if got[0].Version != 1 || got[0].Name != "create_users" || got[0].Down != "DROP TABLE users" {
+		t.Fatalf("first migration is %+v", got[0])
+	}
+	if got[1].Version != 2 || got[1].Up != "ALTER TABLE users ADD email text" || got[1].Down != "" {
+		t.Fatalf("second migration is %+v", got[1])
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"no up file": {
+			"000001_create_users.down.sql": {Data: []byte("DROP TABLE users")},
+		},
+		"two names": {
+			"000001_create_users.up.sql":  {Data: []byte("CREATE TABLE users (id int)")},
+			"000001_create_people.up.sql": {Data: []byte("CREATE TABLE people (id int)")},
+		},
+	} {
+		if _, err := LoadMigrations(fsys); err == nil {
+			t.Errorf("%s: loaded the migrations", name)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	conn := newSQLite(t)
+	if err := CheckSchemaVersion(ctx, conn, SQLite, migrations.FS); err == nil {
+		t.Fatal("an empty database passed the schema check")
+	}
+
+	if err := Migrate(ctx, conn, SQLite, migrations.FS); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchemaVersion(ctx, conn, SQLite, migrations.FS); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating an up to date database does nothing.
+	if err := Migrate(ctx, conn, SQLite, migrations.FS); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, `INSERT INTO users (username, email, password) VALUES ('alice', 'alice@example.com', x'00')`); err != nil {
+		t.Fatalf("the migrated schema has no usable users table: %v", err)
+	}
+}
+
+func TestMigrateAppliesOnlyNewMigrations(t *testing.T) {
+	ctx := context.Background()
+	conn := newSQLite(t)
+	first := map[string]string{
+		"000001_create_notes.up.sql": "CREATE TABLE notes (id integer PRIMARY KEY)",
+	}
+	if err := Migrate(ctx, conn, SQLite, sqliteMigrations(first)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first migration would fail if it ran again.
+	second := map[string]string{
+		"000001_create_notes.up.sql": first["000001_create_notes.up.sql"],
+		"000002_add_text.up.sql":     "ALTER TABLE notes ADD COLUMN text text",
+	}
+	if err := CheckSchemaVersion(ctx, conn, SQLite, sqliteMigrations(second)); err == nil {
+		t.Fatal("a database behind the build passed the schema check")
+	}
+	if err := Migrate(ctx, conn, SQLite, sqliteMigrations(second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchemaVersion(ctx, conn, SQLite, sqliteMigrations(second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchemaVersion(ctx, conn, SQLite, sqliteMigrations(first)); err == nil {
+		t.Fatal("a database ahead of the build passed the schema check")
+	}
+}
+
+func TestMigrateRollsBackAFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	conn := newSQLite(t)
+	files := map[string]string{
+		"000001_create_notes.up.sql": "CREATE TABLE notes (id integer PRIMARY KEY)",
+		"000002_broken.up.sql":       "CREATE TABLE tags (id integer PRIMARY KEY); ALTER TABLE missing ADD COLUMN x text",
+	}
+	err := Migrate(ctx, conn, SQLite, sqliteMigrations(files))
+	if err == nil || !strings.Contains(err.Error(), "2_broken") {
+		t.Fatalf("got %v, want the broken migration to fail", err)
+	}
+	var version uint64
+	if err := conn.QueryRowContext(ctx, `SELECT version FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("schema is at version %d, want 1", version)
+	}
+	var tags int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'tags'`).Scan(&tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags != 0 {
+		t.Fatal("the broken migration was partly applied")
+	}
+}
+
+func TestDirtySchema(t *testing.T) {
+	ctx := context.Background()
+	conn := newSQLite(t)
+	fsys := sqliteMigrations(map[string]string{
+		"000001_create_notes.up.sql": "CREATE TABLE notes (id integer PRIMARY KEY)",
+	})
+	if err := Migrate(ctx, conn, SQLite, fsys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, `UPDATE schema_migrations SET dirty = true`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, conn, SQLite, fsys); err == nil {
+		t.Fatal("migrated a dirty database")
+	}
+	if err := CheckSchemaVersion(ctx, conn, SQLite, fsys); err == nil {
+		t.Fatal("a dirty database passed the schema check")
+	}
+}
@@ -4,15 +4,22 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
 )
 
 // Document represents a shared document.
 type Document struct {
-	ID        int64     `json:"id"`
-	DocID     string    `json:"doc_id"`
-	Content   string    `json:"content"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            int64     `json:"id"`
+	DocID         string    `json:"doc_id"`
+	Content       string    `json:"content"`
+	MergeStrategy string    `json:"merge_strategy"`
+	Revision      int64     `json:"revision"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// MergeState is what the merge strategy keeps besides the content, as
+	// of the last time its room saved the document. It is nil if there is
+	// none, and only loaded by GetDocumentByDocID.
+	MergeState []byte `json:"-"`
 }
 
 // DocumentStore defines methods for document operations.
@@ -25,39 +32,137 @@ func NewDocumentStore(db *sql.DB) *DocumentStore {
 	return &DocumentStore{db: db}
 }
 
-// CreateDocument inserts a new document.
-func (ds *DocumentStore) CreateDocument(ctx context.Context, docID, content string) error {
-	query := `
-		INSERT INTO documents (doc_id, content)
-		VALUES ($1, $2)
-	`
-	_, err := ds.db.ExecContext(ctx, query, docID, content)
-	return err
+// CreateDocument inserts a new document owned by ownerID as its first
+// revision and fills in its generated fields.
+func (ds *DocumentStore) CreateDocument(ctx context.Context, doc *Document, ownerID int64) error {
+	return withTx(ds.db, ctx, func(tx *sql.Tx) error {
+		query := `
+			INSERT INTO documents (doc_id, content, merge_strategy, revision)
+			VALUES ($1, $2, $3, 1)
+			RETURNING id, revision, updated_at
+		`
+		err := tx.QueryRowContext(ctx, query, doc.DocID, doc.Content, doc.MergeStrategy).Scan(&doc.ID, &doc.Revision, &doc.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		if err := insertRevision(ctx, tx, doc.DocID, doc.Revision, doc.Content, ownerID); err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO document_members (doc_id, user_id, role)
+			VALUES ($1, $2, $3)
+		`
+		_, err = tx.ExecContext(ctx, query, doc.DocID, ownerID, RoleOwner)
+		return err
+	})
 }
 
 // GetDocumentByDocID retrieves a document by its docID.
 func (ds *DocumentStore) GetDocumentByDocID(ctx context.Context, docID string) (*Document, error) {
 	query := `
-		SELECT id, doc_id, content, updated_at
+		SELECT id, doc_id, content, merge_strategy, revision, updated_at, merge_state
 		FROM documents
 		WHERE doc_id = $1
 	`
 	doc := &Document{}
-	err := ds.db.QueryRowContext(ctx, query, docID).Scan(&doc.ID, &doc.DocID, &doc.Content, &doc.UpdatedAt)
+	err := ds.db.QueryRowContext(ctx, query, docID).Scan(&doc.ID, &doc.DocID, &doc.Content, &doc.MergeStrategy, &doc.Revision, &doc.UpdatedAt, &doc.MergeState)
 	if err != nil {
-		return nil, err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
 	}
 	return doc, nil
 }
 
-// UpdateDocument updates a document's content.
-func (ds *DocumentStore) UpdateDocument(ctx context.Context, docID, content string) error {
+// ListDocumentsForUser returns a page of the documents userID is a member
+// of, most recently updated first.
+func (ds *DocumentStore) ListDocumentsForUser(ctx context.Context, userID int64, limit, offset int) ([]*Document, error) {
+	query := `
+		SELECT d.id, d.doc_id, d.content, d.merge_strategy, d.revision, d.updated_at
+		FROM documents d
+		JOIN document_members m ON m.doc_id = d.doc_id
+		WHERE m.user_id = $1
+		ORDER BY d.updated_at DESC, d.id DESC
+		LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	rows, err := ds.db.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []*Document{}
+	for rows.Next() {
+		doc := &Document{}
+		if err := rows.Scan(&doc.ID, &doc.DocID, &doc.Content, &doc.MergeStrategy, &doc.Revision, &doc.UpdatedAt); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// UpdateDocument replaces a document's content, records it as a new
+// revision made by userID and returns the revision number. The merge state
+// is left as it is, for the room to reconcile with the new content.
+func (ds *DocumentStore) UpdateDocument(ctx context.Context, docID, content string, userID int64) (int64, error) {
 	query := `
 		UPDATE documents
-		SET content = $1, updated_at = NOW()
+		SET content = $1, revision = revision + 1, updated_at = CURRENT_TIMESTAMP
 		WHERE doc_id = $2
+		RETURNING revision
+	`
+	return ds.update(ctx, query, docID, content, userID, content, docID)
+}
+
+// UpdateDocumentWithState is UpdateDocument for a room, which also stores
+// the merge state the content came out of.
+func (ds *DocumentStore) UpdateDocumentWithState(ctx context.Context, docID, content string, state []byte, userID int64) (int64, error) {
+	query := `
+		UPDATE documents
+		SET content = $1, merge_state = $2, revision = revision + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE doc_id = $3
+		RETURNING revision
 	`
-	res, err := ds.db.ExecContext(ctx, query, content, docID)
+	return ds.update(ctx, query, docID, content, userID, content, state, docID)
+}
+
+// update runs query, which updates a document and returns its revision,
+// with args, and records content as that revision.
+func (ds *DocumentStore) update(ctx context.Context, query, docID, content string, userID int64, args ...any) (int64, error) {
+	var revision int64
+	err := withTx(ds.db, ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&revision); err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNotFound
+			default:
+				return err
+			}
+		}
+		return insertRevision(ctx, tx, docID, revision, content, userID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+// DeleteDocument removes a document along with its memberships.
+func (ds *DocumentStore) DeleteDocument(ctx context.Context, docID string) error {
+	query := `DELETE FROM documents WHERE doc_id = $1`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	res, err := ds.db.ExecContext(ctx, query, docID)
 	if err != nil {
 		return err
 	}
@@ -66,7 +171,7 @@ func (ds *DocumentStore) UpdateDocument(ctx context.Context, docID, content stri
 		return err
 	}
 	if rows == 0 {
-		return sql.ErrNoRows
+		return ErrNotFound
 	}
 	return nil
 }
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The kinds of constraint violation a ConstraintError reports.
+var (
+	ErrUniqueViolation     = errors.New("unique constraint violated")
+	ErrForeignKeyViolation = errors.New("foreign key constraint violated")
+	ErrCheckViolation      = errors.New("check constraint violated")
+)
+
+// ConstraintError is a write the schema rejected. errors.Is matches it
+// against its Kind, and against another ConstraintError of the same kind
+// on the same table and field, such as ErrDuplicateEmail.
+type ConstraintError struct {
+	// Kind is ErrUniqueViolation, ErrForeignKeyViolation or
+	// ErrCheckViolation.
+	Kind error
+	// Table is the table the constraint is on. It is empty when the
+	// database does not say, as SQLite does not for checks.
+	Table string
+	// Field is the column the constraint is on, or its columns separated
+	// by commas. It is empty when the database does not say, as SQLite
+	// does not for foreign keys.
+	Field string
+	// Constraint is the constraint's name, where the database reports it.
+	Constraint string
+
+	err error
+}
+
+func (e *ConstraintError) Error() string {
+	on := e.Table
+	if e.Field != "" {
+		on = strings.TrimPrefix(on+"."+e.Field, ".")
+	}
+	if on == "" {
+		return e.Kind.Error()
+	}
+	return fmt.Sprintf("%s on %s", e.Kind, on)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	if target == e.Kind {
+		return true
+	}
+	t, ok := target.(*ConstraintError)
+	return ok && t.Kind == e.Kind && t.Table == e.Table && t.Field == e.Field
+}
+
+// Unwrap returns the driver's error.
+func (e *ConstraintError) Unwrap() error {
+	return e.err
+}
+
+var (
+	// pqKeyDetail is the start of the detail Postgres gives unique and
+	// foreign key violations: Key (email)=(a@example.com) already exists.
+	pqKeyDetail = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+	// sqliteColumns is the end of SQLite's unique and check violation
+	// messages: the columns, or the check's expression.
+	sqliteColumns = regexp.MustCompile(`(?:UNIQUE|CHECK) constraint failed: (.+?)(?: \(\d+\))?$`)
+	identifier    = regexp.MustCompile(`^\w+`)
+)
+
+// constraintError returns err as a *ConstraintError if it is a constraint
+// violation reported by either driver, and unchanged otherwise.
+func constraintError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqConstraintError(pqErr)
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteConstraintError(sqliteErr)
+	}
+	return err
+}
+
+func pqConstraintError(err *pq.Error) error {
+	e := &ConstraintError{Table: err.Table, Constraint: err.Constraint, err: err}
+	switch err.Code.Name() {
+	case "unique_violation":
+		e.Kind = ErrUniqueViolation
+	case "foreign_key_violation":
+		e.Kind = ErrForeignKeyViolation
+	case "check_violation":
+		e.Kind = ErrCheckViolation
+	default:
+		return err
+	}
+
+	if match := pqKeyDetail.FindStringSubmatch(err.Detail); match != nil {
+		e.Field = match[1]
+	} else {
+		// Postgres names a column's check constraint <table>_<column>_check.
+		e.Field = strings.TrimSuffix(strings.TrimPrefix(err.Constraint, err.Table+"_"), "_check")
+	}
+	return e
+}
+
+func sqliteConstraintError(err *sqlite.Error) error {
+	e := &ConstraintError{err: err}
+	switch err.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		e.Kind = ErrUniqueViolation
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		// SQLite does not say which key.
+		e.Kind = ErrForeignKeyViolation
+		return e
+	case sqlite3.SQLITE_CONSTRAINT_CHECK:
+		e.Kind = ErrCheckViolation
+	default:
+		return err
+	}
+
+	match := sqliteColumns.FindStringSubmatch(err.Error())
+	if match == nil {
+		return e
+	}
+	if e.Kind == ErrCheckViolation {
+		// The expression, which for the schema's checks starts with the
+		// column.
+		e.Field = identifier.FindString(match[1])
+		return e
+	}
+	// Unique columns come as table.column, table.column.
+	var fields []string
+	for _, column := range strings.Split(match[1], ", ") {
+		table, field, _ := strings.Cut(column, ".")
+		e.Table = table
+		fields = append(fields, field)
+	}
+	e.Field = strings.Join(fields, ", ")
+	return e
+}
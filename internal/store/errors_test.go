@@ -0,0 +1,61 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestPostgresConstraintErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  *pq.Error
+		want *ConstraintError
+	}{
+		{
+			name: "unique",
+			err:  &pq.Error{Code: "23505", Table: "users", Constraint: "users_email_key", Detail: "Key (email)=(alice@example.com) already exists."},
+			want: ErrDuplicateEmail,
+		},
+		{
+			name: "unique on several columns",
+			err:  &pq.Error{Code: "23505", Table: "members", Constraint: "members_pkey", Detail: "Key (doc_id, user_id)=(doc, 1) already exists."},
+			want: &ConstraintError{Kind: ErrUniqueViolation, Table: "members", Field: "doc_id, user_id"},
+		},
+		{
+			name: "foreign key",
+			err:  &pq.Error{Code: "23503", Table: "members", Constraint: "members_user_id_fkey", Detail: `Key (user_id)=(7) is not present in table "users".`},
+			want: &ConstraintError{Kind: ErrForeignKeyViolation, Table: "members", Field: "user_id"},
+		},
+		{
+			name: "check",
+			err:  &pq.Error{Code: "23514", Table: "members", Constraint: "members_role_check"},
+			want: &ConstraintError{Kind: ErrCheckViolation, Table: "members", Field: "role"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := constraintError(fmt.Errorf("insert: %w", tc.err))
+			var got *ConstraintError
+			if !errors.As(err, &got) {
+				t.Fatalf("got %v, want a ConstraintError", err)
+			}
+			if !errors.Is(err, tc.want) || !errors.Is(err, tc.want.Kind) {
+				t.Fatalf("got %s %q %q, want %s %q %q", got.Kind, got.Table, got.Field, tc.want.Kind, tc.want.Table, tc.want.Field)
+			}
+			if got.Constraint != tc.err.Constraint {
+				t.Fatalf("got constraint %q, want %q", got.Constraint, tc.err.Constraint)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatal("the driver's error is not wrapped")
+			}
+		})
+	}
+
+	// Other errors pass through unchanged.
+	notNull := &pq.Error{Code: "23502", Table: "users", Column: "email"}
+	if err := constraintError(notNull); err != error(notNull) {
+		t.Fatalf("got %v, want the driver's error", err)
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Role is a user's level of access to a document.
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleEditor    Role = "editor"
+	RoleCommenter Role = "commenter"
+	RoleViewer    Role = "viewer"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	_, ok := roleRank[r]
+	return ok
+}
+
+// AtLeast reports whether r grants everything min does.
+func (r Role) AtLeast(min Role) bool {
+	return roleRank[r] >= roleRank[min]
+}
+
+// CanEdit reports whether r may change document content.
+func (r Role) CanEdit() bool {
+	return r.AtLeast(RoleEditor)
+}
+
+// Member grants a user a role on a document.
+type Member struct {
+	DocID     string    `json:"doc_id"`
+	UserID    int64     `json:"user_id"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MemberStore struct {
+	db *sql.DB
+}
+
+// Set grants member.Role to the user, replacing any role they had.
+func (s *MemberStore) Set(ctx context.Context, member *Member) error {
+	query := `
+		INSERT INTO document_members (doc_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (doc_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	err := s.db.QueryRowContext(ctx, query, member.DocID, member.UserID, member.Role).Scan(&member.CreatedAt)
+	return constraintError(err)
+}
+
+// GetRole returns the user's role on the document, or ErrNotFound if they
+// are not a member.
+func (s *MemberStore) GetRole(ctx context.Context, docID string, userID int64) (Role, error) {
+	query := `SELECT role FROM document_members WHERE doc_id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	var role Role
+	err := s.db.QueryRowContext(ctx, query, docID, userID).Scan(&role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrNotFound
+		default:
+			return "", err
+		}
+	}
+	return role, nil
+}
+
+// List returns the members of a document, owner first.
+func (s *MemberStore) List(ctx context.Context, docID string) ([]*Member, error) {
+	query := `
+		SELECT doc_id, user_id, role, created_at
+		FROM document_members
+		WHERE doc_id = $1
+		ORDER BY role = 'owner' DESC, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Member{}
+	for rows.Next() {
+		m := &Member{}
+		if err := rows.Scan(&m.DocID, &m.UserID, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// ListForUser returns the memberships of a user, by document ID.
+func (s *MemberStore) ListForUser(ctx context.Context, userID int64) ([]*Member, error) {
+	query := `
+		SELECT doc_id, user_id, role, created_at
+		FROM document_members
+		WHERE user_id = $1
+		ORDER BY doc_id
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Member{}
+	for rows.Next() {
+		m := &Member{}
+		if err := rows.Scan(&m.DocID, &m.UserID, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Remove revokes the user's access to the document.
+func (s *MemberStore) Remove(ctx context.Context, docID string, userID int64) error {
+	query := `DELETE FROM document_members WHERE doc_id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, query, docID, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
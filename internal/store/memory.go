@@ -0,0 +1,496 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryStorage returns a Storage that keeps everything in memory, for
+// tests that should not need a database. It enforces the same constraints
+// as the Postgres schema, cascades deletes the same way and returns the
+// same errors: ErrNotFound, and a *ConstraintError for every write the
+// schema would reject.
+func NewMemoryStorage() Storage {
+	m := &memoryDB{
+		users:     make(map[int64]*User),
+		documents: make(map[string]*Document),
+		members:   make(map[string]map[int64]*Member),
+		revisions: make(map[string][]*Revision),
+		sessions:  make(map[int64]*memorySession),
+	}
+	return Storage{
+		User:     &memoryUsers{m},
+		Document: &memoryDocuments{m},
+		Member:   &memoryMembers{m},
+		Revision: &memoryRevisions{m},
+		Session:  &memorySessions{m},
+	}
+}
+
+// memoryDB holds the tables every in-memory repository shares, so deletes
+// can cascade across them.
+type memoryDB struct {
+	mu sync.Mutex
+
+	users     map[int64]*User
+	documents map[string]*Document
+	// members and revisions are keyed by document ID.
+	members   map[string]map[int64]*Member
+	revisions map[string][]*Revision
+	sessions  map[int64]*memorySession
+
+	lastUserID     int64
+	lastDocumentID int64
+	lastRevisionID int64
+	lastSessionID  int64
+}
+
+type memorySession struct {
+	Session
+	rotated bool
+	revoked bool
+}
+
+// now is the current time at the precision of a timestamp(0) column.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// page returns the items a LIMIT and OFFSET would.
+func page[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+type memoryUsers struct{ db *memoryDB }
+
+func (s *memoryUsers) Create(ctx context.Context, user *User) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for _, other := range s.db.users {
+		switch {
+		case strings.EqualFold(other.Email, user.Email):
+			return ErrDuplicateEmail
+		case other.Username == user.Username:
+			return ErrDuplicateUsername
+		}
+	}
+	s.db.lastUserID++
+	created := now().Format(time.RFC3339Nano)
+	user.ID, user.CreatedAt = s.db.lastUserID, created
+
+	stored := *user
+	stored.Password.text = nil
+	stored.UpdatedAt = created
+	s.db.users[stored.ID] = &stored
+	return nil
+}
+
+func (s *memoryUsers) GetById(ctx context.Context, id int64) (*User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	user, ok := s.db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *user
+	return &found, nil
+}
+
+func (s *memoryUsers) GetAll(ctx context.Context) ([]*User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	users := make([]*User, 0, len(s.db.users))
+	for _, user := range s.db.users {
+		found := *user
+		users = append(users, &found)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryUsers) GetByEmail(ctx context.Context, email string) (*User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for _, user := range s.db.users {
+		if strings.EqualFold(user.Email, email) {
+			found := *user
+			found.UpdatedAt = ""
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Delete removes the user with their memberships and sessions, and the
+// documents they own. Revisions they made of other documents stay, without
+// an author.
+func (s *memoryUsers) Delete(ctx context.Context, id int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if _, ok := s.db.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.db.users, id)
+	for docID, members := range s.db.members {
+		if member, ok := members[id]; ok && member.Role == RoleOwner {
+			delete(s.db.documents, docID)
+			delete(s.db.members, docID)
+			delete(s.db.revisions, docID)
+			continue
+		}
+		delete(members, id)
+	}
+	for _, revisions := range s.db.revisions {
+		for _, rev := range revisions {
+			if rev.UserID != nil && *rev.UserID == id {
+				rev.UserID = nil
+			}
+		}
+	}
+	for sessionID, session := range s.db.sessions {
+		if session.UserID == id {
+			delete(s.db.sessions, sessionID)
+		}
+	}
+	return nil
+}
+
+type memoryDocuments struct{ db *memoryDB }
+
+func (s *memoryDocuments) CreateDocument(ctx context.Context, doc *Document, ownerID int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if _, ok := s.db.documents[doc.DocID]; ok {
+		return &ConstraintError{Kind: ErrUniqueViolation, Table: "documents", Field: "doc_id"}
+	}
+	if doc.MergeStrategy != "ot" && doc.MergeStrategy != "crdt" {
+		return &ConstraintError{Kind: ErrCheckViolation, Table: "documents", Field: "merge_strategy"}
+	}
+	if _, ok := s.db.users[ownerID]; !ok {
+		return &ConstraintError{Kind: ErrForeignKeyViolation, Table: "document_revisions", Field: "user_id"}
+	}
+
+	s.db.lastDocumentID++
+	doc.ID, doc.Revision, doc.UpdatedAt = s.db.lastDocumentID, 1, now()
+	stored := *doc
+	stored.MergeState = nil
+	s.db.documents[doc.DocID] = &stored
+	s.db.addRevision(doc.DocID, doc.Revision, doc.Content, ownerID)
+	s.db.members[doc.DocID] = map[int64]*Member{
+		ownerID: {DocID: doc.DocID, UserID: ownerID, Role: RoleOwner, CreatedAt: now()},
+	}
+	return nil
+}
+
+func (s *memoryDocuments) GetDocumentByDocID(ctx context.Context, docID string) (*Document, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	doc, ok := s.db.documents[docID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *doc
+	found.MergeState = slices.Clone(doc.MergeState)
+	return &found, nil
+}
+
+func (s *memoryDocuments) ListDocumentsForUser(ctx context.Context, userID int64, limit, offset int) ([]*Document, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	docs := []*Document{}
+	for docID, members := range s.db.members {
+		if _, ok := members[userID]; ok {
+			found := *s.db.documents[docID]
+			found.MergeState = nil
+			docs = append(docs, &found)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].UpdatedAt.Equal(docs[j].UpdatedAt) {
+			return docs[i].UpdatedAt.After(docs[j].UpdatedAt)
+		}
+		return docs[i].ID > docs[j].ID
+	})
+	return page(docs, limit, offset), nil
+}
+
+func (s *memoryDocuments) UpdateDocument(ctx context.Context, docID, content string, userID int64) (int64, error) {
+	return s.update(docID, content, userID, nil)
+}
+
+func (s *memoryDocuments) UpdateDocumentWithState(ctx context.Context, docID, content string, state []byte, userID int64) (int64, error) {
+	return s.update(docID, content, userID, func(doc *Document) {
+		doc.MergeState = slices.Clone(state)
+	})
+}
+
+// update stores a new revision of a document, changing anything else about
+// it with set, if given.
+func (s *memoryDocuments) update(docID, content string, userID int64, set func(*Document)) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	doc, ok := s.db.documents[docID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if _, ok := s.db.users[userID]; !ok {
+		return 0, &ConstraintError{Kind: ErrForeignKeyViolation, Table: "document_revisions", Field: "user_id"}
+	}
+	doc.Content, doc.Revision, doc.UpdatedAt = content, doc.Revision+1, now()
+	if set != nil {
+		set(doc)
+	}
+	s.db.addRevision(docID, doc.Revision, content, userID)
+	return doc.Revision, nil
+}
+
+// DeleteDocument removes a document along with its memberships and
+// revisions.
+func (s *memoryDocuments) DeleteDocument(ctx context.Context, docID string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if _, ok := s.db.documents[docID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.db.documents, docID)
+	delete(s.db.members, docID)
+	delete(s.db.revisions, docID)
+	return nil
+}
+
+// addRevision records a revision; the caller holds mu.
+func (m *memoryDB) addRevision(docID string, revision int64, content string, userID int64) {
+	m.lastRevisionID++
+	m.revisions[docID] = append(m.revisions[docID], &Revision{
+		ID:        m.lastRevisionID,
+		DocID:     docID,
+		Revision:  revision,
+		Content:   content,
+		UserID:    &userID,
+		CreatedAt: now(),
+	})
+}
+
+type memoryMembers struct{ db *memoryDB }
+
+func (s *memoryMembers) Set(ctx context.Context, member *Member) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	members, ok := s.db.members[member.DocID]
+	if _, exists := s.db.documents[member.DocID]; !exists || !ok {
+		return &ConstraintError{Kind: ErrForeignKeyViolation, Table: "document_members", Field: "doc_id"}
+	}
+	if _, ok := s.db.users[member.UserID]; !ok {
+		return &ConstraintError{Kind: ErrForeignKeyViolation, Table: "document_members", Field: "user_id"}
+	}
+	if !member.Role.Valid() {
+		return &ConstraintError{Kind: ErrCheckViolation, Table: "document_members", Field: "role"}
+	}
+
+	if existing, ok := members[member.UserID]; ok {
+		existing.Role = member.Role
+		member.CreatedAt = existing.CreatedAt
+		return nil
+	}
+	member.CreatedAt = now()
+	stored := *member
+	members[member.UserID] = &stored
+	return nil
+}
+
+func (s *memoryMembers) GetRole(ctx context.Context, docID string, userID int64) (Role, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	member, ok := s.db.members[docID][userID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return member.Role, nil
+}
+
+// List returns the members of a document, owner first.
+func (s *memoryMembers) List(ctx context.Context, docID string) ([]*Member, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	members := []*Member{}
+	for _, member := range s.db.members[docID] {
+		found := *member
+		members = append(members, &found)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if (a.Role == RoleOwner) != (b.Role == RoleOwner) {
+			return a.Role == RoleOwner
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.UserID < b.UserID
+	})
+	return members, nil
+}
+
+// ListForUser returns the memberships of a user, by document ID.
+func (s *memoryMembers) ListForUser(ctx context.Context, userID int64) ([]*Member, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	members := []*Member{}
+	for _, docMembers := range s.db.members {
+		if member, ok := docMembers[userID]; ok {
+			found := *member
+			members = append(members, &found)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].DocID < members[j].DocID })
+	return members, nil
+}
+
+func (s *memoryMembers) Remove(ctx context.Context, docID string, userID int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if _, ok := s.db.members[docID][userID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.db.members[docID], userID)
+	return nil
+}
+
+type memoryRevisions struct{ db *memoryDB }
+
+// List returns a page of a document's revisions, newest first, without
+// their content.
+func (s *memoryRevisions) List(ctx context.Context, docID string, limit, offset int) ([]*Revision, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	stored := s.db.revisions[docID]
+	revisions := make([]*Revision, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		found := *stored[i]
+		found.Content = ""
+		revisions = append(revisions, &found)
+	}
+	return page(revisions, limit, offset), nil
+}
+
+func (s *memoryRevisions) Get(ctx context.Context, docID string, revision int64) (*Revision, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for _, rev := range s.db.revisions[docID] {
+		if rev.Revision == revision {
+			found := *rev
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type memorySessions struct{ db *memoryDB }
+
+func (s *memorySessions) Create(ctx context.Context, session *Session) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.insertSession(session)
+}
+
+func (s *memorySessions) Rotate(ctx context.Context, tokenHash []byte, next *Session, issue func(*Session) error) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	old := s.db.sessionByHash(tokenHash)
+	if old == nil {
+		return ErrNotFound
+	}
+	next.UserID, next.Family = old.UserID, old.Family
+
+	switch {
+	case old.revoked:
+		return ErrSessionRevoked
+	case old.rotated:
+		s.db.revokeFamily(old.Family)
+		return ErrSessionReused
+	case time.Now().After(old.ExpiresAt):
+		return ErrSessionExpired
+	}
+	if err := issue(next); err != nil {
+		return err
+	}
+	if err := s.db.insertSession(next); err != nil {
+		return err
+	}
+	old.rotated = true
+	return nil
+}
+
+func (s *memorySessions) Revoke(ctx context.Context, tokenHash []byte) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	session := s.db.sessionByHash(tokenHash)
+	if session == nil {
+		return ErrNotFound
+	}
+	s.db.revokeFamily(session.Family)
+	return nil
+}
+
+// IsRevoked reports whether the access token with the given jti belongs to
+// a revoked session. Tokens whose session no longer exists count as
+// revoked.
+func (s *memorySessions) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for _, session := range s.db.sessions {
+		if session.AccessJTI == jti {
+			return session.revoked, nil
+		}
+	}
+	return true, nil
+}
+
+// insertSession stores a session; the caller holds mu.
+func (m *memoryDB) insertSession(session *Session) error {
+	if _, ok := m.users[session.UserID]; !ok {
+		return &ConstraintError{Kind: ErrForeignKeyViolation, Table: "sessions", Field: "user_id"}
+	}
+	for _, other := range m.sessions {
+		switch {
+		case string(other.TokenHash) == string(session.TokenHash):
+			return &ConstraintError{Kind: ErrUniqueViolation, Table: "sessions", Field: "token_hash"}
+		case other.AccessJTI == session.AccessJTI:
+			return &ConstraintError{Kind: ErrUniqueViolation, Table: "sessions", Field: "access_jti"}
+		}
+	}
+	m.lastSessionID++
+	session.ID, session.CreatedAt = m.lastSessionID, now()
+	m.sessions[session.ID] = &memorySession{Session: *session}
+	return nil
+}
+
+// sessionByHash returns the session for a refresh token; the caller holds
+// mu.
+func (m *memoryDB) sessionByHash(tokenHash []byte) *memorySession {
+	for _, session := range m.sessions {
+		if string(session.TokenHash) == string(tokenHash) {
+			return session
+		}
+	}
+	return nil
+}
+
+// revokeFamily revokes every session of a login; the caller holds mu.
+func (m *memoryDB) revokeFamily(family string) {
+	for _, session := range m.sessions {
+		if session.Family == family {
+			session.revoked = true
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/cmd/migrate/migrations"
+	"github.com/vlkhvnn/DocCollab/internal/db"
+)
+
+// forEachStorage runs test against fresh memory storage and fresh SQLite
+// storage, so the memory store is held to what the schema does.
+func forEachStorage(t *testing.T, test func(t *testing.T, s Storage)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStorage())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		conn, err := db.New("sqlite://"+filepath.Join(t.TempDir(), "test.db"), 1, 1, "1m")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := db.Migrate(context.Background(), conn, db.SQLite, migrations.FS); err != nil {
+			t.Fatal(err)
+		}
+		test(t, NewSQLiteStorage(conn))
+	})
+}
+
+func createUser(t *testing.T, s Storage, name string) *User {
+	t.Helper()
+	user := &User{Username: name, Email: name + "@example.com"}
+	if err := user.Password.Set("password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.User.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func createDocument(t *testing.T, s Storage, docID string, owner *User) *Document {
+	t.Helper()
+	doc := &Document{DocID: docID, Content: "hello", MergeStrategy: "ot"}
+	if err := s.Document.CreateDocument(context.Background(), doc, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestUserErrors(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		alice := createUser(t, s, "alice")
+
+		for _, tc := range []struct {
+			name     string
+			username string
+			email    string
+			want     error
+		}{
+			{name: "duplicate username", username: "alice", email: "other@example.com", want: ErrDuplicateUsername},
+			{name: "duplicate email", username: "other", email: "alice@example.com", want: ErrDuplicateEmail},
+			{name: "duplicate email in another case", username: "other", email: "Alice@Example.com", want: ErrDuplicateEmail},
+		} {
+			user := &User{Username: tc.username, Email: tc.email}
+			user.Password.Set("password")
+			err := s.User.Create(ctx, user)
+			var constraintErr *ConstraintError
+			if !errors.Is(err, tc.want) || !errors.As(err, &constraintErr) {
+				t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+			}
+		}
+
+		if _, err := s.User.GetById(ctx, alice.ID+1); err != ErrNotFound {
+			t.Errorf("getting a missing user: got %v, want ErrNotFound", err)
+		}
+		if _, err := s.User.GetByEmail(ctx, "bob@example.com"); err != ErrNotFound {
+			t.Errorf("getting a missing email: got %v, want ErrNotFound", err)
+		}
+		if found, err := s.User.GetByEmail(ctx, "ALICE@example.com"); err != nil || found.ID != alice.ID {
+			t.Errorf("getting an email in another case: got %v, %v", found, err)
+		}
+		if err := s.User.Delete(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.User.Delete(ctx, alice.ID); err != ErrNotFound {
+			t.Errorf("deleting a deleted user: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestDocumentErrors(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		alice := createUser(t, s, "alice")
+		createDocument(t, s, "doc", alice)
+
+		for _, tc := range []struct {
+			name     string
+			docID    string
+			strategy string
+			ownerID  int64
+			want     error
+			// field is the column the violated check is on.
+			field string
+		}{
+			{name: "duplicate doc ID", docID: "doc", strategy: "ot", ownerID: alice.ID,
+				want: &ConstraintError{Kind: ErrUniqueViolation, Table: "documents", Field: "doc_id"}},
+			{name: "unknown strategy", docID: "other", strategy: "merge", ownerID: alice.ID, want: ErrCheckViolation, field: "merge_strategy"},
+			{name: "unknown owner", docID: "other", strategy: "ot", ownerID: alice.ID + 1, want: ErrForeignKeyViolation},
+		} {
+			err := s.Document.CreateDocument(ctx, &Document{DocID: tc.docID, MergeStrategy: tc.strategy}, tc.ownerID)
+			var constraintErr *ConstraintError
+			if !errors.Is(err, tc.want) || !errors.As(err, &constraintErr) {
+				t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+			} else if tc.field != "" && constraintErr.Field != tc.field {
+				t.Errorf("%s: violated check on %q, want %q", tc.name, constraintErr.Field, tc.field)
+			}
+		}
+		if _, err := s.Document.GetDocumentByDocID(ctx, "other"); err != ErrNotFound {
+			t.Errorf("a failed create left a document behind: got %v, want ErrNotFound", err)
+		}
+
+		if _, err := s.Document.UpdateDocument(ctx, "missing", "", alice.ID); err != ErrNotFound {
+			t.Errorf("updating a missing document: got %v, want ErrNotFound", err)
+		}
+		if _, err := s.Document.UpdateDocument(ctx, "doc", "", alice.ID+1); !errors.Is(err, ErrForeignKeyViolation) {
+			t.Errorf("updating as a missing user: got %v, want ErrForeignKeyViolation", err)
+		}
+		if _, err := s.Revision.Get(ctx, "doc", 2); err != ErrNotFound {
+			t.Errorf("a failed update left a revision behind: got %v, want ErrNotFound", err)
+		}
+		if err := s.Document.DeleteDocument(ctx, "missing"); err != ErrNotFound {
+			t.Errorf("deleting a missing document: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestDocumentMergeState(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		alice := createUser(t, s, "alice")
+		createDocument(t, s, "doc", alice)
+
+		get := func() *Document {
+			t.Helper()
+			doc, err := s.Document.GetDocumentByDocID(ctx, "doc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return doc
+		}
+		if doc := get(); doc.MergeState != nil {
+			t.Fatalf("new document has merge state %q", doc.MergeState)
+		}
+
+		state := []byte(`[{"id":{"clock":1,"site":"server"},"value":"h"}]`)
+		revision, err := s.Document.UpdateDocumentWithState(ctx, "doc", "h", state, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc := get(); doc.Revision != revision || doc.Content != "h" || !bytes.Equal(doc.MergeState, state) {
+			t.Fatalf("got %q with state %q at revision %d", doc.Content, doc.MergeState, doc.Revision)
+		}
+
+		// A plain update leaves the state for the room to reconcile.
+		if _, err := s.Document.UpdateDocument(ctx, "doc", "hi", alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if doc := get(); doc.Content != "hi" || !bytes.Equal(doc.MergeState, state) {
+			t.Fatalf("got %q with state %q", doc.Content, doc.MergeState)
+		}
+
+		if _, err := s.Document.UpdateDocumentWithState(ctx, "doc", "", nil, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if doc := get(); doc.MergeState != nil {
+			t.Fatalf("cleared state is %q", doc.MergeState)
+		}
+		if _, err := s.Document.UpdateDocumentWithState(ctx, "missing", "", state, alice.ID); err != ErrNotFound {
+			t.Errorf("updating a missing document: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestMemberErrors(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		alice, bob := createUser(t, s, "alice"), createUser(t, s, "bob")
+		createDocument(t, s, "doc", alice)
+
+		for _, tc := range []struct {
+			name   string
+			member Member
+			want   error
+			field  string
+		}{
+			{name: "unknown document", member: Member{DocID: "missing", UserID: bob.ID, Role: RoleEditor}, want: ErrForeignKeyViolation},
+			{name: "unknown user", member: Member{DocID: "doc", UserID: bob.ID + 1, Role: RoleEditor}, want: ErrForeignKeyViolation},
+			{name: "unknown role", member: Member{DocID: "doc", UserID: bob.ID, Role: "admin"}, want: ErrCheckViolation, field: "role"},
+		} {
+			err := s.Member.Set(ctx, &tc.member)
+			var constraintErr *ConstraintError
+			if !errors.Is(err, tc.want) || !errors.As(err, &constraintErr) {
+				t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+			} else if tc.field != "" && constraintErr.Field != tc.field {
+				t.Errorf("%s: violated check on %q, want %q", tc.name, constraintErr.Field, tc.field)
+			}
+		}
+		if _, err := s.Member.GetRole(ctx, "doc", bob.ID); err != ErrNotFound {
+			t.Errorf("a failed set left a member behind: got %v, want ErrNotFound", err)
+		}
+
+		// Setting an existing member changes their role in place.
+		first := &Member{DocID: "doc", UserID: bob.ID, Role: RoleEditor}
+		if err := s.Member.Set(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+		again := &Member{DocID: "doc", UserID: bob.ID, Role: RoleViewer}
+		if err := s.Member.Set(ctx, again); err != nil {
+			t.Fatalf("setting an existing member: %v", err)
+		}
+		if !again.CreatedAt.Equal(first.CreatedAt) {
+			t.Errorf("membership recreated at %v, was %v", again.CreatedAt, first.CreatedAt)
+		}
+		members, err := s.Member.List(ctx, "doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(members) != 2 || members[0].UserID != alice.ID || members[0].Role != RoleOwner || members[1].Role != RoleViewer {
+			t.Fatalf("got members %+v %+v, want the owner, then bob as a viewer", members[0], members[len(members)-1])
+		}
+
+		if err := s.Member.Remove(ctx, "doc", bob.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Member.Remove(ctx, "doc", bob.ID); err != ErrNotFound {
+			t.Errorf("removing a removed member: got %v, want ErrNotFound", err)
+		}
+
+		// Deleting the owner's account takes the membership with it.
+		if err := s.User.Delete(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Member.GetRole(ctx, "doc", alice.ID); err != ErrNotFound {
+			t.Errorf("deleted owner's role: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestDeleteUserDeletesOwnedDocuments(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		alice, bob := createUser(t, s, "alice"), createUser(t, s, "bob")
+		createDocument(t, s, "alices", alice)
+		createDocument(t, s, "bobs", bob)
+		for _, m := range []*Member{
+			{DocID: "alices", UserID: bob.ID, Role: RoleEditor},
+			{DocID: "bobs", UserID: alice.ID, Role: RoleViewer},
+		} {
+			if err := s.Member.Set(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		memberships, err := s.Member.ListForUser(ctx, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(memberships) != 2 || memberships[0].DocID != "alices" || memberships[0].Role != RoleOwner ||
+			memberships[1].DocID != "bobs" || memberships[1].Role != RoleViewer {
+			t.Fatalf("got memberships %+v", memberships)
+		}
+
+		if err := s.User.Delete(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Document.GetDocumentByDocID(ctx, "alices"); err != ErrNotFound {
+			t.Errorf("owned document: got %v, want ErrNotFound", err)
+		}
+		if _, err := s.Document.GetDocumentByDocID(ctx, "bobs"); err != nil {
+			t.Errorf("document alice was a member of: %v", err)
+		}
+		if memberships, err := s.Member.ListForUser(ctx, bob.ID); err != nil || len(memberships) != 1 {
+			t.Errorf("bob's memberships: got %v, %v; want only his own document", memberships, err)
+		}
+	})
+}
+
+func TestRotateSession(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		alice := createUser(t, s, "alice")
+		first := &Session{UserID: alice.ID, Family: "login", TokenHash: []byte("first"), AccessJTI: "jti-1", ExpiresAt: time.Now().Add(time.Hour)}
+		if err := s.Session.Create(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+		issued := func(*Session) error { return nil }
+
+		// A failure to issue the new tokens leaves the old one usable.
+		failed := &Session{TokenHash: []byte("failed"), AccessJTI: "jti-failed", ExpiresAt: time.Now().Add(time.Hour)}
+		signErr := errors.New("signing failed")
+		if err := s.Session.Rotate(ctx, []byte("first"), failed, func(*Session) error { return signErr }); !errors.Is(err, signErr) {
+			t.Fatalf("got %v, want the signing error", err)
+		}
+		if revoked, err := s.Session.IsRevoked(ctx, "jti-failed"); err != nil || !revoked {
+			t.Fatalf("the failed session was stored: revoked %v, %v", revoked, err)
+		}
+
+		second := &Session{TokenHash: []byte("second"), AccessJTI: "jti-2", ExpiresAt: time.Now().Add(time.Hour)}
+		var seen *Session
+		if err := s.Session.Rotate(ctx, []byte("first"), second, func(next *Session) error { seen = next; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if seen != second || second.UserID != alice.ID || second.Family != "login" {
+			t.Fatalf("rotated into %+v", second)
+		}
+
+		// Replaying the first token revokes the whole login.
+		replay := &Session{TokenHash: []byte("replay"), AccessJTI: "jti-3", ExpiresAt: time.Now().Add(time.Hour)}
+		if err := s.Session.Rotate(ctx, []byte("first"), replay, issued); err != ErrSessionReused {
+			t.Fatalf("replaying a rotated token: got %v, want ErrSessionReused", err)
+		}
+		for _, jti := range []string{"jti-1", "jti-2"} {
+			if revoked, err := s.Session.IsRevoked(ctx, jti); err != nil || !revoked {
+				t.Errorf("%s after a replay: revoked %v, %v", jti, revoked, err)
+			}
+		}
+		if err := s.Session.Rotate(ctx, []byte("second"), replay, issued); err != ErrSessionRevoked {
+			t.Fatalf("rotating a revoked token: got %v, want ErrSessionRevoked", err)
+		}
+		if err := s.Session.Rotate(ctx, []byte("unknown"), replay, issued); err != ErrNotFound {
+			t.Fatalf("rotating an unknown token: got %v, want ErrNotFound", err)
+		}
+	})
+}
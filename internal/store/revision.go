@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Revision is a snapshot of a document's content after a change.
+type Revision struct {
+	ID        int64     `json:"id"`
+	DocID     string    `json:"doc_id"`
+	Revision  int64     `json:"revision"`
+	Content   string    `json:"content,omitempty"`
+	UserID    *int64    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type RevisionStore struct {
+	db *sql.DB
+}
+
+// List returns a page of a document's revisions, newest first. Content is
+// left out to keep the listing small.
+func (s *RevisionStore) List(ctx context.Context, docID string, limit, offset int) ([]*Revision, error) {
+	query := `
+		SELECT id, doc_id, revision, user_id, created_at
+		FROM document_revisions
+		WHERE doc_id = $1
+		ORDER BY revision DESC
+		LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, docID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*Revision{}
+	for rows.Next() {
+		rev := &Revision{}
+		if err := rows.Scan(&rev.ID, &rev.DocID, &rev.Revision, &rev.UserID, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Get returns a document's content as of the given revision.
+func (s *RevisionStore) Get(ctx context.Context, docID string, revision int64) (*Revision, error) {
+	query := `
+		SELECT id, doc_id, revision, content, user_id, created_at
+		FROM document_revisions
+		WHERE doc_id = $1 AND revision = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	rev := &Revision{}
+	err := s.db.QueryRowContext(ctx, query, docID, revision).Scan(
+		&rev.ID,
+		&rev.DocID,
+		&rev.Revision,
+		&rev.Content,
+		&rev.UserID,
+		&rev.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return rev, nil
+}
+
+func insertRevision(ctx context.Context, tx *sql.Tx, docID string, revision int64, content string, userID int64) error {
+	query := `
+		INSERT INTO document_revisions (doc_id, revision, content, user_id)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := tx.ExecContext(ctx, query, docID, revision, content, userID)
+	return err
+}
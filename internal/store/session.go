@@ -0,0 +1,175 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionExpired = errors.New("session has expired")
+	ErrSessionRevoked = errors.New("session has been revoked")
+	ErrSessionReused  = errors.New("refresh token was already used, session revoked")
+)
+
+// Session is one refresh token. Refreshing replaces a session with a new
+// one in the same family, so a family is a single login. The access token
+// issued alongside the refresh token is identified by AccessJTI.
+type Session struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Family    string    `json:"family"`
+	TokenHash []byte    `json:"-"`
+	AccessJTI string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SessionStore struct {
+	db *sql.DB
+	// lock ends the query Rotate reads a session with, locking its row.
+	// SQLite has no row locks; its transactions take the database's write
+	// lock up front instead.
+	lock string
+}
+
+// Create stores a new session.
+func (s *SessionStore) Create(ctx context.Context, session *Session) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		return insertSession(ctx, tx, session)
+	})
+}
+
+// Rotate exchanges the session whose refresh token hashes to tokenHash for
+// next, which joins the same user and family. A token that was already
+// rotated is being replayed, by an attacker or a client that lost the
+// response, so the whole family is revoked and ErrSessionReused returned.
+//
+// issue is called with next once its user and family are filled in, to
+// sign what is handed out for it. If it fails, nothing is rotated.
+func (s *SessionStore) Rotate(ctx context.Context, tokenHash []byte, next *Session, issue func(*Session) error) error {
+	reused := false
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		query := `
+			SELECT id, user_id, family, expires_at, rotated_at, revoked_at
+			FROM sessions
+			WHERE token_hash = $1
+		` + s.lock
+		var (
+			id                 int64
+			expiresAt          time.Time
+			rotatedAt, revoked sql.NullTime
+		)
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+		err := tx.QueryRowContext(ctx, query, tokenHash).Scan(
+			&id,
+			&next.UserID,
+			&next.Family,
+			&expiresAt,
+			&rotatedAt,
+			&revoked,
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNotFound
+			default:
+				return err
+			}
+		}
+
+		switch {
+		case revoked.Valid:
+			return ErrSessionRevoked
+		case rotatedAt.Valid:
+			reused = true
+			return revokeFamily(ctx, tx, next.Family)
+		case time.Now().After(expiresAt):
+			return ErrSessionExpired
+		}
+
+		if err := issue(next); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE sessions SET rotated_at = CURRENT_TIMESTAMP WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return insertSession(ctx, tx, next)
+	})
+	if err == nil && reused {
+		return ErrSessionReused
+	}
+	return err
+}
+
+// Revoke ends the login the refresh token hashing to tokenHash belongs to,
+// invalidating every refresh and access token issued for it.
+func (s *SessionStore) Revoke(ctx context.Context, tokenHash []byte) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		query := `SELECT family FROM sessions WHERE token_hash = $1`
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+		var family string
+		if err := tx.QueryRowContext(ctx, query, tokenHash).Scan(&family); err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNotFound
+			default:
+				return err
+			}
+		}
+		return revokeFamily(ctx, tx, family)
+	})
+}
+
+// IsRevoked reports whether the access token with the given jti belongs to
+// a revoked session. Tokens whose session no longer exists count as
+// revoked.
+func (s *SessionStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	query := `SELECT revoked_at IS NOT NULL FROM sessions WHERE access_jti = $1`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, query, jti).Scan(&revoked)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return true, nil
+		default:
+			return false, err
+		}
+	}
+	return revoked, nil
+}
+
+func insertSession(ctx context.Context, tx *sql.Tx, session *Session) error {
+	query := `
+		INSERT INTO sessions (user_id, family, token_hash, access_jti, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	return tx.QueryRowContext(
+		ctx,
+		query,
+		session.UserID,
+		session.Family,
+		session.TokenHash,
+		session.AccessJTI,
+		session.ExpiresAt,
+	).Scan(
+		&session.ID,
+		&session.CreatedAt,
+	)
+}
+
+func revokeFamily(ctx context.Context, tx *sql.Tx, family string) error {
+	query := `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE family = $1 AND revoked_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+	_, err := tx.ExecContext(ctx, query, family)
+	return err
+}
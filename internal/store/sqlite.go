@@ -0,0 +1,17 @@
+package store
+
+import "database/sql"
+
+// NewSQLiteStorage returns a Storage backed by a SQLite database with the
+// sqlite migrations applied. The repositories' queries are written to run
+// on both dialects, and constraint errors from either are classified the
+// same way.
+func NewSQLiteStorage(db *sql.DB) Storage {
+	return Storage{
+		User:     &UserStore{db},
+		Document: &DocumentStore{db},
+		Member:   &MemberStore{db},
+		Revision: &RevisionStore{db},
+		Session:  &SessionStore{db: db},
+	}
+}
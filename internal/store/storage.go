@@ -12,28 +12,72 @@ var (
 	QueryTimeoutDuration = time.Second * 5
 )
 
+// UserRepository stores user accounts.
+type UserRepository interface {
+	Create(context.Context, *User) error
+	GetById(context.Context, int64) (*User, error)
+	GetAll(context.Context) ([]*User, error)
+	GetByEmail(context.Context, string) (*User, error)
+	Delete(context.Context, int64) error
+}
+
+// DocumentRepository stores documents, recording a revision for every
+// version of their content.
+type DocumentRepository interface {
+	GetDocumentByDocID(context.Context, string) (*Document, error)
+	CreateDocument(context.Context, *Document, int64) error
+	UpdateDocument(context.Context, string, string, int64) (int64, error)
+	UpdateDocumentWithState(context.Context, string, string, []byte, int64) (int64, error)
+	ListDocumentsForUser(context.Context, int64, int, int) ([]*Document, error)
+	DeleteDocument(context.Context, string) error
+}
+
+// MemberRepository stores who may access which document, and how.
+type MemberRepository interface {
+	Set(context.Context, *Member) error
+	GetRole(context.Context, string, int64) (Role, error)
+	List(context.Context, string) ([]*Member, error)
+	ListForUser(context.Context, int64) ([]*Member, error)
+	Remove(context.Context, string, int64) error
+}
+
+// RevisionRepository reads the revisions DocumentRepository records.
+type RevisionRepository interface {
+	List(context.Context, string, int, int) ([]*Revision, error)
+	Get(context.Context, string, int64) (*Revision, error)
+}
+
+// SessionRepository stores refresh token sessions.
+type SessionRepository interface {
+	Create(context.Context, *Session) error
+	Rotate(context.Context, []byte, *Session, func(*Session) error) error
+	Revoke(context.Context, []byte) error
+	IsRevoked(context.Context, string) (bool, error)
+}
+
+// Storage is every repository the application uses. NewStorage backs them
+// with Postgres, NewSQLiteStorage with SQLite and NewMemoryStorage with
+// memory, for tests.
 type Storage struct {
-	User interface {
-		Create(context.Context, *User) error
-		GetById(context.Context, int64) (*User, error)
-		GetAll(context.Context) ([]*User, error)
-		GetByEmail(context.Context, string) (*User, error)
-		Delete(context.Context, int64) error
-	}
-	Document interface {
-		GetDocumentByDocID(context.Context, string) (*Document, error)
-		CreateDocument(context.Context, string, string) error
-		UpdateDocument(context.Context, string, string) error
-	}
+	User     UserRepository
+	Document DocumentRepository
+	Member   MemberRepository
+	Revision RevisionRepository
+	Session  SessionRepository
 }
 
 func NewStorage(db *sql.DB) Storage {
 	return Storage{
 		User:     &UserStore{db},
 		Document: &DocumentStore{db},
+		Member:   &MemberStore{db},
+		Revision: &RevisionStore{db},
+		Session:  &SessionStore{db: db, lock: "FOR UPDATE"},
 	}
 }
 
+// withTx runs fn in a transaction, committing it unless fn fails.
+// Constraint violations are returned as *ConstraintError.
 func withTx(db *sql.DB, ctx context.Context, fn func(*sql.Tx) error) error {
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
@@ -41,8 +85,8 @@ func withTx(db *sql.DB, ctx context.Context, fn func(*sql.Tx) error) error {
 	}
 	if err := fn(tx); err != nil {
 		tx.Rollback()
-		return err
+		return constraintError(err)
 	}
 
-	return tx.Commit()
+	return constraintError(tx.Commit())
 }
@@ -8,9 +8,11 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Errors matching a user's unique constraints, with errors.Is, whichever
+// database reported them.
 var (
-	ErrDuplicateEmail    = errors.New("a user with that email already exists")
-	ErrDuplicateUsername = errors.New("a user with that username already exists")
+	ErrDuplicateEmail    = &ConstraintError{Kind: ErrUniqueViolation, Table: "users", Field: "email"}
+	ErrDuplicateUsername = &ConstraintError{Kind: ErrUniqueViolation, Table: "users", Field: "username"}
 )
 
 type User struct {
@@ -54,7 +56,7 @@ func (s *UserStore) Create(ctx context.Context, user *User) error {
 		`
 		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 		defer cancel()
-		err := tx.QueryRowContext(
+		return tx.QueryRowContext(
 			ctx,
 			query,
 			user.Email,
@@ -64,17 +66,6 @@ func (s *UserStore) Create(ctx context.Context, user *User) error {
 			&user.ID,
 			&user.CreatedAt,
 		)
-		if err != nil {
-			switch {
-			case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-				return ErrDuplicateEmail
-			case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-				return ErrDuplicateUsername
-			default:
-				return err
-			}
-		}
-		return nil
 	})
 }
 
@@ -110,8 +101,12 @@ func (s *UserStore) GetById(ctx context.Context, id int64) (*User, error) {
 
 func (s *UserStore) GetAll(ctx context.Context) ([]*User, error) {
 	query := `
-		SELECT id, email, username, password, created_at FROM users
+		SELECT id, email, username, password, created_at, updated_at
+		FROM users
+		ORDER BY id
 	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
 	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
@@ -121,7 +116,7 @@ func (s *UserStore) GetAll(ctx context.Context) ([]*User, error) {
 	users := []*User{}
 	for rows.Next() {
 		user := &User{}
-		if err := rows.Scan(&user.ID, &user.Email, &user.Username, &user.Password, &user.CreatedAt); err != nil {
+		if err := rows.Scan(&user.ID, &user.Email, &user.Username, &user.Password.hash, &user.CreatedAt, &user.UpdatedAt); err != nil {
 			return nil, err
 		}
 		users = append(users, user)
@@ -133,8 +128,14 @@ func (s *UserStore) GetAll(ctx context.Context) ([]*User, error) {
 	return users, nil
 }
 
+// Delete removes the user with their memberships and sessions, and the
+// documents they own, which no one else could manage. Revisions they made
+// of other documents stay, without an author.
 func (s *UserStore) Delete(ctx context.Context, userId int64) error {
 	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		if err := s.deleteOwnedDocuments(ctx, tx, userId); err != nil {
+			return err
+		}
 		if err := s.deleteUser(ctx, tx, userId); err != nil {
 			return err
 		}
@@ -167,15 +168,36 @@ func (s *UserStore) GetByEmail(ctx context.Context, email string) (*User, error)
 	return user, nil
 }
 
+func (s *UserStore) deleteOwnedDocuments(ctx context.Context, tx *sql.Tx, userId int64) error {
+	query := `
+		DELETE FROM documents
+		WHERE doc_id IN (
+			SELECT doc_id FROM document_members WHERE user_id = $1 AND role = 'owner'
+		)
+	`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, query, userId)
+	return err
+}
+
 func (s *UserStore) deleteUser(ctx context.Context, tx *sql.Tx, userId int64) error {
 	query := `DELETE FROM users WHERE id=$1`
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
-	_, err := tx.ExecContext(ctx, query, userId)
+	res, err := tx.ExecContext(ctx, query, userId)
 	if err != nil {
 		return err
 	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
@@ -0,0 +1,136 @@
+// internal/websocket/broker.go
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// Broker connects the API instances serving the same documents. It carries
+// messages between them and decides which instance owns each document's
+// room: only the owner merges edits, and the rooms other instances open for
+// the same document forward their clients to it.
+type Broker interface {
+	// Publish delivers payload to every current subscriber of topic, on any
+	// instance. Delivery is best effort; a subscriber that falls behind or
+	// loses its connection may miss messages.
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Subscribe starts delivering messages published to topic.
+	Subscribe(ctx context.Context, topic string) (Subscription, error)
+	// Acquire makes instance the owner of key unless another instance
+	// already is, in which case it returns a nil Lease and no error.
+	Acquire(ctx context.Context, key, instance string) (Lease, error)
+	// Owner returns the instance that owns key, or "" if none does.
+	Owner(ctx context.Context, key string) (string, error)
+}
+
+// Subscription receives the messages published to a topic.
+type Subscription interface {
+	// C delivers the messages in the order they were published. It is
+	// closed by Close.
+	C() <-chan []byte
+	Close() error
+}
+
+// Lease is ownership of a key, held until it is released or lost.
+type Lease interface {
+	// Lost is closed if the lease ends other than through Release, for
+	// example because it could not be renewed in time.
+	Lost() <-chan struct{}
+	Release(ctx context.Context) error
+}
+
+// ErrNoRoom is returned by the hub's document operations when no instance
+// has a room open for the document, so the caller should use the store.
+var ErrNoRoom = errors.New("document has no live room")
+
+// Envelope kinds exchanged between rooms on different instances.
+const (
+	// Sent to the owner's document topic by other instances.
+	envJoin    = "join"
+	envLeave   = "leave"
+	envMessage = "message"
+	envRequest = "request"
+	// envResync asks the owner for a fresh sync of a connection whose
+	// deliveries the follower has had to drop.
+	envResync = "resync"
+
+	// Sent by the owner to the instance topic of each follower.
+	envDeliver   = "deliver"
+	envKick      = "kick"
+	envClosed    = "closed"
+	envHeartbeat = "heartbeat"
+
+	// Sent to the instance topic of whoever made a request.
+	envResponse = "response"
+)
+
+// Requests another instance can make of a document's owner.
+const (
+	requestReplace  = "replace"
+	requestRestore  = "restore"
+	requestRole     = "role"
+	requestPresence = "presence"
+	requestContent  = "content"
+	requestClose    = "close"
+)
+
+// envelope is what rooms on different instances exchange over the broker.
+// Which fields are set depends on Kind.
+type envelope struct {
+	Kind     string `json:"kind"`
+	DocID    string `json:"doc_id"`
+	Instance string `json:"instance,omitempty"`
+	Conn     string `json:"conn,omitempty"`
+
+	// The user behind a joining connection, or whose role a request
+	// changes.
+	UserID   int64      `json:"user_id,omitempty"`
+	Username string     `json:"username,omitempty"`
+	Role     store.Role `json:"role,omitempty"`
+
+	// A client message for the owner, or the error decoding it.
+	Msg       *Message `json:"msg,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	ErrorCode string   `json:"error_code,omitempty"`
+
+	// A message for a follower's client, already encoded.
+	MsgType string          `json:"msg_type,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+
+	// Why a connection or the whole room was closed, and whether a room
+	// asked to close saves its content first.
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Save   bool   `json:"save,omitempty"`
+
+	// Requests and their responses.
+	Request string     `json:"request,omitempty"`
+	ID      string     `json:"id,omitempty"`
+	Content string     `json:"content,omitempty"`
+	Users   []Presence `json:"users,omitempty"`
+}
+
+func docTopic(docID string) string { return "doc:" + docID }
+
+func instanceTopic(instance string) string { return "instance:" + instance }
+
+// remoteErrors are the errors a response can carry and still be matched
+// with errors.Is by the instance that made the request.
+var remoteErrors = []error{ErrRoomClosed, ErrShuttingDown, ErrNoRoom, store.ErrNotFound}
+
+// remoteError recreates an error sent in a response.
+func remoteError(text string) error {
+	if text == "" {
+		return nil
+	}
+	for _, err := range remoteErrors {
+		if err.Error() == text {
+			return err
+		}
+	}
+	return errors.New(text)
+}
@@ -0,0 +1,107 @@
+// internal/websocket/broker_memory.go
+package websocket
+
+import (
+	"context"
+	"sync"
+)
+
+// subscriptionBuffer is how many messages a subscription holds for a slow
+// reader before it starts dropping them.
+const subscriptionBuffer = 1024
+
+// MemoryBroker is a Broker for a single instance, or several hubs in one
+// process.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	subs   map[string]map[*memorySubscription]struct{}
+	owners map[string]string
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subs:   make(map[string]map[*memorySubscription]struct{}),
+		owners: make(map[string]string),
+	}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[topic] {
+		select {
+		case sub.c <- payload:
+		default:
+			brokerDropped.Add(1)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, topic string) (Subscription, error) {
+	sub := &memorySubscription{broker: b, topic: topic, c: make(chan []byte, subscriptionBuffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[*memorySubscription]struct{})
+	}
+	b.subs[topic][sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *MemoryBroker) Acquire(ctx context.Context, key, instance string) (Lease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, taken := b.owners[key]; taken {
+		return nil, nil
+	}
+	b.owners[key] = instance
+	return &memoryLease{broker: b, key: key, lost: make(chan struct{})}, nil
+}
+
+func (b *MemoryBroker) Owner(ctx context.Context, key string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.owners[key], nil
+}
+
+type memorySubscription struct {
+	broker *MemoryBroker
+	topic  string
+	c      chan []byte
+	once   sync.Once
+}
+
+func (s *memorySubscription) C() <-chan []byte { return s.c }
+
+func (s *memorySubscription) Close() error {
+	s.once.Do(func() {
+		s.broker.mu.Lock()
+		defer s.broker.mu.Unlock()
+		delete(s.broker.subs[s.topic], s)
+		if len(s.broker.subs[s.topic]) == 0 {
+			delete(s.broker.subs, s.topic)
+		}
+		close(s.c)
+	})
+	return nil
+}
+
+// memoryLease cannot be lost; it lasts until released.
+type memoryLease struct {
+	broker *MemoryBroker
+	key    string
+	lost   chan struct{}
+	once   sync.Once
+}
+
+func (l *memoryLease) Lost() <-chan struct{} { return l.lost }
+
+func (l *memoryLease) Release(ctx context.Context) error {
+	l.once.Do(func() {
+		l.broker.mu.Lock()
+		defer l.broker.mu.Unlock()
+		delete(l.broker.owners, l.key)
+	})
+	return nil
+}
@@ -0,0 +1,323 @@
+// internal/websocket/broker_postgres.go
+package websocket
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+const (
+	// maxNotifyPayload keeps payloads below Postgres' 8000 byte NOTIFY
+	// limit. Larger ones are stored in broker_payloads and the notification
+	// carries their ID instead.
+	maxNotifyPayload = 7800
+	// payloadRetention is how long stored payloads are kept for listeners
+	// to fetch.
+	payloadRetention = 5 * time.Minute
+)
+
+// PostgresBroker is a Broker backed by Postgres: messages travel as
+// LISTEN/NOTIFY notifications and ownership is a lease row in room_owners
+// that the owner keeps renewing.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	leaseTTL time.Duration
+
+	mu   sync.Mutex
+	subs map[string]map[*postgresSubscription]struct{}
+
+	done chan struct{}
+}
+
+// NewPostgresBroker listens for notifications on a connection of its own
+// to dsn and uses db for everything else. Leases expire leaseTTL after
+// their last renewal.
+func NewPostgresBroker(db *sql.DB, dsn string, leaseTTL time.Duration) *PostgresBroker {
+	b := &PostgresBroker{
+		db:       db,
+		leaseTTL: leaseTTL,
+		subs:     make(map[string]map[*postgresSubscription]struct{}),
+		done:     make(chan struct{}),
+	}
+	b.listener = pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Broker listener disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Printf("Broker listener reconnected; notifications sent meanwhile are lost")
+		}
+	})
+	go b.dispatch()
+	go b.cleanup()
+	return b
+}
+
+// Close stops listening. Subscriptions stop receiving messages.
+func (b *PostgresBroker) Close() error {
+	close(b.done)
+	return b.listener.Close()
+}
+
+// channelName maps a topic to a Postgres channel. Topics contain document
+// IDs, which may be longer than an identifier can be, so they are hashed.
+func channelName(topic string) string {
+	sum := sha256.Sum256([]byte(topic))
+	return "doccollab_" + hex.EncodeToString(sum[:16])
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, store.QueryTimeoutDuration)
+	defer cancel()
+
+	message := string(payload)
+	if len(payload) > maxNotifyPayload {
+		var id int64
+		err := b.db.QueryRowContext(ctx, `INSERT INTO broker_payloads (payload) VALUES ($1) RETURNING id`, payload).Scan(&id)
+		if err != nil {
+			brokerPublishFailures.Add(1)
+			return err
+		}
+		message = "@" + strconv.FormatInt(id, 10)
+	}
+	if _, err := b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channelName(topic), message); err != nil {
+		brokerPublishFailures.Add(1)
+		return err
+	}
+	return nil
+}
+
+func (b *PostgresBroker) Subscribe(ctx context.Context, topic string) (Subscription, error) {
+	channel := channelName(topic)
+	sub := &postgresSubscription{broker: b, channel: channel, c: make(chan []byte, subscriptionBuffer)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[channel] == nil {
+		if err := b.listener.Listen(channel); err != nil && !errors.Is(err, pq.ErrChannelAlreadyOpen) {
+			return nil, err
+		}
+		b.subs[channel] = make(map[*postgresSubscription]struct{})
+	}
+	b.subs[channel][sub] = struct{}{}
+	return sub, nil
+}
+
+// dispatch hands every notification to the subscriptions of its channel,
+// fetching payloads that were too large to send inline.
+func (b *PostgresBroker) dispatch() {
+	for {
+		var n *pq.Notification
+		select {
+		case n = <-b.listener.Notify:
+		case <-b.done:
+			return
+		}
+		if n == nil {
+			// The connection was re-established.
+			continue
+		}
+
+		payload := []byte(n.Extra)
+		if id, ok := strings.CutPrefix(n.Extra, "@"); ok {
+			var err error
+			if payload, err = b.fetch(id); err != nil {
+				log.Printf("Failed to fetch broker payload %s: %v", id, err)
+				brokerDropped.Add(1)
+				continue
+			}
+		}
+
+		b.mu.Lock()
+		for sub := range b.subs[n.Channel] {
+			select {
+			case sub.c <- payload:
+			default:
+				brokerDropped.Add(1)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *PostgresBroker) fetch(id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), store.QueryTimeoutDuration)
+	defer cancel()
+	var payload []byte
+	err := b.db.QueryRowContext(ctx, `SELECT payload FROM broker_payloads WHERE id = $1`, id).Scan(&payload)
+	return payload, err
+}
+
+// cleanup deletes stored payloads every listener has had time to fetch.
+func (b *PostgresBroker) cleanup() {
+	ticker := time.NewTicker(payloadRetention)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), store.QueryTimeoutDuration)
+		_, err := b.db.ExecContext(ctx, `DELETE FROM broker_payloads WHERE created_at < NOW() - $1 * INTERVAL '1 second'`, payloadRetention.Seconds())
+		cancel()
+		if err != nil {
+			log.Printf("Failed to clean up broker payloads: %v", err)
+		}
+	}
+}
+
+func (b *PostgresBroker) Acquire(ctx context.Context, key, instance string) (Lease, error) {
+	query := `
+		INSERT INTO room_owners (doc_id, instance, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (doc_id) DO UPDATE
+		SET instance = EXCLUDED.instance, expires_at = EXCLUDED.expires_at
+		WHERE room_owners.expires_at < NOW() OR room_owners.instance = EXCLUDED.instance
+		RETURNING instance
+	`
+	ctx, cancel := context.WithTimeout(ctx, store.QueryTimeoutDuration)
+	defer cancel()
+	var owner string
+	err := b.db.QueryRowContext(ctx, query, key, instance, b.leaseTTL.Milliseconds()).Scan(&owner)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	l := &postgresLease{
+		broker:   b,
+		key:      key,
+		instance: instance,
+		lost:     make(chan struct{}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go l.renew()
+	return l, nil
+}
+
+func (b *PostgresBroker) Owner(ctx context.Context, key string) (string, error) {
+	query := `SELECT instance FROM room_owners WHERE doc_id = $1 AND expires_at > NOW()`
+	ctx, cancel := context.WithTimeout(ctx, store.QueryTimeoutDuration)
+	defer cancel()
+	var owner string
+	err := b.db.QueryRowContext(ctx, query, key).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return owner, err
+}
+
+type postgresSubscription struct {
+	broker  *PostgresBroker
+	channel string
+	c       chan []byte
+	once    sync.Once
+}
+
+func (s *postgresSubscription) C() <-chan []byte { return s.c }
+
+func (s *postgresSubscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		b := s.broker
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[s.channel], s)
+		if len(b.subs[s.channel]) == 0 {
+			delete(b.subs, s.channel)
+			if err = b.listener.Unlisten(s.channel); errors.Is(err, pq.ErrChannelNotOpen) {
+				err = nil
+			}
+		}
+		close(s.c)
+	})
+	return err
+}
+
+// postgresLease renews its row every third of the lease TTL. It is lost
+// when another instance has taken the row over or when it could not be
+// renewed before expiring.
+type postgresLease struct {
+	broker   *PostgresBroker
+	key      string
+	instance string
+
+	lost    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (l *postgresLease) Lost() <-chan struct{} { return l.lost }
+
+func (l *postgresLease) renew() {
+	defer close(l.stopped)
+	ttl := l.broker.leaseTTL
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+		ok, err := l.extend()
+		switch {
+		case err == nil && ok:
+			renewed = time.Now()
+		case err == nil:
+			log.Printf("Lost ownership of document %s to another instance", l.key)
+			close(l.lost)
+			return
+		case time.Since(renewed) >= ttl:
+			log.Printf("Lost ownership of document %s, could not renew: %v", l.key, err)
+			close(l.lost)
+			return
+		default:
+			log.Printf("Failed to renew ownership of document %s: %v", l.key, err)
+		}
+	}
+}
+
+func (l *postgresLease) extend() (bool, error) {
+	query := `
+		UPDATE room_owners SET expires_at = NOW() + $3 * INTERVAL '1 millisecond'
+		WHERE doc_id = $1 AND instance = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), store.QueryTimeoutDuration)
+	defer cancel()
+	res, err := l.broker.db.ExecContext(ctx, query, l.key, l.instance, l.broker.leaseTTL.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+func (l *postgresLease) Release(ctx context.Context) error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.stopped
+		ctx, cancel := context.WithTimeout(ctx, store.QueryTimeoutDuration)
+		defer cancel()
+		_, err = l.broker.db.ExecContext(ctx, `DELETE FROM room_owners WHERE doc_id = $1 AND instance = $2`, l.key, l.instance)
+	})
+	return err
+}
@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/cmd/migrate/migrations"
+	"github.com/vlkhvnn/DocCollab/internal/db"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// receive waits for the next message on sub.
+func receive(t *testing.T, sub Subscription) string {
+	t.Helper()
+	select {
+	case payload, ok := <-sub.C():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return string(payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return ""
+	}
+}
+
+// testBroker checks the behaviour every Broker must have.
+func testBroker(t *testing.T, broker Broker) {
+	ctx := context.Background()
+
+	t.Run("publish", func(t *testing.T) {
+		a, err := broker.Subscribe(ctx, "topic-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		b, err := broker.Subscribe(ctx, "topic-b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		for _, payload := range []string{"one", "two", "three"} {
+			if err := broker.Publish(ctx, "topic-a", []byte(payload)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := broker.Publish(ctx, "topic-b", []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"one", "two", "three"} {
+			if got := receive(t, a); got != want {
+				t.Fatalf("received %q, want %q", got, want)
+			}
+		}
+		if got := receive(t, b); got != "other" {
+			t.Fatalf("received %q on the other topic, want %q", got, "other")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		sub, err := broker.Subscribe(ctx, "topic-c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-sub.C(); ok {
+			t.Fatal("closed subscription delivered a message")
+		}
+	})
+
+	t.Run("lease", func(t *testing.T) {
+		lease, err := broker.Acquire(ctx, "doc-a", "one")
+		if err != nil || lease == nil {
+			t.Fatalf("first Acquire gave %v, %v, want a lease", lease, err)
+		}
+		if other, err := broker.Acquire(ctx, "doc-a", "two"); err != nil || other != nil {
+			t.Fatalf("second Acquire gave %v, %v, want no lease", other, err)
+		}
+		if owner, err := broker.Owner(ctx, "doc-a"); err != nil || owner != "one" {
+			t.Fatalf("Owner gave %q, %v, want %q", owner, err, "one")
+		}
+		if owner, err := broker.Owner(ctx, "doc-b"); err != nil || owner != "" {
+			t.Fatalf("Owner of an unowned key gave %q, %v", owner, err)
+		}
+
+		if err := lease.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if owner, err := broker.Owner(ctx, "doc-a"); err != nil || owner != "" {
+			t.Fatalf("Owner after Release gave %q, %v, want nobody", owner, err)
+		}
+		next, err := broker.Acquire(ctx, "doc-a", "two")
+		if err != nil || next == nil {
+			t.Fatalf("Acquire after Release gave %v, %v, want a lease", next, err)
+		}
+		defer next.Release(ctx)
+		select {
+		case <-lease.Lost():
+			t.Fatal("a released lease was lost")
+		case <-next.Lost():
+			t.Fatal("a held lease was lost")
+		default:
+		}
+	})
+}
+
+func TestMemoryBroker(t *testing.T) {
+	testBroker(t, NewMemoryBroker())
+}
+
+// TestPostgresBroker runs against the database at TEST_DB_ADDR, which it
+// migrates, and is skipped without one.
+func TestPostgresBroker(t *testing.T) {
+	addr := os.Getenv("TEST_DB_ADDR")
+	if addr == "" {
+		t.Skip("TEST_DB_ADDR is not set")
+	}
+	dialect, err := db.DialectOf(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialect != db.Postgres {
+		t.Skip("TEST_DB_ADDR is not a Postgres database")
+	}
+	conn, err := db.New(addr, 5, 5, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx, conn, dialect, migrations.FS); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, `DELETE FROM room_owners`); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := NewPostgresBroker(conn, addr, 300*time.Millisecond)
+	defer broker.Close()
+	testBroker(t, broker)
+
+	t.Run("large payload", func(t *testing.T) {
+		sub, err := broker.Subscribe(ctx, "topic-large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		payload := make([]byte, 2*maxNotifyPayload)
+		for i := range payload {
+			payload[i] = 'a' + byte(i%26)
+		}
+		if err := broker.Publish(ctx, "topic-large", payload); err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(t, sub); got != string(payload) {
+			t.Fatalf("received %d bytes, want the %d published", len(got), len(payload))
+		}
+	})
+
+	t.Run("expired lease", func(t *testing.T) {
+		lease, err := broker.Acquire(ctx, "doc-expired", "one")
+		if err != nil || lease == nil {
+			t.Fatalf("Acquire gave %v, %v, want a lease", lease, err)
+		}
+		defer lease.Release(ctx)
+		// The lease outlives its TTL while it is renewed.
+		time.Sleep(time.Second)
+		if owner, err := broker.Owner(ctx, "doc-expired"); err != nil || owner != "one" {
+			t.Fatalf("Owner of a renewed lease gave %q, %v, want %q", owner, err, "one")
+		}
+
+		// Another instance may take it over once it has expired; the
+		// first finds out when it next renews.
+		if _, err := conn.ExecContext(ctx, `UPDATE room_owners SET instance = 'two' WHERE doc_id = 'doc-expired'`); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-lease.Lost():
+		case <-time.After(5 * time.Second):
+			t.Fatal("the lease was not lost")
+		}
+	})
+}
+
+func TestFollowerRoomsForwardToTheOwner(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice", "bob")
+	if err := storage.Member.Set(context.Background(), &store.Member{DocID: doc.DocID, UserID: users[1].ID, Role: store.RoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+	broker := NewMemoryBroker()
+	owner, ownerSrv := newTestHub(t, storage, broker)
+	follower, followerSrv := newTestHub(t, storage, broker)
+
+	alice, _ := dial(t, ownerSrv, doc.DocID, users[0].ID, store.RoleOwner)
+	bob, sync := dial(t, followerSrv, doc.DocID, users[1].ID, store.RoleEditor)
+	if sync.Text != "abc" {
+		t.Fatalf("bob synced %q through the follower, want %q", sync.Text, "abc")
+	}
+	if room, ok := follower.Lookup(doc.DocID); !ok || room.follower == nil {
+		t.Fatal("the second hub did not open a follower room")
+	}
+
+	bob.splice(0, 3, 0, "d")
+	bob.expect(TypeAck)
+	alice.expect(TypeOp)
+	alice.splice(1, 0, 0, "X")
+	alice.expect(TypeAck)
+	bob.expect(TypeOp)
+
+	ctx := context.Background()
+	for _, hub := range []*Hub{owner, follower} {
+		content, err := hub.Content(ctx, doc.DocID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != "Xabcd" {
+			t.Fatalf("hub has %q, want %q", content, "Xabcd")
+		}
+	}
+	present, err := follower.Presence(ctx, doc.DocID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(present) != 2 {
+		t.Fatalf("presence through the follower is %+v, want alice and bob", present)
+	}
+}
+
+func TestFollowerGivesUpOnASilentOwner(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice")
+	broker := NewMemoryBroker()
+	// An instance took the document and crashed without releasing it.
+	if _, err := broker.Acquire(context.Background(), doc.DocID, "crashed"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig
+	cfg.OwnerHeartbeat = 20 * time.Millisecond
+	hub, srv := newTestHubWithConfig(t, storage, broker, cfg)
+
+	alice := dialRaw(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	alice.send(&Message{Type: TypeHello, Versions: []int{ProtocolVersion}})
+	alice.expect(TypeHello)
+	alice.expectClose(CloseGoingAway)
+	if _, ok := hub.Lookup(doc.DocID); ok {
+		t.Fatal("the follower room was kept")
+	}
+}
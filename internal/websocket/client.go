@@ -1,43 +1,225 @@
 package websocket
 
 import (
+	"errors"
 	"log"
+	"net"
+	"strconv"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/store"
 )
 
 // Client represents a single WebSocket connection.
 type Client struct {
 	Conn *websocket.Conn
-	Send chan []byte
+	// UserID and Username identify the authenticated user behind the
+	// connection.
+	UserID   int64
+	Username string
+	// Role is the user's access to the room's document.
+	Role store.Role
+
+	config Config
+	queue  *sendQueue
+	// id identifies the connection across instances. instance is set on
+	// the stand-ins an owner room keeps for clients of other instances.
+	id       string
+	instance string
+	// version is the protocol version agreed in the handshake.
+	version int
+	// idle is whether the client last said its user was idle. It is only
+	// changed from the room's Run, under the room's Mu.
+	idle bool
+	// lastCursor is when the client's cursor was last relayed and
+	// pendingCursor the one held back since. Both belong to the room's Run.
+	lastCursor    time.Time
+	pendingCursor *Message
+}
+
+// NewClient wraps an upgraded connection for user, who holds role on the
+// document being joined.
+func NewClient(conn *websocket.Conn, user *store.User, role store.Role, config Config) *Client {
+	conn.SetReadLimit(config.MaxMessageSize)
+	return &Client{
+		Conn:     conn,
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     role,
+		config:   config,
+		queue:    newSendQueue(config.SendQueueSize),
+		id:       uuid.NewString(),
+	}
+}
+
+// isProxy reports whether the client stands in for a connection to
+// another instance.
+func (c *Client) isProxy() bool {
+	return c.instance != ""
+}
+
+// userTag is the user ID as stamped on outgoing messages.
+func (c *Client) userTag() string {
+	return strconv.FormatInt(c.UserID, 10)
+}
+
+// closeWith sends a close frame with code and reason. It is safe to call
+// concurrently with WritePump.
+func (c *Client) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		log.Printf("Close error: %v", err)
+	}
+}
+
+// Reject tells a freshly upgraded connection that the room for docID could
+// not be opened and closes it. The cause is only logged.
+func Reject(conn *websocket.Conn, docID string, cause error) {
+	log.Printf("Could not open room %s: %v", docID, cause)
+	msg := &Message{
+		Type:      TypeError,
+		DocID:     docID,
+		Text:      "failed to load document",
+		Code:      errorCode(cause),
+		UserID:    "server",
+		Timestamp: time.Now(),
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := conn.WriteJSON(msg); err == nil {
+		closeMsg := websocket.FormatCloseMessage(closeCodeFor(cause), msg.Text)
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	}
+	conn.Close()
+}
+
+// Handshake waits for the client's hello and answers with the protocol
+// version both sides will speak. It must run before the client joins a
+// room. On failure the client is told why and the connection is closed.
+func (c *Client) Handshake(docID string) error {
+	c.Conn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout))
+	messageType, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		c.Conn.Close()
+		return err
+	}
+	if messageType != websocket.TextMessage {
+		c.closeWith(CloseUnsupportedData, "only text messages are supported")
+		c.Conn.Close()
+		return errors.New("binary message during handshake")
+	}
+
+	msg, err := DecodeMessage(data, docID)
+	if err == nil && msg.Type != TypeHello {
+		err = badMessage("expected hello, got %q", msg.Type)
+	}
+	if err == nil {
+		c.version, err = negotiateVersion(msg.Versions)
+	}
+	reply := &Message{DocID: docID, UserID: "server", Timestamp: time.Now()}
+	if err != nil {
+		reply.Type, reply.Text, reply.Code = TypeError, err.Error(), errorCode(err)
+	} else {
+		reply.Type, reply.Version = TypeHello, c.version
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+	if writeErr := c.Conn.WriteJSON(reply); writeErr != nil && err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		code := ClosePolicyViolation
+		if errors.Is(err, ErrUnsupportedVersion) {
+			code = CloseUnsupportedVersion
+		}
+		c.closeWith(code, reply.Code)
+		c.Conn.Close()
+	}
+	return err
 }
 
+// ReadPump decodes the client's messages and forwards them to room until
+// the connection fails. Messages that cannot be decoded are forwarded as
+// errors so the room can tell the client. Every pong extends the read
+// deadline, so a peer that stops answering pings is dropped after PongWait.
 func (c *Client) ReadPump(room *Room) {
 	defer func() {
-		room.Unregister <- c
+		room.leave(c)
 		c.Conn.Close()
 	}()
+	c.Conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+	})
 	for {
-		_, messageBytes, err := c.Conn.ReadMessage()
+		messageType, messageBytes, err := c.Conn.ReadMessage()
 		if err != nil {
-			log.Printf("Read error: %v", err)
+			c.handleReadError(err)
+			break
+		}
+		if messageType != websocket.TextMessage {
+			c.closeWith(CloseUnsupportedData, "only text messages are supported")
 			break
 		}
 
-		// Here we assume that clients send "update" messages with the full text.
-		room.Broadcast <- BroadcastMessage{
-			Sender: c,
-			Data:   messageBytes,
+		msg, err := DecodeMessage(messageBytes, room.ID)
+		if err == nil && msg.Type == TypeHello {
+			err = badMessage("hello may only be sent once")
 		}
+		if !room.submit(BroadcastMessage{Sender: c, Msg: msg, Err: err}) {
+			break
+		}
+	}
+}
+
+// handleReadError tells the peer why its connection is being dropped, when
+// it is still there to hear it.
+func (c *Client) handleReadError(err error) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.closeWith(CloseIdleTimeout, "heartbeat timeout")
+	case errors.Is(err, websocket.ErrReadLimit):
+		// The connection has already sent CloseMessageTooBig.
+	case websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		log.Printf("Read error: %v", err)
 	}
 }
 
+// WritePump writes queued messages to the connection and pings the peer
+// every PingPeriod. It stops when the queue is closed or a write fails.
 func (c *Client) WritePump() {
-	defer c.Conn.Close()
-	for message := range c.Send {
-		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("Write error: %v", err)
-			break
+	ticker := time.NewTicker(c.config.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+	for {
+		select {
+		case <-c.queue.ready:
+			for {
+				message, ok := c.queue.pop()
+				if !ok {
+					break
+				}
+				c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+				if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+					log.Printf("Write error: %v", err)
+					return
+				}
+			}
+			if closed, code, reason := c.queue.closing(); closed {
+				if code != 0 {
+					c.closeWith(code, reason)
+				}
+				return
+			}
+		case <-ticker.C:
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.config.WriteWait)); err != nil {
+				log.Printf("Ping error: %v", err)
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+func TestMessageTooBigClosesTheConnection(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "", "alice")
+	cfg := testConfig
+	cfg.MaxMessageSize = 256
+	_, srv := newTestHubWithConfig(t, storage, NewMemoryBroker(), cfg)
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	alice.splice(0, 0, 0, strings.Repeat("x", 300))
+	alice.expectClose(CloseMessageTooBig)
+}
+
+func TestBinaryMessagesCloseTheConnection(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "", "alice")
+	_, srv := newTestHub(t, storage, NewMemoryBroker())
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	if err := alice.conn.WriteMessage(websocket.BinaryMessage, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	alice.expectClose(CloseUnsupportedData)
+}
+
+func TestPongsKeepTheConnectionAlive(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "", "alice")
+	cfg := testConfig
+	cfg.PingPeriod, cfg.PongWait = 20*time.Millisecond, 60*time.Millisecond
+	_, srv := newTestHubWithConfig(t, storage, NewMemoryBroker(), cfg)
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	var pings atomic.Int32
+	alice.conn.SetPingHandler(func(data string) error {
+		pings.Add(1)
+		return alice.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	// Reading the acks answers the pings that arrived in between.
+	for i := range 10 {
+		time.Sleep(cfg.PingPeriod)
+		alice.splice(i, i, 0, "x")
+		alice.expect(TypeAck)
+	}
+	if pings.Load() == 0 {
+		t.Fatal("the server never pinged")
+	}
+}
+
+func TestMissingPongsTimeOut(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "", "alice")
+	cfg := testConfig
+	cfg.PingPeriod, cfg.PongWait = 20*time.Millisecond, 60*time.Millisecond
+	_, srv := newTestHubWithConfig(t, storage, NewMemoryBroker(), cfg)
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	alice.conn.SetPingHandler(func(string) error { return nil })
+	alice.expectClose(CloseIdleTimeout)
+}
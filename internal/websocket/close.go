@@ -0,0 +1,59 @@
+// internal/websocket/close.go
+package websocket
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// Close codes the server ends connections with, so the frontend can tell
+// why it was disconnected and whether reconnecting makes sense. Standard
+// codes are used where one fits; the 4000 range is specific to DocCollab.
+const (
+	// CloseGoingAway: the server is shutting down. Reconnect with backoff.
+	CloseGoingAway = websocket.CloseGoingAway
+	// CloseUnsupportedData: the client sent a binary frame.
+	CloseUnsupportedData = websocket.CloseUnsupportedData
+	// ClosePolicyViolation: the client broke the protocol, for example by
+	// not opening with a hello.
+	ClosePolicyViolation = websocket.ClosePolicyViolation
+	// CloseMessageTooBig: a message exceeded Config.MaxMessageSize.
+	CloseMessageTooBig = websocket.CloseMessageTooBig
+	// CloseInternalError: the server failed, for example loading the
+	// document. Reconnect with backoff.
+	CloseInternalError = websocket.CloseInternalServerErr
+
+	// CloseIdleTimeout: no pong arrived within Config.PongWait, so the
+	// connection is presumed dead. Reconnect straight away.
+	CloseIdleTimeout = 4000
+	// CloseSlowConsumer: the client could not keep up with the room and
+	// the hub is configured to disconnect slow clients. Reconnect, which
+	// starts again from a fresh sync.
+	CloseSlowConsumer = 4001
+	// CloseUnsupportedVersion: the client's hello offered no protocol
+	// version the server speaks. Do not reconnect without upgrading.
+	CloseUnsupportedVersion = 4002
+	// CloseRoomClosed: an administrator closed the room. Its content was
+	// saved, so reconnecting starts a fresh room from it.
+	CloseRoomClosed = 4003
+	// CloseDocumentDeleted: the document no longer exists. Do not reconnect.
+	CloseDocumentDeleted = 4004
+	// CloseAccessRevoked: the user was removed from the document or
+	// deleted. Do not reconnect.
+	CloseAccessRevoked = 4005
+)
+
+// closeCodeFor picks the close code for a connection that cannot join a
+// room because of err.
+func closeCodeFor(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return CloseDocumentDeleted
+	case errors.Is(err, ErrShuttingDown):
+		return CloseGoingAway
+	default:
+		return CloseInternalError
+	}
+}
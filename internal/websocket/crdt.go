@@ -0,0 +1,480 @@
+// internal/websocket/crdt.go
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPendingRGAOps bounds how many ops waiting for the ops of a site a
+// document buffers before it gives up on them.
+const maxPendingRGAOps = 10000
+
+// serverSite is the site ID used for characters created by the server, both
+// when a document is loaded from text and for position-based edits.
+const serverSite = "server"
+
+// maxClockSkew bounds how far ahead of the document's clock a client op's
+// clock may be. A client's clock only runs ahead of the server's by its own
+// ops the server has not integrated yet, of which there are never more than
+// maxPendingRGAOps plus the ones in the message.
+const maxClockSkew = maxPendingRGAOps
+
+// tombstoneWindow is how many clock ticks a deleted character is kept for
+// after its deletion, so that ops from clients that have not seen the
+// deletion yet still find it. Past that, ops referring to it need a resync.
+const tombstoneWindow = 100_000
+
+// compactInterval is how many revisions pass between sweeps for tombstones
+// that have left the window.
+const compactInterval = 100
+
+// RGA op types.
+const (
+	RGAInsert = "insert"
+	RGADelete = "delete"
+)
+
+var (
+	// ErrOpsPending is returned by Integrate, along with whatever it did
+	// integrate, when ops of the message have to wait for ops they depend
+	// on. They are integrated and relayed as soon as those arrive.
+	ErrOpsPending        = errors.New("ops are waiting for the ops they depend on")
+	ErrTooManyPendingOps = errors.New("too many ops waiting for missing dependencies, resync required")
+)
+
+// RGAID identifies a character in an RGA document. IDs are ordered by
+// Lamport clock and then by site, which every replica agrees on.
+//
+// Site names the replica that created the character: serverSite, or for
+// clients the ID of the user they are connected as, optionally followed by
+// a colon and whatever tells that user's replicas apart, as in "42:tab-2".
+// Clients may only create characters on their own user's sites.
+type RGAID struct {
+	Clock int64  `json:"clock"`
+	Site  string `json:"site"`
+}
+
+func (id RGAID) isZero() bool { return id.Clock == 0 && id.Site == "" }
+
+// siteUser returns the user ID a site belongs to.
+func siteUser(site string) string {
+	user, _, _ := strings.Cut(site, ":")
+	return user
+}
+
+func (id RGAID) less(other RGAID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock < other.Clock
+	}
+	return id.Site < other.Site
+}
+
+// RGAOp inserts the single character Value after After (the zero ID meaning
+// the start of the document), or tombstones the character ID.
+type RGAOp struct {
+	Type  string `json:"type"`
+	ID    RGAID  `json:"id"`
+	After RGAID  `json:"after"`
+	Value string `json:"value,omitempty"`
+}
+
+// RGANode is one character of the document as sent to joining clients,
+// in document order and including tombstones. DeletedAt is the document's
+// clock when the character was deleted.
+type RGANode struct {
+	ID        RGAID  `json:"id"`
+	Value     string `json:"value"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	DeletedAt int64  `json:"deleted_at,omitempty"`
+}
+
+type rgaNode struct {
+	RGANode
+	next *rgaNode
+}
+
+// rgaDocument is the Merger for the CRDT strategy, a Replicated Growable
+// Array. Ops commute, so clients can edit offline and send their ops later
+// in any interleaving; the server only relays them once their causal
+// dependencies are known.
+//
+// The tree, tombstones included, is saved along with the text and rebuilt
+// from it when a room starts, so the IDs clients hold stay valid however
+// often the room is closed in between. Tombstones are dropped once they
+// fall tombstoneWindow behind the clock, which assumes clients keep a
+// Lamport clock: every ID they create is above every ID they have seen.
+type rgaDocument struct {
+	head     rgaNode
+	nodes    map[RGAID]*rgaNode
+	clock    int64
+	revision int
+	content  string
+	// state caches the encoded tree until the next revision.
+	state json.RawMessage
+	// pending holds the ops waiting for a character that has not arrived,
+	// by the site of that character. Clients only learn of other sites'
+	// characters through the server, so ops only ever wait for characters
+	// of their own user's sites, which only that user can still send.
+	pending map[string][]RGAOp
+	// history approximates each recent revision as a single splice, only
+	// to move positions such as cursors through it. history[i] turned
+	// revision revision-len(history)+i into the next one.
+	history []*Operation
+}
+
+// newRGADocument creates a document holding content. If state holds the
+// tree saved along with an earlier content, the document is rebuilt from
+// it and whatever changed since, for example over the REST API while the
+// room was closed, is applied on top as server ops.
+func newRGADocument(content string, state []byte) *rgaDocument {
+	d := &rgaDocument{nodes: make(map[RGAID]*rgaNode), pending: make(map[string][]RGAOp)}
+	var nodes []RGANode
+	if state != nil {
+		if err := json.Unmarshal(state, &nodes); err != nil {
+			log.Printf("Ignoring invalid merge state: %v", err)
+			nodes = nil
+		}
+	}
+	if nodes == nil {
+		// Loading the same text always gives the same IDs.
+		for _, r := range content {
+			nodes = append(nodes, RGANode{ID: RGAID{Clock: int64(len(nodes) + 1), Site: serverSite}, Value: string(r)})
+		}
+	}
+
+	prev := &d.head
+	for _, node := range nodes {
+		n := &rgaNode{RGANode: node}
+		d.nodes[n.ID] = n
+		d.clock = max(d.clock, n.ID.Clock)
+		prev.next = n
+		prev = n
+	}
+	d.content = d.text()
+	d.replace(content)
+	return d
+}
+
+// replace turns the text into content with server ops, so the characters
+// both have in common keep their IDs.
+func (d *rgaDocument) replace(content string) {
+	ops, err := d.splice(spliceBetween(d.content, content))
+	if err != nil {
+		// spliceBetween only describes splices in range.
+		panic(err)
+	}
+	for _, op := range ops {
+		if op.Type == RGAInsert {
+			d.insert(op)
+		} else {
+			d.delete(d.nodes[op.ID])
+		}
+	}
+	d.content = d.text()
+}
+
+// commit records the change from old to the current content as a new
+// revision.
+func (d *rgaDocument) commit(old string) {
+	d.revision++
+	d.state = nil
+	if d.revision%compactInterval == 0 {
+		d.compact()
+	}
+	position, length, text := spliceBetween(old, d.content)
+	op := &Operation{}
+	op.Retain(position).Delete(length).Insert(text).Retain(textLen(old) - position - length)
+	d.history = append(d.history, op)
+	if len(d.history) > maxHistory {
+		d.history = d.history[len(d.history)-maxHistory:]
+	}
+}
+
+func (d *rgaDocument) Content() string { return d.content }
+
+func (d *rgaDocument) Revision() int { return d.revision }
+
+func (d *rgaDocument) State() (json.RawMessage, error) {
+	if d.state != nil {
+		return d.state, nil
+	}
+	nodes := make([]RGANode, 0, len(d.nodes))
+	for n := d.head.next; n != nil; n = n.next {
+		nodes = append(nodes, n.RGANode)
+	}
+	state, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, err
+	}
+	d.state = state
+	return state, nil
+}
+
+// horizon is the clock at or below which deleted characters may have been
+// compacted away.
+func (d *rgaDocument) horizon() int64 { return d.clock - tombstoneWindow }
+
+// compact drops the tombstones deleted at or below the horizon.
+func (d *rgaDocument) compact() {
+	for prev := &d.head; prev.next != nil; {
+		n := prev.next
+		if n.Deleted && n.DeletedAt <= d.horizon() {
+			prev.next = n.next
+			delete(d.nodes, n.ID)
+			continue
+		}
+		prev = n
+	}
+}
+
+// Reset replaces the text with server ops, so ops from clients that have
+// not seen it yet still find the characters they refer to.
+func (d *rgaDocument) Reset(content string) {
+	old := d.content
+	d.replace(content)
+	d.commit(old)
+}
+
+func (d *rgaDocument) Integrate(msg *Message) (json.RawMessage, error) {
+	var ops []RGAOp
+	if len(msg.Ops) == 0 {
+		var err error
+		if ops, err = d.splice(msg.Position, msg.Length, msg.Text); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := json.Unmarshal(msg.Ops, &ops); err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			if err := d.validate(op, msg.UserID, len(ops)); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.checkPending(ops, msg.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	applied := d.applyReady(ops)
+	var pending error
+	if d.waiting(ops) {
+		pending = ErrOpsPending
+	}
+	if len(applied) == 0 {
+		return nil, pending
+	}
+	old := d.content
+	d.content = d.text()
+	d.commit(old)
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return nil, err
+	}
+	return data, pending
+}
+
+// waiting reports whether any of ops is still pending.
+func (d *rgaDocument) waiting(ops []RGAOp) bool {
+	for _, op := range ops {
+		for _, p := range d.pending[op.dependency().Site] {
+			if p == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dependency returns the character op cannot be integrated without.
+func (op RGAOp) dependency() RGAID {
+	if op.Type == RGAInsert {
+		return op.After
+	}
+	return op.ID
+}
+
+// checkPending makes sure that ops sent by userID that refer to characters
+// the server does not know can wait for them. Characters of other users
+// would have reached the sender through the server, so not knowing them
+// means the sender's view is too old, and it has to resync, as does not
+// knowing characters at or below the horizon, which may have been
+// compacted. Ops waiting for a site beyond maxPendingRGAOps are given up
+// on, along with the ones already waiting for it, which were all sent by
+// the same replica.
+func (d *rgaDocument) checkPending(ops []RGAOp, userID string) error {
+	waiting := make(map[string]int)
+	for _, op := range ops {
+		if _, ok := d.nodes[op.ID]; !ok && op.Type == RGAInsert && op.ID.Clock <= d.horizon() {
+			// It may be the insert of a compacted character.
+			return fmt.Errorf("%w: insert %+v is behind the horizon", ErrRevisionTooOld, op.ID)
+		}
+		dep := op.dependency()
+		if _, ok := d.nodes[dep]; ok || dep.isZero() {
+			continue
+		}
+		if siteUser(dep.Site) != userID || dep.Clock <= d.horizon() {
+			return fmt.Errorf("%w: character %+v is unknown", ErrRevisionTooOld, dep)
+		}
+		waiting[dep.Site]++
+	}
+	var err error
+	for site, n := range waiting {
+		if len(d.pending[site])+n > maxPendingRGAOps {
+			delete(d.pending, site)
+			err = ErrTooManyPendingOps
+		}
+	}
+	return err
+}
+
+func (d *rgaDocument) TransformRange(revision, start, end int) (int, int, error) {
+	return transformRange(d.history, d.revision-len(d.history), d.content, revision, start, end)
+}
+
+// validate checks an op sent by userID in a message of n ops. Inserts must
+// be on one of the user's sites, so no one can take over the IDs of others,
+// and their clocks must be within reach of the document's so that the
+// clock cannot be run out.
+func (d *rgaDocument) validate(op RGAOp, userID string, n int) error {
+	if op.ID.Site == "" || op.ID.Clock <= 0 {
+		return fmt.Errorf("invalid op id %+v", op.ID)
+	}
+	switch op.Type {
+	case RGAInsert:
+		if siteUser(op.ID.Site) != userID {
+			return fmt.Errorf("op id %+v is not on a site of user %s", op.ID, userID)
+		}
+		if op.ID.Clock > d.clock+maxClockSkew+int64(n) {
+			return fmt.Errorf("op clock %d is too far ahead of the document's %d", op.ID.Clock, d.clock)
+		}
+		if utf8.RuneCountInString(op.Value) != 1 {
+			return errors.New("insert must carry exactly one character")
+		}
+		if !op.After.isZero() && op.ID.Clock <= op.After.Clock {
+			return fmt.Errorf("insert clock %d must be greater than its reference %d", op.ID.Clock, op.After.Clock)
+		}
+	case RGADelete:
+	default:
+		return fmt.Errorf("unknown op type %q", op.Type)
+	}
+	return nil
+}
+
+// applyReady integrates ops and every pending op whose dependencies are
+// present, repeating until no more progress is made, and returns the ops
+// that changed the document. Duplicates of ops already integrated are
+// dropped, and the rest is left pending.
+func (d *rgaDocument) applyReady(ops []RGAOp) []RGAOp {
+	candidates := slices.Clone(ops)
+	for _, waiting := range d.pending {
+		candidates = append(candidates, waiting...)
+	}
+	clear(d.pending)
+	var applied []RGAOp
+	for progress := true; progress; {
+		progress = false
+		var waiting []RGAOp
+		for _, op := range candidates {
+			switch op.Type {
+			case RGAInsert:
+				if _, dup := d.nodes[op.ID]; dup {
+					progress = true
+					continue
+				}
+				if _, ok := d.nodes[op.After]; !ok && !op.After.isZero() {
+					waiting = append(waiting, op)
+					continue
+				}
+				d.insert(op)
+			case RGADelete:
+				n, ok := d.nodes[op.ID]
+				if !ok {
+					waiting = append(waiting, op)
+					continue
+				}
+				if n.Deleted {
+					progress = true
+					continue
+				}
+				d.delete(n)
+			}
+			applied = append(applied, op)
+			progress = true
+		}
+		candidates = waiting
+	}
+	for _, op := range candidates {
+		site := op.dependency().Site
+		d.pending[site] = append(d.pending[site], op)
+	}
+	return applied
+}
+
+// insert places a new character after its reference, skipping over any
+// concurrent inserts at the same place that have a higher ID.
+func (d *rgaDocument) insert(op RGAOp) {
+	prev := &d.head
+	if !op.After.isZero() {
+		prev = d.nodes[op.After]
+	}
+	for prev.next != nil && op.ID.less(prev.next.ID) {
+		prev = prev.next
+	}
+	n := &rgaNode{RGANode: RGANode{ID: op.ID, Value: op.Value}, next: prev.next}
+	prev.next = n
+	d.nodes[op.ID] = n
+	d.clock = max(d.clock, op.ID.Clock)
+}
+
+// delete tombstones n.
+func (d *rgaDocument) delete(n *rgaNode) {
+	n.Deleted = true
+	n.DeletedAt = d.clock
+}
+
+// splice turns a position-based edit against the current text into RGA ops
+// authored by the server.
+func (d *rgaDocument) splice(position, length int, text string) ([]RGAOp, error) {
+	if position < 0 || length < 0 || position+length > textLen(d.content) {
+		return nil, fmt.Errorf("splice %d+%d is out of range for document of length %d", position, length, textLen(d.content))
+	}
+	var ops []RGAOp
+	after := RGAID{}
+	index := 0
+	for n := d.head.next; n != nil && index < position+length; n = n.next {
+		if n.Deleted {
+			continue
+		}
+		if index < position {
+			after = n.ID
+		} else {
+			ops = append(ops, RGAOp{Type: RGADelete, ID: n.ID})
+		}
+		index += textLen(n.Value)
+	}
+	clock := d.clock
+	for _, r := range text {
+		clock++
+		id := RGAID{Clock: clock, Site: serverSite}
+		ops = append(ops, RGAOp{Type: RGAInsert, ID: id, After: after, Value: string(r)})
+		after = id
+	}
+	return ops, nil
+}
+
+func (d *rgaDocument) text() string {
+	var b strings.Builder
+	for n := d.head.next; n != nil; n = n.next {
+		if !n.Deleted {
+			b.WriteString(n.Value)
+		}
+	}
+	return b.String()
+}
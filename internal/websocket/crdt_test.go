@@ -0,0 +1,336 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// rgaMessage wraps ops in an op message from the user whose site the first
+// op is on, as the room would stamp it.
+func rgaMessage(t *testing.T, ops ...RGAOp) *Message {
+	t.Helper()
+	data, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{Type: TypeOp, Ops: data, UserID: siteUser(ops[0].ID.Site)}
+}
+
+func rgaInsert(clock int64, site string, after RGAID, value string) RGAOp {
+	return RGAOp{Type: RGAInsert, ID: RGAID{Clock: clock, Site: site}, After: after, Value: value}
+}
+
+func TestRGAIntegrateReportsPendingOps(t *testing.T) {
+	doc := newRGADocument("ab", nil)
+	b := RGAID{Clock: 2, Site: serverSite}
+	x := rgaInsert(3, "1", b, "x")
+	y := rgaInsert(4, "1", x.ID, "y")
+
+	// y depends on x, which has not arrived.
+	ops, err := doc.Integrate(rgaMessage(t, y))
+	if !errors.Is(err, ErrOpsPending) || ops != nil {
+		t.Fatalf("got %s, %v; want nothing and ErrOpsPending", ops, err)
+	}
+	if doc.Revision() != 0 || doc.Content() != "ab" {
+		t.Fatalf("pending op changed the document to %q at revision %d", doc.Content(), doc.Revision())
+	}
+
+	// x releases y, and both are relayed.
+	ops, err = doc.Integrate(rgaMessage(t, x))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var relayed []RGAOp
+	if err := json.Unmarshal(ops, &relayed); err != nil {
+		t.Fatal(err)
+	}
+	if len(relayed) != 2 || doc.Content() != "abxy" || doc.Revision() != 1 {
+		t.Fatalf("got %d ops, %q at revision %d; want 2 ops, %q at revision 1", len(relayed), doc.Content(), doc.Revision(), "abxy")
+	}
+
+	// Part of a message can go through while the rest waits.
+	z := rgaInsert(6, "2", RGAID{Clock: 5, Site: "2"}, "z")
+	w := rgaInsert(7, "2", y.ID, "w")
+	ops, err = doc.Integrate(rgaMessage(t, z, w))
+	if !errors.Is(err, ErrOpsPending) || ops == nil {
+		t.Fatalf("got %s, %v; want the ready op and ErrOpsPending", ops, err)
+	}
+	if doc.Content() != "abxyw" {
+		t.Fatalf("content is %q, want %q", doc.Content(), "abxyw")
+	}
+}
+
+func TestPendingOpsAreNotAcked(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyCRDT, "ab", "alice", "bob")
+	if err := storage.Member.Set(context.Background(), &store.Member{DocID: doc.DocID, UserID: users[1].ID, Role: store.RoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+	_, srv := newTestHub(t, storage, NewMemoryBroker())
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	bob, _ := dial(t, srv, doc.DocID, users[1].ID, store.RoleEditor)
+
+	site := strconv.FormatInt(users[0].ID, 10)
+	x := rgaInsert(3, site, RGAID{Clock: 2, Site: serverSite}, "x")
+	y := rgaInsert(4, site, x.ID, "y")
+	alice.send(rgaMessage(t, y))
+	if msg := alice.expect(TypeError); msg.Code != CodePending {
+		t.Fatalf("got error %q, want %q", msg.Code, CodePending)
+	}
+	alice.send(rgaMessage(t, x))
+	if msg := alice.expect(TypeAck); msg.Revision != 1 {
+		t.Fatalf("acked revision %d, want 1", msg.Revision)
+	}
+	var relayed []RGAOp
+	if err := json.Unmarshal(bob.expect(TypeOp).Ops, &relayed); err != nil {
+		t.Fatal(err)
+	}
+	if len(relayed) != 2 {
+		t.Fatalf("relayed %d ops, want 2", len(relayed))
+	}
+}
+
+func TestRGAStateKeepsIDsAcrossReloads(t *testing.T) {
+	b := RGAID{Clock: 2, Site: serverSite}
+	x := rgaInsert(3, "1", b, "x")
+	// y is sent by a client that saw x before the reload.
+	y := rgaInsert(4, "2", x.ID, "y")
+
+	for _, tc := range []struct {
+		name string
+		// content is what the document holds when it is reloaded, which
+		// differs from the saved state if it was changed without a room.
+		content string
+		want    string
+	}{
+		{name: "unchanged", content: "abx", want: "abxy"},
+		{name: "changed since", content: "Zabx", want: "Zabxy"},
+		{name: "x deleted since", content: "ab", want: "aby"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := newRGADocument("ab", nil)
+			if _, err := doc.Integrate(rgaMessage(t, x)); err != nil {
+				t.Fatal(err)
+			}
+			state, err := doc.State()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc = newRGADocument(tc.content, state)
+			if doc.Content() != tc.content {
+				t.Fatalf("reloaded %q, want %q", doc.Content(), tc.content)
+			}
+			if _, err := doc.Integrate(rgaMessage(t, y)); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Content() != tc.want {
+				t.Fatalf("content is %q, want %q", doc.Content(), tc.want)
+			}
+		})
+	}
+}
+
+func TestRGAResetKeepsIDs(t *testing.T) {
+	doc := newRGADocument("abc", nil)
+	doc.Reset("aXc")
+	if doc.Content() != "aXc" || doc.Revision() != 1 {
+		t.Fatalf("got %q at revision %d, want %q at revision 1", doc.Content(), doc.Revision(), "aXc")
+	}
+	// An op sent before the reset, after the deleted b.
+	op := rgaInsert(4, "1", RGAID{Clock: 2, Site: serverSite}, "y")
+	if _, err := doc.Integrate(rgaMessage(t, op)); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Content() != "aXyc" {
+		t.Fatalf("content is %q, want %q", doc.Content(), "aXyc")
+	}
+}
+
+func TestCRDTOpsSurviveRoomRestart(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyCRDT, "ab", "alice")
+	hub, srv := newTestHub(t, storage, NewMemoryBroker())
+	ctx := context.Background()
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	site := strconv.FormatInt(users[0].ID, 10)
+	x := rgaInsert(3, site, RGAID{Clock: 2, Site: serverSite}, "x")
+	alice.send(rgaMessage(t, x))
+	alice.expect(TypeAck)
+	if err := hub.CloseRoom(ctx, doc.DocID, CloseRoomClosed, "", true); err != nil {
+		t.Fatal(err)
+	}
+	alice.expectClose(CloseRoomClosed)
+
+	// The next room knows x by the ID alice gave it.
+	alice, _ = dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	alice.send(rgaMessage(t, rgaInsert(4, site, x.ID, "y")))
+	alice.expect(TypeAck)
+	content, err := hub.Content(ctx, doc.DocID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "abxy" {
+		t.Fatalf("content is %q, want %q", content, "abxy")
+	}
+}
+
+func TestRGARejectsOpsOnOthersSites(t *testing.T) {
+	b := RGAID{Clock: 2, Site: serverSite}
+	for _, tc := range []struct {
+		name string
+		op   RGAOp
+		ok   bool
+	}{
+		{name: "own site", op: rgaInsert(3, "1", b, "x"), ok: true},
+		{name: "own site with a replica", op: rgaInsert(3, "1:tab", b, "x"), ok: true},
+		{name: "another user's site", op: rgaInsert(3, "2", b, "x")},
+		{name: "a site merely starting with the user", op: rgaInsert(3, "12", b, "x")},
+		{name: "the server's site", op: rgaInsert(3, serverSite, b, "x")},
+		{name: "clock within reach", op: rgaInsert(2+maxClockSkew, "1", b, "x"), ok: true},
+		{name: "clock too far ahead", op: rgaInsert(4+maxClockSkew, "1", b, "x")},
+		{name: "clock at its limit", op: rgaInsert(math.MaxInt64, "1", b, "x")},
+		{name: "deleting another user's character", op: RGAOp{Type: RGADelete, ID: b}, ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := newRGADocument("ab", nil)
+			msg := rgaMessage(t, tc.op)
+			msg.UserID = "1"
+			_, err := doc.Integrate(msg)
+			if (err == nil) != tc.ok {
+				t.Fatalf("got %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestRGAPendingOpsAreKeptPerSite(t *testing.T) {
+	doc := newRGADocument("ab", nil)
+	b := RGAID{Clock: 2, Site: serverSite}
+	x := rgaInsert(3, "1", b, "x")
+	y := rgaInsert(4, "1", x.ID, "y")
+	if _, err := doc.Integrate(rgaMessage(t, y)); !errors.Is(err, ErrOpsPending) {
+		t.Fatalf("got %v, want ErrOpsPending", err)
+	}
+
+	// Another user overflows the buffer with ops waiting for their own
+	// missing character, which only costs them theirs.
+	missing := RGAID{Clock: 3, Site: "2"}
+	flood := make([]RGAOp, maxPendingRGAOps+1)
+	for i := range flood {
+		flood[i] = RGAOp{Type: RGADelete, ID: missing}
+	}
+	if _, err := doc.Integrate(rgaMessage(t, rgaInsert(4, "2", missing, "z"))); !errors.Is(err, ErrOpsPending) {
+		t.Fatalf("got %v, want ErrOpsPending", err)
+	}
+	msg := rgaMessage(t, flood...)
+	msg.UserID = "2"
+	if _, err := doc.Integrate(msg); !errors.Is(err, ErrTooManyPendingOps) {
+		t.Fatalf("got %v, want ErrTooManyPendingOps", err)
+	}
+	if len(doc.pending["2"]) != 0 {
+		t.Fatalf("%d ops still waiting for site 2", len(doc.pending["2"]))
+	}
+
+	if _, err := doc.Integrate(rgaMessage(t, x)); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Content() != "abxy" {
+		t.Fatalf("content is %q, want %q", doc.Content(), "abxy")
+	}
+}
+
+func TestRGAOpsOnUnknownCharactersOfOthersNeedResync(t *testing.T) {
+	doc := newRGADocument("ab", nil)
+	for _, op := range []RGAOp{
+		rgaInsert(6, "1", RGAID{Clock: 5, Site: "2"}, "x"),
+		rgaInsert(6, "1", RGAID{Clock: 5, Site: serverSite}, "x"),
+	} {
+		_, err := doc.Integrate(rgaMessage(t, op))
+		if !errors.Is(err, ErrRevisionTooOld) || errorCode(err) != CodeResyncRequired {
+			t.Fatalf("%+v: got %v, want a resync", op.After, err)
+		}
+	}
+	msg := rgaMessage(t, RGAOp{Type: RGADelete, ID: RGAID{Clock: 5, Site: "2"}})
+	msg.UserID = "1"
+	if _, err := doc.Integrate(msg); !errors.Is(err, ErrRevisionTooOld) {
+		t.Fatalf("deleting an unknown character: got %v, want ErrRevisionTooOld", err)
+	}
+	if len(doc.pending) != 0 {
+		t.Fatalf("ops left pending: %v", doc.pending)
+	}
+}
+
+func TestRGACompactsOldTombstones(t *testing.T) {
+	doc := newRGADocument("", nil)
+	x := rgaInsert(1, "1", RGAID{}, "x")
+	if _, err := doc.Integrate(rgaMessage(t, x)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doc.Integrate(rgaMessage(t, RGAOp{Type: RGADelete, ID: x.ID})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Type until x's tombstone is out of the window by the next sweep.
+	after := RGAID{}
+	for doc.Revision() < compactInterval {
+		op := rgaInsert(doc.clock+2*tombstoneWindow/compactInterval, "1", after, "y")
+		if _, err := doc.Integrate(rgaMessage(t, op)); err != nil {
+			t.Fatal(err)
+		}
+		after = op.ID
+	}
+	if _, ok := doc.nodes[x.ID]; ok {
+		t.Fatal("x's tombstone was not compacted")
+	}
+	if doc.Content() != strings.Repeat("y", compactInterval-2) {
+		t.Fatalf("compaction changed the content to %q", doc.Content())
+	}
+	state, err := doc.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(state), `"x"`) {
+		t.Fatalf("state still holds x: %s", state)
+	}
+
+	// Ops that could refer to x need a resync rather than bringing it back
+	// or waiting for it forever.
+	for _, op := range []RGAOp{
+		x,
+		rgaInsert(doc.clock+1, "1", x.ID, "z"),
+		{Type: RGADelete, ID: x.ID},
+	} {
+		if _, err := doc.Integrate(rgaMessage(t, op)); !errors.Is(err, ErrRevisionTooOld) {
+			t.Fatalf("%s of %+v: got %v, want ErrRevisionTooOld", op.Type, op.ID, err)
+		}
+	}
+}
+
+func TestRGAStateIsEncodedOncePerRevision(t *testing.T) {
+	doc := newRGADocument("ab", nil)
+	first, err := doc.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := doc.State(); &again[0] != &first[0] {
+		t.Fatal("state was encoded again without a change")
+	}
+	if _, err := doc.Integrate(rgaMessage(t, rgaInsert(3, "1", RGAID{Clock: 2, Site: serverSite}, "x"))); err != nil {
+		t.Fatal(err)
+	}
+	state, err := doc.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newRGADocument("abx", state)
+	if reloaded.Content() != "abx" || reloaded.clock != 3 {
+		t.Fatalf("state is stale: reloaded %q at clock %d", reloaded.Content(), reloaded.clock)
+	}
+}
@@ -0,0 +1,69 @@
+// internal/websocket/cursor.go
+package websocket
+
+import (
+	"errors"
+	"time"
+)
+
+// handleCursor relays a client's caret or selection to everyone else. It
+// is never persisted. Each client's cursor is relayed at most once per
+// cursorInterval; one arriving sooner replaces any already held back and
+// goes out when the interval is up, so the last position always arrives.
+func (r *Room) handleCursor(sender *Client, msg *Message) {
+	if sender.idle {
+		r.setIdle(sender, false)
+	}
+	sender.pendingCursor = msg
+	r.flushCursors(time.Now())
+}
+
+// flushCursors relays every held-back cursor whose client is due and arms
+// the cursor timer for the next one that is not.
+func (r *Room) flushCursors(now time.Time) {
+	r.Mu.Lock()
+	var waiting []*Client
+	for client := range r.Clients {
+		if client.pendingCursor != nil {
+			waiting = append(waiting, client)
+		}
+	}
+	r.Mu.Unlock()
+
+	var next time.Duration
+	for _, client := range waiting {
+		if wait := client.lastCursor.Add(r.cursorInterval).Sub(now); wait > 0 {
+			if next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		r.relayCursor(client, client.pendingCursor)
+		client.pendingCursor = nil
+		client.lastCursor = now
+	}
+	if next > 0 {
+		r.cursorTimer.Reset(next)
+	}
+}
+
+// relayCursor rebases a cursor onto the current revision, so edits made
+// since the sender saw the document do not shift it onto other text, and
+// sends it to everyone but the sender.
+func (r *Room) relayCursor(sender *Client, msg *Message) {
+	start, end, err := r.doc.TransformRange(msg.Revision, msg.Position, msg.Position+msg.Length)
+	switch {
+	case errors.Is(err, ErrRevisionTooOld):
+		// The client is about to resync and will send a fresh cursor.
+		return
+	case err != nil:
+		r.send(sender, r.errorMessage(err))
+		return
+	}
+
+	relay := r.newMessage(TypeCursor, sender.userTag())
+	relay.Username = sender.Username
+	relay.Position = start
+	relay.Length = end - start
+	r.broadcast(relay, sender)
+}
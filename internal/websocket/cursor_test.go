@@ -0,0 +1,100 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// expectCursor reads until a cursor message arrives, skipping presence
+// updates.
+func (c *testConn) expectCursor() *Message {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("waiting for a cursor: %v", err)
+		}
+		switch msg.Type {
+		case TypeCursor:
+			return &msg
+		case TypePresence:
+		default:
+			c.t.Fatalf("got %s message %q, want a cursor", msg.Type, msg.Text)
+		}
+	}
+}
+
+func TestOTTransformRange(t *testing.T) {
+	doc := newOTDocument("abcdef")
+	for i, s := range []splice{{0, 0, "XY"}, {5, 2, ""}} {
+		if _, err := doc.Integrate(otSplice(i, s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "XYabcdef" then "XYabcf": the selection of "cde" at revision 0 has
+	// had "XY" inserted before it and "de" deleted from it.
+	start, end, err := doc.TransformRange(0, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 4 || end != 5 {
+		t.Fatalf("moved 2-5 to %d-%d, want 4-5", start, end)
+	}
+	if _, _, err := doc.TransformRange(3, 0, 0); err == nil {
+		t.Fatal("transformed a range from a future revision")
+	}
+}
+
+// newCursorRoom connects alice and bob to a room on "abcdef" that relays
+// each client's cursor at most once per interval.
+func newCursorRoom(t *testing.T, interval time.Duration) (alice, bob *testConn) {
+	t.Helper()
+	storage, doc, users := newTestStorage(t, StrategyOT, "abcdef", "alice", "bob")
+	if err := storage.Member.Set(context.Background(), &store.Member{DocID: doc.DocID, UserID: users[1].ID, Role: store.RoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig
+	cfg.CursorInterval = interval
+	_, srv := newTestHubWithConfig(t, storage, NewMemoryBroker(), cfg)
+	alice, _ = dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	bob, _ = dial(t, srv, doc.DocID, users[1].ID, store.RoleEditor)
+	return alice, bob
+}
+
+func TestCursorIsRebasedOntoTheCurrentRevision(t *testing.T) {
+	alice, bob := newCursorRoom(t, 0)
+	alice.splice(0, 0, 0, "XY")
+	alice.expect(TypeAck)
+
+	// bob selects "cd" before seeing alice's edit.
+	bob.send(&Message{Type: TypeCursor, Revision: 0, Position: 2, Length: 2})
+	cursor := alice.expectCursor()
+	if cursor.Position != 4 || cursor.Length != 2 || cursor.Username != "bob" {
+		t.Fatalf("relayed %s's cursor at %d+%d, want bob's at 4+2", cursor.Username, cursor.Position, cursor.Length)
+	}
+	bob.expect(TypeOp)
+
+	bob.send(&Message{Type: TypeCursor, Revision: 5, Position: 0})
+	if msg := bob.expect(TypeError); msg.Code != CodeRejected {
+		t.Fatalf("got error %q for a cursor at a future revision, want %q", msg.Code, CodeRejected)
+	}
+}
+
+func TestCursorsAreThrottled(t *testing.T) {
+	alice, bob := newCursorRoom(t, 50*time.Millisecond)
+	for position := range 4 {
+		bob.send(&Message{Type: TypeCursor, Revision: 0, Position: position})
+	}
+	// The first cursor goes out straight away and the last once the
+	// interval is up; those in between are dropped.
+	if cursor := alice.expectCursor(); cursor.Position != 0 {
+		t.Fatalf("first cursor relayed at %d, want 0", cursor.Position)
+	}
+	if cursor := alice.expectCursor(); cursor.Position != 3 {
+		t.Fatalf("second cursor relayed at %d, want the last one, at 3", cursor.Position)
+	}
+}
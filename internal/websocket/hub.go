@@ -1,34 +1,541 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/vlkhvnn/DocCollab/internal/store"
 )
 
-// Hub manages multiple document rooms.
+// Config tunes how rooms and their connections behave.
+type Config struct {
+	// RoomIdleTimeout is how long a room without clients stays loaded
+	// before it is flushed and dropped. Zero keeps rooms forever.
+	RoomIdleTimeout time.Duration
+	// PersistDebounce is how long edits have to pause before the document
+	// is written, and PersistMaxDelay the longest a write is put off while
+	// edits keep coming.
+	PersistDebounce time.Duration
+	PersistMaxDelay time.Duration
+
+	// PingPeriod is how often clients are pinged. A client that has not
+	// answered within PongWait is disconnected with CloseIdleTimeout, so
+	// PingPeriod must be shorter than PongWait.
+	PingPeriod time.Duration
+	PongWait   time.Duration
+	// HandshakeTimeout is how long a new connection has to send its hello.
+	HandshakeTimeout time.Duration
+	// WriteWait bounds how long a single write to a client may take.
+	WriteWait time.Duration
+	// MaxMessageSize is the largest message in bytes a client may send.
+	MaxMessageSize int64
+
+	// CursorInterval is the shortest time between two cursor updates from
+	// the same client being relayed.
+	CursorInterval time.Duration
+
+	// SendQueueSize is how many messages may wait to be written to a
+	// client before SlowConsumerPolicy applies.
+	SendQueueSize int
+	// SlowConsumerPolicy is SlowConsumerResync or SlowConsumerDisconnect.
+	// Empty means SlowConsumerResync.
+	SlowConsumerPolicy string
+
+	// OwnerHeartbeat is how often a room owning its document tells the
+	// other instances with clients in it that it is still there. They give
+	// up on it after three missed heartbeats.
+	OwnerHeartbeat time.Duration
+}
+
+// Validate reports the first setting the hub cannot run with.
+func (c Config) Validate() error {
+	switch {
+	case c.PingPeriod <= 0:
+		return fmt.Errorf("ping period must be positive, got %s", c.PingPeriod)
+	case c.PongWait <= c.PingPeriod:
+		return fmt.Errorf("pong wait %s must be longer than the ping period %s", c.PongWait, c.PingPeriod)
+	case c.HandshakeTimeout <= 0:
+		return fmt.Errorf("handshake timeout must be positive, got %s", c.HandshakeTimeout)
+	case c.WriteWait <= 0:
+		return fmt.Errorf("write wait must be positive, got %s", c.WriteWait)
+	case c.MaxMessageSize <= 0:
+		return fmt.Errorf("max message size must be positive, got %d", c.MaxMessageSize)
+	case c.SendQueueSize <= 0:
+		return fmt.Errorf("send queue size must be positive, got %d", c.SendQueueSize)
+	case c.CursorInterval < 0:
+		return fmt.Errorf("cursor interval must not be negative, got %s", c.CursorInterval)
+	case c.RoomIdleTimeout < 0:
+		return fmt.Errorf("room idle timeout must not be negative, got %s", c.RoomIdleTimeout)
+	case c.PersistDebounce < 0 || c.PersistMaxDelay < 0:
+		return fmt.Errorf("persist delays must not be negative, got %s and %s", c.PersistDebounce, c.PersistMaxDelay)
+	case c.OwnerHeartbeat < 0:
+		return fmt.Errorf("owner heartbeat must not be negative, got %s", c.OwnerHeartbeat)
+	}
+	switch c.SlowConsumerPolicy {
+	case "", SlowConsumerResync, SlowConsumerDisconnect:
+	default:
+		return fmt.Errorf("unknown slow consumer policy %q", c.SlowConsumerPolicy)
+	}
+	return nil
+}
+
+// ErrShuttingDown is returned for rooms requested after Shutdown.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// Hub manages multiple document rooms. Hubs on different instances share a
+// Broker, which makes sure only one of them owns the room for a document;
+// the others open follower rooms that forward their clients to it.
 type Hub struct {
 	Rooms   map[string]*Room
 	Mu      sync.Mutex
 	Storage *store.Storage
+	Config  Config
+
+	closing bool
+
+	broker Broker
+	// instance identifies the hub to the other instances, and inbox
+	// receives what they send it.
+	instance string
+	inbox    Subscription
+	// loading holds documents whose room is being opened, so that only
+	// one is. The channel is closed once it is done.
+	loading map[string]chan struct{}
+	// publishing tracks what rooms publish in the background, which
+	// Shutdown waits for.
+	publishing sync.WaitGroup
+	// requests holds the requests made of other instances awaiting a
+	// response, by ID.
+	requests map[string]chan *envelope
+}
+
+// NewHub starts a hub on storage and broker. It fails if config does not
+// validate.
+func NewHub(storage *store.Storage, broker Broker, config Config) (*Hub, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("websocket config: %w", err)
+	}
+	h := &Hub{
+		Rooms:    make(map[string]*Room),
+		Storage:  storage,
+		Config:   config,
+		broker:   broker,
+		instance: uuid.NewString(),
+		loading:  make(map[string]chan struct{}),
+		requests: make(map[string]chan *envelope),
+	}
+	inbox, err := broker.Subscribe(context.Background(), instanceTopic(h.instance))
+	if err != nil {
+		return nil, err
+	}
+	h.inbox = inbox
+	go h.dispatch()
+	return h, nil
+}
+
+// GetRoom retrieves the live room for docID, or opens one. It returns
+// store.ErrNotFound if the document does not exist.
+func (h *Hub) GetRoom(ctx context.Context, docID string) (*Room, error) {
+	for {
+		h.Mu.Lock()
+		if h.closing {
+			h.Mu.Unlock()
+			return nil, ErrShuttingDown
+		}
+		if room, ok := h.Rooms[docID]; ok {
+			h.Mu.Unlock()
+			return room, nil
+		}
+		if wait, ok := h.loading[docID]; ok {
+			h.Mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		loaded := make(chan struct{})
+		h.loading[docID] = loaded
+		h.Mu.Unlock()
+
+		// Open outside the lock so a slow query does not hold up other
+		// rooms.
+		room, err := h.openRoom(ctx, docID)
+
+		h.Mu.Lock()
+		delete(h.loading, docID)
+		close(loaded)
+		if err == nil && h.closing {
+			err = ErrShuttingDown
+			room.retire(CloseGoingAway, "server going away")
+		}
+		if err != nil {
+			h.Mu.Unlock()
+			return nil, err
+		}
+		h.Rooms[docID] = room
+		h.Mu.Unlock()
+
+		go room.Run()
+		if room.sub != nil {
+			go room.pump()
+		}
+		return room, nil
+	}
 }
 
-func NewHub(storage *store.Storage) *Hub {
-	return &Hub{
-		Rooms:   make(map[string]*Room),
-		Storage: storage,
+// openRoom takes ownership of docID and loads it into a new room, or
+// opens a follower room if another instance owns it.
+func (h *Hub) openRoom(ctx context.Context, docID string) (*Room, error) {
+	// Subscribe before taking ownership so that nothing a follower sends
+	// once it sees the new owner is missed.
+	sub, err := h.broker.Subscribe(ctx, docTopic(docID))
+	if err != nil {
+		return nil, err
+	}
+	lease, err := h.broker.Acquire(ctx, docID, h.instance)
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	// Load after taking ownership, so that a previous owner has saved
+	// everything it had.
+	doc, err := h.Storage.Document.GetDocumentByDocID(ctx, docID)
+	if err == nil && lease == nil {
+		sub.Close()
+		return newFollowerRoom(docID, h), nil
+	}
+	var room *Room
+	if err == nil {
+		room, err = NewRoom(doc, h.Storage)
+	}
+	if err != nil {
+		sub.Close()
+		if lease != nil {
+			lease.Release(context.Background())
+		}
+		return nil, err
+	}
+
+	room.hub = h
+	room.idleTimeout = h.Config.RoomIdleTimeout
+	room.cursorInterval = h.Config.CursorInterval
+	room.heartbeat = h.Config.OwnerHeartbeat
+	room.persister = newPersister(docID, h.Storage, h.Config, doc.MergeStrategy == StrategyCRDT)
+	room.lease = lease
+	room.sub = sub
+	return room, nil
+}
+
+// Join adds client to the room for docID, creating the room if needed. If
+// the room it finds stops before the client gets in, it tries again with a
+// fresh one.
+func (h *Hub) Join(ctx context.Context, docID string, client *Client) (*Room, error) {
+	for {
+		room, err := h.GetRoom(ctx, docID)
+		if err != nil {
+			return nil, err
+		}
+		if room.Join(client) {
+			return room, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// remove drops room from the hub if it is still the live room for its
+// document.
+func (h *Hub) remove(room *Room) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	if h.Rooms[room.ID] == room {
+		delete(h.Rooms, room.ID)
 	}
 }
 
-// GetRoom retrieves or creates a room with the given docID.
-func (h *Hub) GetRoom(docID string) *Room {
+// Lookup returns the live room for docID without creating one.
+func (h *Hub) Lookup(docID string) (*Room, bool) {
 	h.Mu.Lock()
 	defer h.Mu.Unlock()
 	room, ok := h.Rooms[docID]
-	if !ok {
-		room = NewRoom(docID, h.Storage)
-		h.Rooms[docID] = room
-		go room.Run()
+	return room, ok
+}
+
+// CloseRoom closes the room for docID, wherever it is open, disconnecting
+// its clients with the given websocket close code and reason. Unsaved
+// content is discarded unless save is set.
+func (h *Hub) CloseRoom(ctx context.Context, docID string, code int, reason string, save bool) error {
+	h.Mu.Lock()
+	room, ok := h.Rooms[docID]
+	delete(h.Rooms, docID)
+	h.Mu.Unlock()
+	if ok {
+		err := room.Close(code, reason, save)
+		if room.follower == nil {
+			return err
+		}
+	}
+	_, err := h.request(ctx, docID, &envelope{Request: requestClose, Code: code, Reason: reason, Save: save})
+	if errors.Is(err, ErrNoRoom) {
+		return nil
+	}
+	return err
+}
+
+// RoomInfo describes a live room on this instance.
+type RoomInfo struct {
+	DocID string `json:"doc_id"`
+	// Owner is whether this instance owns the document rather than
+	// following the instance that does.
+	Owner bool `json:"owner"`
+	// Clients are connected to this instance; RemoteClients, known only
+	// to the owner, to its followers.
+	Clients       int `json:"clients"`
+	RemoteClients int `json:"remote_clients"`
+}
+
+// ListRooms describes the rooms live on this instance, by document ID.
+func (h *Hub) ListRooms() []RoomInfo {
+	h.Mu.Lock()
+	rooms := make([]*Room, 0, len(h.Rooms))
+	for _, room := range h.Rooms {
+		rooms = append(rooms, room)
+	}
+	h.Mu.Unlock()
+
+	infos := make([]RoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		info := RoomInfo{DocID: room.ID, Owner: room.follower == nil}
+		room.Mu.Lock()
+		for client := range room.Clients {
+			if client.isProxy() {
+				info.RemoteClients++
+			} else {
+				info.Clients++
+			}
+		}
+		room.Mu.Unlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].DocID < infos[j].DocID })
+	return infos
+}
+
+// Replace swaps the content of docID through its live room, wherever it
+// is open, as if userID had typed it. It returns ErrNoRoom if there is no
+// live room, in which case the caller should update the store.
+func (h *Hub) Replace(ctx context.Context, docID, content string, userID int64) error {
+	if room, ok := h.ownedRoom(docID); ok {
+		if err := room.Replace(content, userID); !errors.Is(err, ErrRoomClosed) {
+			return err
+		}
+	}
+	_, err := h.request(ctx, docID, &envelope{Request: requestReplace, Content: content, UserID: userID})
+	return err
+}
+
+// Restore is Replace for restoring an earlier revision; see Room.Restore.
+func (h *Hub) Restore(ctx context.Context, docID, content string, userID int64) error {
+	if room, ok := h.ownedRoom(docID); ok {
+		if err := room.Restore(content, userID); !errors.Is(err, ErrRoomClosed) {
+			return err
+		}
+	}
+	_, err := h.request(ctx, docID, &envelope{Request: requestRestore, Content: content, UserID: userID})
+	return err
+}
+
+// SetRole applies a change to userID's role on docID to their open
+// connections, wherever the room is open; see Room.SetRole. An empty role
+// closes them. Without a live room there is nothing to do.
+func (h *Hub) SetRole(ctx context.Context, docID string, userID int64, role store.Role) error {
+	if room, ok := h.ownedRoom(docID); ok {
+		if err := room.SetRole(userID, role); !errors.Is(err, ErrRoomClosed) {
+			return err
+		}
+	}
+	_, err := h.request(ctx, docID, &envelope{Request: requestRole, UserID: userID, Role: role})
+	if errors.Is(err, ErrNoRoom) {
+		return nil
+	}
+	return err
+}
+
+// Content returns the live content of docID, which may hold edits not
+// saved yet. It returns ErrNoRoom if there is no live room.
+func (h *Hub) Content(ctx context.Context, docID string) (string, error) {
+	if room, ok := h.ownedRoom(docID); ok {
+		return room.Content(), nil
+	}
+	resp, err := h.request(ctx, docID, &envelope{Request: requestContent})
+	if err != nil {
+		return "", err
+	}
+	return resp.Content, nil
+}
+
+// Presence returns who is connected to docID on any instance.
+func (h *Hub) Presence(ctx context.Context, docID string) ([]Presence, error) {
+	if room, ok := h.ownedRoom(docID); ok {
+		return room.Presence(), nil
+	}
+	resp, err := h.request(ctx, docID, &envelope{Request: requestPresence})
+	switch {
+	case errors.Is(err, ErrNoRoom):
+		return []Presence{}, nil
+	case err != nil:
+		return nil, err
+	}
+	if resp.Users == nil {
+		resp.Users = []Presence{}
+	}
+	return resp.Users, nil
+}
+
+// ownedRoom returns the room for docID if this hub owns the document.
+func (h *Hub) ownedRoom(docID string) (*Room, bool) {
+	room, ok := h.Lookup(docID)
+	if !ok || room.follower != nil {
+		return nil, false
+	}
+	return room, true
+}
+
+// request asks the owner of docID, on whichever instance, to carry out req
+// and waits for the response.
+func (h *Hub) request(ctx context.Context, docID string, req *envelope) (*envelope, error) {
+	owner, err := h.broker.Owner(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return nil, ErrNoRoom
+	}
+
+	req.Kind, req.DocID, req.Instance, req.ID = envRequest, docID, h.instance, uuid.NewString()
+	reply := make(chan *envelope, 1)
+	h.Mu.Lock()
+	h.requests[req.ID] = reply
+	h.Mu.Unlock()
+	defer func() {
+		h.Mu.Lock()
+		delete(h.requests, req.ID)
+		h.Mu.Unlock()
+	}()
+
+	// Restoring a revision includes a flush, so allow for a few queries.
+	ctx, cancel := context.WithTimeout(ctx, 3*store.QueryTimeoutDuration)
+	defer cancel()
+	if err := h.publishContext(ctx, docTopic(docID), req); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-reply:
+		return resp, remoteError(resp.Error)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch routes what other instances send the hub: responses to the
+// requests waiting for them and everything else to the follower room of
+// the document concerned.
+func (h *Hub) dispatch() {
+	for data := range h.inbox.C() {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			log.Printf("Invalid envelope: %v", err)
+			continue
+		}
+		h.Mu.Lock()
+		reply, isReply := h.requests[env.ID]
+		room := h.Rooms[env.DocID]
+		h.Mu.Unlock()
+
+		switch {
+		case env.Kind == envResponse:
+			if isReply {
+				select {
+				case reply <- &env:
+				default:
+				}
+			}
+		case room != nil && room.follower != nil:
+			// A room that has fallen behind must not hold up the others:
+			// what it misses is dropped, and its clients are resynced.
+			select {
+			case room.inbox <- &env:
+			default:
+				wsMessagesDropped.Add(1)
+				select {
+				case room.follower.overflow <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// publish sends env to topic, logging failures.
+func (h *Hub) publish(topic string, env *envelope) {
+	ctx, cancel := context.WithTimeout(context.Background(), store.QueryTimeoutDuration)
+	defer cancel()
+	if err := h.publishContext(ctx, topic, env); err != nil {
+		log.Printf("Failed to publish %s for room %s: %v", env.Kind, env.DocID, err)
+	}
+}
+
+func (h *Hub) publishContext(ctx context.Context, topic string, env *envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(ctx, topic, data)
+}
+
+// Shutdown stops handing out rooms, then disconnects every client with a
+// going-away close frame and saves every room's content. It returns once
+// all rooms have stopped or ctx is done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.Mu.Lock()
+	h.closing = true
+	rooms := h.Rooms
+	h.Rooms = make(map[string]*Room)
+	h.Mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(rooms))
+	for docID, room := range rooms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := room.Shutdown(ctx); err != nil {
+				errs <- fmt.Errorf("room %s: %w", docID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if ctx.Err() == nil {
+		// Every room has stopped, so nothing is added while waiting.
+		h.publishing.Wait()
+	}
+
+	var all []error
+	for err := range errs {
+		all = append(all, err)
 	}
-	return room
+	h.inbox.Close()
+	return errors.Join(all...)
 }
@@ -0,0 +1,335 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+var testConfig = Config{
+	PersistDebounce:  10 * time.Millisecond,
+	PersistMaxDelay:  50 * time.Millisecond,
+	PingPeriod:       time.Minute,
+	PongWait:         2 * time.Minute,
+	HandshakeTimeout: 5 * time.Second,
+	WriteWait:        5 * time.Second,
+	MaxMessageSize:   1 << 20,
+	SendQueueSize:    64,
+}
+
+// newTestHub starts a hub on storage and broker, with an HTTP server that
+// connects the user given by the userID query parameter with the role
+// given by role, as the API does after checking both.
+func newTestHub(t *testing.T, storage *store.Storage, broker Broker) (*Hub, *httptest.Server) {
+	t.Helper()
+	return newTestHubWithConfig(t, storage, broker, testConfig)
+}
+
+// newTestHubWithConfig is newTestHub with cfg instead of testConfig.
+func newTestHubWithConfig(t *testing.T, storage *store.Storage, broker Broker, cfg Config) (*Hub, *httptest.Server) {
+	t.Helper()
+	hub, err := NewHub(storage, broker, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		docID := r.URL.Query().Get("docID")
+		userID, _ := strconv.ParseInt(r.URL.Query().Get("userID"), 10, 64)
+		user, err := storage.User.GetById(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, user, store.Role(r.URL.Query().Get("role")), hub.Config)
+		if err := client.Handshake(docID); err != nil {
+			return
+		}
+		room, err := hub.Join(r.Context(), docID, client)
+		if err != nil {
+			Reject(conn, docID, err)
+			return
+		}
+		go client.ReadPump(room)
+		go client.WritePump()
+	}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+		srv.Close()
+	})
+	return hub, srv
+}
+
+// testConn is a client connection to a test server.
+type testConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// dial connects userID to docID through srv with role, and reads the
+// handshake and the initial sync, which it returns.
+func dial(t *testing.T, srv *httptest.Server, docID string, userID int64, role store.Role) (*testConn, *Message) {
+	t.Helper()
+	c := dialRaw(t, srv, docID, userID, role)
+	c.send(&Message{Type: TypeHello, Versions: []int{ProtocolVersion}})
+	c.expect(TypeHello)
+	return c, c.expect(TypeSync)
+}
+
+// dialRaw connects userID to docID through srv with role, without going
+// through the handshake.
+func dialRaw(t *testing.T, srv *httptest.Server, docID string, userID int64, role store.Role) *testConn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?docID=" + docID +
+		"&userID=" + strconv.FormatInt(userID, 10) + "&role=" + string(role)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn}
+}
+
+func (c *testConn) send(msg *Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads messages until one of type msgType arrives, skipping
+// presence and cursor updates.
+func (c *testConn) expect(msgType string) *Message {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return &msg
+		}
+		if msg.Type != TypePresence && msg.Type != TypeCursor {
+			c.t.Fatalf("got %s message %q, want %s", msg.Type, msg.Text, msgType)
+		}
+	}
+}
+
+// expectClose reads until the connection is closed and checks the code.
+func (c *testConn) expectClose(code int) {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := c.conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		switch {
+		case errors.As(err, &closeErr):
+			if closeErr.Code != code {
+				c.t.Fatalf("closed with %d, want %d", closeErr.Code, code)
+			}
+			return
+		case err != nil:
+			c.t.Fatalf("waiting for close %d: %v", code, err)
+		}
+	}
+}
+
+// splice sends an edit against revision.
+func (c *testConn) splice(revision, position, length int, text string) {
+	c.t.Helper()
+	c.send(&Message{Type: TypeOp, Revision: revision, Position: position, Length: length, Text: text})
+}
+
+func TestSetRoleReachesLiveConnections(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// follower connects bob through a second instance and changes
+		// bob's role through it, so everything crosses the broker.
+		follower bool
+	}{
+		{name: "same instance"},
+		{name: "across instances", follower: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			storage, doc, users := newTestStorage(t, "ot", "hello", "alice", "bob")
+			alice, bob := users[0].ID, users[1].ID
+			ctx := context.Background()
+			if err := storage.Member.Set(ctx, &store.Member{DocID: doc.DocID, UserID: bob, Role: store.RoleEditor}); err != nil {
+				t.Fatal(err)
+			}
+
+			broker := NewMemoryBroker()
+			owner, ownerSrv := newTestHub(t, storage, broker)
+			hub, srv := owner, ownerSrv
+			if tc.follower {
+				hub, srv = newTestHub(t, storage, broker)
+			}
+			aliceConn, _ := dial(t, ownerSrv, doc.DocID, alice, store.RoleOwner)
+			bobConn, sync := dial(t, srv, doc.DocID, bob, store.RoleEditor)
+
+			bobConn.splice(sync.Revision, 5, 0, "!")
+			bobConn.expect(TypeAck)
+			aliceConn.expect(TypeOp)
+
+			// Demoted: told so, and ops are refused from then on.
+			if err := hub.SetRole(ctx, doc.DocID, bob, store.RoleViewer); err != nil {
+				t.Fatal(err)
+			}
+			if msg := bobConn.expect(TypeRole); msg.Role != store.RoleViewer {
+				t.Fatalf("got role %q, want %q", msg.Role, store.RoleViewer)
+			}
+			bobConn.splice(sync.Revision+1, 0, 0, "x")
+			if msg := bobConn.expect(TypeError); msg.Code != CodeReadOnly {
+				t.Fatalf("got error %q, want %q", msg.Code, CodeReadOnly)
+			}
+
+			// Removed: disconnected, while everyone else stays.
+			if err := hub.SetRole(ctx, doc.DocID, bob, ""); err != nil {
+				t.Fatal(err)
+			}
+			bobConn.expectClose(CloseAccessRevoked)
+			if msg := aliceConn.expect(TypePresence); msg.Event != PresenceLeave {
+				t.Fatalf("got presence %q, want %q", msg.Event, PresenceLeave)
+			}
+			content, err := owner.Content(ctx, doc.DocID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content != "hello!" {
+				t.Fatalf("content is %q, want %q", content, "hello!")
+			}
+		})
+	}
+}
+
+func TestSetRoleWithoutLiveRoom(t *testing.T) {
+	storage, doc, users := newTestStorage(t, "ot", "", "alice")
+	hub, _ := newTestHub(t, storage, NewMemoryBroker())
+	if err := hub.SetRole(context.Background(), doc.DocID, users[0].ID, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewHubRejectsInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(*Config)
+	}{
+		{name: "no ping period", change: func(c *Config) { c.PingPeriod = 0 }},
+		{name: "pong wait not past the ping", change: func(c *Config) { c.PongWait = c.PingPeriod }},
+		{name: "no handshake timeout", change: func(c *Config) { c.HandshakeTimeout = 0 }},
+		{name: "no send queue", change: func(c *Config) { c.SendQueueSize = 0 }},
+		{name: "negative cursor interval", change: func(c *Config) { c.CursorInterval = -time.Second }},
+		{name: "negative idle timeout", change: func(c *Config) { c.RoomIdleTimeout = -time.Second }},
+		{name: "negative persist delay", change: func(c *Config) { c.PersistMaxDelay = -time.Second }},
+		{name: "unknown slow consumer policy", change: func(c *Config) { c.SlowConsumerPolicy = "drop" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			storage, _, _ := newTestStorage(t, StrategyOT, "", "alice")
+			config := testConfig
+			tc.change(&config)
+			if hub, err := NewHub(storage, NewMemoryBroker(), config); err == nil {
+				hub.Shutdown(context.Background())
+				t.Fatal("the hub started")
+			}
+		})
+	}
+}
+
+func TestFollowerThatFallsBehindIsResynced(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "hello", "alice")
+	broker := NewMemoryBroker()
+	_, ownerSrv := newTestHub(t, storage, broker)
+	follower, srv := newTestHub(t, storage, broker)
+	dial(t, ownerSrv, doc.DocID, users[0].ID, store.RoleOwner)
+	conn, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+
+	// Hold up the follower room while its inbox fills, then send it one
+	// more envelope, which the hub has to drop rather than wait.
+	follower.Mu.Lock()
+	room := follower.Rooms[doc.DocID]
+	follower.Mu.Unlock()
+	room.Mu.Lock()
+	for full := false; !full; {
+		select {
+		case room.inbox <- &envelope{Kind: envHeartbeat, DocID: doc.DocID}:
+		default:
+			full = true
+		}
+	}
+	data, err := json.Marshal(&envelope{Kind: envHeartbeat, DocID: doc.DocID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish(context.Background(), instanceTopic(follower.instance), data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-room.follower.overflow:
+		room.follower.overflow <- struct{}{}
+	case <-time.After(5 * time.Second):
+		room.Mu.Unlock()
+		t.Fatal("the hub did not drop the envelope")
+	}
+	room.Mu.Unlock()
+
+	if msg := conn.expect(TypeSync); msg.Text != "hello" {
+		t.Fatalf("resynced with %q, want %q", msg.Text, "hello")
+	}
+}
+
+func TestShutdownDrainsRooms(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice", "bob")
+	ctx := context.Background()
+	other := &store.Document{DocID: "other", Content: "xyz", MergeStrategy: StrategyOT}
+	if err := storage.Document.CreateDocument(ctx, other, users[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig
+	cfg.PersistDebounce, cfg.PersistMaxDelay = time.Hour, time.Hour
+	hub, srv := newTestHubWithConfig(t, storage, NewMemoryBroker(), cfg)
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	bob, _ := dial(t, srv, other.DocID, users[1].ID, store.RoleOwner)
+	alice.splice(0, 3, 0, "d")
+	alice.expect(TypeAck)
+	bob.splice(0, 0, 0, "w")
+	bob.expect(TypeAck)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	alice.expectClose(CloseGoingAway)
+	bob.expectClose(CloseGoingAway)
+
+	for docID, want := range map[string]string{doc.DocID: "abcd", other.DocID: "wxyz"} {
+		stored, err := storage.Document.GetDocumentByDocID(ctx, docID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Content != want {
+			t.Errorf("%s was saved as %q, want %q", docID, stored.Content, want)
+		}
+	}
+	if _, err := hub.GetRoom(ctx, doc.DocID); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("got %v opening a room after shutdown, want ErrShuttingDown", err)
+	}
+}
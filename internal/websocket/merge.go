@@ -0,0 +1,103 @@
+// internal/websocket/merge.go
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Merge strategies a document can be configured with.
+const (
+	StrategyOT   = "ot"
+	StrategyCRDT = "crdt"
+)
+
+// Merger reconciles concurrent edits to a room's document. Rooms hold one
+// Merger and call it only from their Run loop.
+type Merger interface {
+	// Content returns the current document text.
+	Content() string
+	// Revision returns the number of edits integrated so far.
+	Revision() int
+	// Integrate applies an op message sent by a client and returns the ops
+	// to relay to the other clients, or nil if nothing changed yet. It
+	// returns ErrOpsPending, along with the ops to relay, if some of the
+	// message has to wait for ops that have not arrived.
+	Integrate(msg *Message) (json.RawMessage, error)
+	// State returns what a joining client needs besides the text to take
+	// part in merging, or nil if the text is enough.
+	State() (json.RawMessage, error)
+	// Reset replaces the whole document with content as a new revision.
+	// OT edits based on earlier revisions are rejected afterwards and their
+	// senders have to resync; CRDT ops still merge into the new content.
+	Reset(content string)
+	// TransformRange moves the range start to end, as seen at revision,
+	// through the edits integrated since so that it covers the same text
+	// in the current document.
+	TransformRange(revision, start, end int) (int, int, error)
+}
+
+// NewMerger creates a Merger for strategy holding content. state is what
+// State returned when the document was last saved by a room, or nil.
+func NewMerger(strategy, content string, state []byte) (Merger, error) {
+	switch strategy {
+	case StrategyOT, "":
+		return newOTDocument(content), nil
+	case StrategyCRDT:
+		return newRGADocument(content, state), nil
+	default:
+		return nil, fmt.Errorf("unknown merge strategy %q", strategy)
+	}
+}
+
+// transformRange implements Merger.TransformRange for documents that keep
+// the operations applied to them, where history[i] turned revision
+// first+i into the next one and content is the current text.
+func transformRange(history []*Operation, first int, content string, revision, start, end int) (int, int, error) {
+	current := first + len(history)
+	if revision > current || revision < 0 {
+		return 0, 0, fmt.Errorf("unknown revision %d", revision)
+	}
+	if revision < first {
+		return 0, 0, ErrRevisionTooOld
+	}
+	concurrent := history[revision-first:]
+	baseLen := textLen(content)
+	if len(concurrent) > 0 {
+		baseLen = concurrent[0].BaseLen
+	}
+	if start < 0 || start > end || end > baseLen {
+		return 0, 0, fmt.Errorf("range %d-%d is out of range for document of length %d", start, end, baseLen)
+	}
+	for _, op := range concurrent {
+		start, end = op.TransformPosition(start), op.TransformPosition(end)
+	}
+	return start, end, nil
+}
+
+// spliceBetween describes the change from old to new as a single splice,
+// trimming the common prefix and suffix so that positions elsewhere in the
+// document are left alone. Positions are in UTF-16 code units.
+func spliceBetween(old, new string) (position, length int, text string) {
+	a, b := utf16.Encode([]rune(old)), utf16.Encode([]rune(new))
+	for position < len(a) && position < len(b) && a[position] == b[position] {
+		position++
+	}
+	suffix := 0
+	for suffix < len(a)-position && suffix < len(b)-position && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	// Do not split a surrogate pair.
+	if position > 0 && isLeadSurrogate(a[position-1]) {
+		position--
+	}
+	if suffix > 0 && isTrailSurrogate(a[len(a)-suffix]) {
+		suffix--
+	}
+	return position, len(a) - position - suffix, string(utf16.Decode(b[position : len(b)-suffix]))
+}
+
+func isLeadSurrogate(u uint16) bool { return u >= 0xd800 && u < 0xdc00 }
+
+func isTrailSurrogate(u uint16) bool { return u >= 0xdc00 && u < 0xe000 }
@@ -1,12 +1,71 @@
 package websocket
 
-import "time"
+import (
+	"encoding/json"
+	"time"
 
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// Message types exchanged over the websocket.
+const (
+	// TypeHello opens every connection. The client lists the protocol
+	// versions it speaks in Versions and the server answers with the one
+	// chosen in Version, before anything else is exchanged.
+	TypeHello = "hello"
+	// TypeSync carries the full document text and the revision it reflects,
+	// plus any merge state the document's strategy needs in Ops and the
+	// users currently in the room in Users.
+	TypeSync = "sync"
+	// TypeOp carries an edit in the format of the document's merge strategy.
+	// The server relays what it integrated along with the new revision.
+	TypeOp = "op"
+	// TypeAck confirms to the sender that its op became the given revision.
+	// An op that has to wait for ops the server has not seen yet gets an
+	// error with code pending instead, and is relayed like any other op
+	// once it has been integrated.
+	TypeAck = "ack"
+	// TypeError reports a rejected message back to its sender, with Code
+	// saying why.
+	TypeError = "error"
+	// TypePresence announces a user joining, leaving, going idle or
+	// becoming active again, as given by Event. Clients send it with idle
+	// or active only.
+	TypePresence = "presence"
+	// TypeCursor carries a caret at Position, or a selection of Length
+	// characters from it, as of Revision. The server relays it rebased
+	// onto its current revision and never stores it.
+	TypeCursor = "cursor"
+	// TypeRole tells a client its user's role on the document, in Role,
+	// after it was changed. Ops are checked against the new role from then
+	// on. Users who lose access are disconnected instead.
+	TypeRole = "role"
+)
+
+// Message is the envelope of every message in either direction. Which
+// fields are meaningful depends on Type.
 type Message struct {
-	Type      string    `json:"type"`
-	DocID     string    `json:"docID"`
-	Position  int       `json:"position"`
-	Text      string    `json:"text"`
-	UserID    string    `json:"userID"`
-	Timestamp time.Time `json:"timestamp"`
+	Type      string          `json:"type"`
+	DocID     string          `json:"docID"`
+	Position  int             `json:"position"`
+	Length    int             `json:"length,omitempty"`
+	Text      string          `json:"text"`
+	Revision  int             `json:"revision"`
+	Ops       json.RawMessage `json:"ops,omitempty"`
+	UserID    string          `json:"userID"`
+	Timestamp time.Time       `json:"timestamp"`
+
+	// Versions and Version negotiate the protocol in hello messages.
+	Versions []int `json:"versions,omitempty"`
+	Version  int   `json:"version,omitempty"`
+	// Code classifies an error message.
+	Code string `json:"code,omitempty"`
+
+	// Event, Username and Users describe presence.
+	Event    string     `json:"event,omitempty"`
+	Username string     `json:"username,omitempty"`
+	Users    []Presence `json:"users,omitempty"`
+
+	// Role is the user's new role in role messages.
+	Role store.Role `json:"role,omitempty"`
 }
@@ -0,0 +1,75 @@
+// internal/websocket/metrics.go
+package websocket
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Counters published on /v1/admin/debug/vars.
+var (
+	// persistPending is the number of rooms with edits not yet stored.
+	persistPending = expvar.NewInt("persist_pending")
+	// persistFlushes counts successful document writes.
+	persistFlushes = expvar.NewInt("persist_flushes")
+	// persistFailures counts document writes that failed and will be retried.
+	persistFailures = expvar.NewInt("persist_failures")
+
+	// wsMessagesDropped counts messages that did not fit in a client's
+	// send queue.
+	wsMessagesDropped = expvar.NewInt("ws_messages_dropped")
+	// wsSlowConsumerResyncs counts slow clients sent a sync in place of
+	// their queued messages.
+	wsSlowConsumerResyncs = expvar.NewInt("ws_slow_consumer_resyncs")
+	// wsSlowConsumerDisconnects counts slow clients that were disconnected.
+	wsSlowConsumerDisconnects = expvar.NewInt("ws_slow_consumer_disconnects")
+	// syncsCoalesced counts queued messages discarded because a newer
+	// sync superseded them.
+	syncsCoalesced = expvar.NewInt("ws_syncs_coalesced")
+
+	// brokerDropped counts broker messages a subscriber was too far behind
+	// to receive.
+	brokerDropped = expvar.NewInt("broker_dropped")
+	// brokerPublishFailures counts messages the broker failed to publish.
+	brokerPublishFailures = expvar.NewInt("broker_publish_failures")
+)
+
+// liveClients maps every client in a room to the room's document ID, so
+// their send queue depths can be published.
+var liveClients = struct {
+	sync.Mutex
+	rooms map[*Client]string
+}{rooms: make(map[*Client]string)}
+
+func init() {
+	expvar.Publish("ws_send_queue_depth", expvar.Func(sendQueueDepths))
+}
+
+func trackClient(c *Client, docID string) {
+	liveClients.Lock()
+	liveClients.rooms[c] = docID
+	liveClients.Unlock()
+}
+
+func untrackClient(c *Client) {
+	liveClients.Lock()
+	delete(liveClients.rooms, c)
+	liveClients.Unlock()
+}
+
+type queueDepth struct {
+	UserID int64 `json:"user_id"`
+	Depth  int   `json:"depth"`
+}
+
+// sendQueueDepths reports the send queue depth of every connected client,
+// grouped by document.
+func sendQueueDepths() any {
+	liveClients.Lock()
+	defer liveClients.Unlock()
+	depths := make(map[string][]queueDepth)
+	for c, docID := range liveClients.rooms {
+		depths[docID] = append(depths[docID], queueDepth{UserID: c.UserID, Depth: c.queue.depth()})
+	}
+	return depths
+}
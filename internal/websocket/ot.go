@@ -0,0 +1,373 @@
+// internal/websocket/ot.go
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// maxHistory bounds how many applied operations an OT document keeps for
+// transforming late edits. Clients further behind must resync.
+const maxHistory = 1000
+
+var (
+	ErrBaseLengthMismatch = errors.New("operation base length does not match document length")
+	ErrIncompatibleOps    = errors.New("operations are not based on the same document")
+	ErrRevisionTooOld     = errors.New("revision is too old, resync required")
+)
+
+// Component is a single step of an Operation. Exactly one of Retain, Insert
+// or Delete is set.
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// Operation is a sequence of retain, insert and delete components that turns
+// a document of BaseLen characters into one of TargetLen characters.
+//
+// Lengths and positions are measured in UTF-16 code units so that they line
+// up with JavaScript string indices used by the editor.
+type Operation struct {
+	Components []Component
+	BaseLen    int
+	TargetLen  int
+}
+
+// textLen returns the length of s in UTF-16 code units.
+func textLen(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// Retain skips over n characters.
+func (o *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLen += n
+	o.TargetLen += n
+	if last := len(o.Components) - 1; last >= 0 && o.Components[last].Retain > 0 {
+		o.Components[last].Retain += n
+		return o
+	}
+	o.Components = append(o.Components, Component{Retain: n})
+	return o
+}
+
+// Insert inserts s at the current position.
+func (o *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return o
+	}
+	o.TargetLen += textLen(s)
+	last := len(o.Components) - 1
+	switch {
+	case last >= 0 && o.Components[last].Insert != "":
+		o.Components[last].Insert += s
+	case last >= 0 && o.Components[last].Delete > 0:
+		// Keep inserts ahead of deletes so equivalent operations compare equal.
+		if last > 0 && o.Components[last-1].Insert != "" {
+			o.Components[last-1].Insert += s
+		} else {
+			o.Components = append(o.Components, o.Components[last])
+			o.Components[last] = Component{Insert: s}
+		}
+	default:
+		o.Components = append(o.Components, Component{Insert: s})
+	}
+	return o
+}
+
+// Delete removes n characters at the current position.
+func (o *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLen += n
+	if last := len(o.Components) - 1; last >= 0 && o.Components[last].Delete > 0 {
+		o.Components[last].Delete += n
+		return o
+	}
+	o.Components = append(o.Components, Component{Delete: n})
+	return o
+}
+
+// IsNoop reports whether the operation leaves the document unchanged.
+func (o *Operation) IsNoop() bool {
+	for _, c := range o.Components {
+		if c.Insert != "" || c.Delete > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSpliceOperation builds an operation that deletes length characters at
+// position and inserts text in their place, for a document of docLen
+// characters.
+func NewSpliceOperation(docLen, position, length int, text string) (*Operation, error) {
+	if position < 0 || length < 0 || position+length > docLen {
+		return nil, fmt.Errorf("splice %d+%d is out of range for document of length %d", position, length, docLen)
+	}
+	op := &Operation{}
+	op.Retain(position).Delete(length).Insert(text).Retain(docLen - position - length)
+	return op, nil
+}
+
+// Apply applies the operation to doc and returns the resulting text.
+func (o *Operation) Apply(doc string) (string, error) {
+	units := utf16.Encode([]rune(doc))
+	if len(units) != o.BaseLen {
+		return "", ErrBaseLengthMismatch
+	}
+	out := make([]uint16, 0, o.TargetLen)
+	i := 0
+	for _, c := range o.Components {
+		switch {
+		case c.Retain > 0:
+			out = append(out, units[i:i+c.Retain]...)
+			i += c.Retain
+		case c.Insert != "":
+			out = append(out, utf16.Encode([]rune(c.Insert))...)
+		case c.Delete > 0:
+			i += c.Delete
+		}
+	}
+	return string(utf16.Decode(out)), nil
+}
+
+// Transform takes two operations a and b that were applied concurrently to
+// the same document and returns a' and b' such that applying a then b'
+// yields the same document as applying b then a'. When both insert at the
+// same position the text from a is placed first.
+func Transform(a, b *Operation) (*Operation, *Operation, error) {
+	if a.BaseLen != b.BaseLen {
+		return nil, nil, ErrIncompatibleOps
+	}
+	aPrime, bPrime := &Operation{}, &Operation{}
+	ai, bi := newComponentIter(a), newComponentIter(b)
+	for ai.cur != nil || bi.cur != nil {
+		if ai.cur != nil && ai.cur.Insert != "" {
+			aPrime.Insert(ai.cur.Insert)
+			bPrime.Retain(textLen(ai.cur.Insert))
+			ai.next()
+			continue
+		}
+		if bi.cur != nil && bi.cur.Insert != "" {
+			aPrime.Retain(textLen(bi.cur.Insert))
+			bPrime.Insert(bi.cur.Insert)
+			bi.next()
+			continue
+		}
+		if ai.cur == nil || bi.cur == nil {
+			return nil, nil, ErrIncompatibleOps
+		}
+
+		n := min(ai.cur.Retain+ai.cur.Delete, bi.cur.Retain+bi.cur.Delete)
+		switch {
+		case ai.cur.Retain > 0 && bi.cur.Retain > 0:
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case ai.cur.Delete > 0 && bi.cur.Retain > 0:
+			aPrime.Delete(n)
+		case ai.cur.Retain > 0 && bi.cur.Delete > 0:
+			bPrime.Delete(n)
+		}
+		// Both deleting the same range needs no output on either side.
+		ai.consume(n)
+		bi.consume(n)
+	}
+	return aPrime, bPrime, nil
+}
+
+// componentIter walks the components of an operation, allowing retains and
+// deletes to be consumed partially.
+type componentIter struct {
+	ops []Component
+	i   int
+	cur *Component
+}
+
+func newComponentIter(o *Operation) *componentIter {
+	it := &componentIter{ops: o.Components}
+	it.next()
+	return it
+}
+
+func (it *componentIter) next() {
+	if it.i >= len(it.ops) {
+		it.cur = nil
+		return
+	}
+	c := it.ops[it.i]
+	it.i++
+	it.cur = &c
+}
+
+// consume takes n characters from the current retain or delete component.
+func (it *componentIter) consume(n int) {
+	if it.cur.Retain > 0 {
+		it.cur.Retain -= n
+	} else {
+		it.cur.Delete -= n
+	}
+	if it.cur.Retain == 0 && it.cur.Delete == 0 {
+		it.next()
+	}
+}
+
+// TransformPosition moves a caret position through op so that it points at
+// the same character afterwards. Inserts exactly at pos push it forward.
+func (o *Operation) TransformPosition(pos int) int {
+	index, newPos := 0, pos
+	for _, c := range o.Components {
+		if index > pos {
+			break
+		}
+		switch {
+		case c.Retain > 0:
+			index += c.Retain
+		case c.Insert != "":
+			newPos += textLen(c.Insert)
+		case c.Delete > 0:
+			newPos -= min(c.Delete, pos-index)
+			index += c.Delete
+		}
+	}
+	return newPos
+}
+
+// MarshalJSON encodes the operation in the compact ot.js form: positive
+// integers retain, negative integers delete and strings insert.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	out := make([]any, 0, len(o.Components))
+	for _, c := range o.Components {
+		switch {
+		case c.Retain > 0:
+			out = append(out, c.Retain)
+		case c.Insert != "":
+			out = append(out, c.Insert)
+		case c.Delete > 0:
+			out = append(out, -c.Delete)
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes the compact ot.js form produced by MarshalJSON.
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*o = Operation{}
+	for _, r := range raw {
+		var s string
+		if err := json.Unmarshal(r, &s); err == nil {
+			o.Insert(s)
+			continue
+		}
+		var n int
+		if err := json.Unmarshal(r, &n); err != nil {
+			return fmt.Errorf("invalid operation component %s", r)
+		}
+		switch {
+		case n > 0:
+			o.Retain(n)
+		case n < 0:
+			o.Delete(-n)
+		default:
+			return errors.New("operation component must not be zero")
+		}
+	}
+	return nil
+}
+
+// otDocument is the Merger for the OT strategy. The server is the single
+// sequencer: every edit is transformed against the operations applied since
+// the revision it was based on.
+type otDocument struct {
+	content  string
+	revision int
+	// history holds the last operations applied; history[i] turned revision
+	// revision-len(history)+i into the next one.
+	history []*Operation
+}
+
+func newOTDocument(content string) *otDocument {
+	return &otDocument{content: content}
+}
+
+func (d *otDocument) Content() string { return d.content }
+
+func (d *otDocument) Revision() int { return d.revision }
+
+func (d *otDocument) State() (json.RawMessage, error) { return nil, nil }
+
+func (d *otDocument) Reset(content string) {
+	d.content = content
+	d.revision++
+	d.history = nil
+}
+
+func (d *otDocument) TransformRange(revision, start, end int) (int, int, error) {
+	return transformRange(d.history, d.revision-len(d.history), d.content, revision, start, end)
+}
+
+func (d *otDocument) Integrate(msg *Message) (json.RawMessage, error) {
+	first := d.revision - len(d.history)
+	if msg.Revision > d.revision || msg.Revision < 0 {
+		return nil, fmt.Errorf("unknown revision %d", msg.Revision)
+	}
+	if msg.Revision < first {
+		return nil, ErrRevisionTooOld
+	}
+
+	concurrent := d.history[msg.Revision-first:]
+	baseLen := textLen(d.content)
+	if len(concurrent) > 0 {
+		baseLen = concurrent[0].BaseLen
+	}
+	op, err := d.operation(msg, baseLen)
+	if err != nil {
+		return nil, err
+	}
+	for _, applied := range concurrent {
+		if op, _, err = Transform(op, applied); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := op.Apply(d.content)
+	if err != nil {
+		return nil, err
+	}
+	d.content = content
+	d.revision++
+	d.history = append(d.history, op)
+	if len(d.history) > maxHistory {
+		d.history = d.history[len(d.history)-maxHistory:]
+	}
+	return json.Marshal(op)
+}
+
+// operation returns the edit carried by msg. Clients either send a full
+// operation in Ops or a single splice described by Position, Length and Text
+// against a document of baseLen characters.
+func (d *otDocument) operation(msg *Message, baseLen int) (*Operation, error) {
+	if len(msg.Ops) == 0 {
+		return NewSpliceOperation(baseLen, msg.Position, msg.Length, msg.Text)
+	}
+	op := &Operation{}
+	if err := json.Unmarshal(msg.Ops, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
@@ -0,0 +1,239 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// splice is a test edit: delete length characters at position, then insert
+// text there.
+type splice struct {
+	position, length int
+	text             string
+}
+
+func (s splice) operation(t *testing.T, doc string) *Operation {
+	t.Helper()
+	op, err := NewSpliceOperation(textLen(doc), s.position, s.length, s.text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+func apply(t *testing.T, op *Operation, doc string) string {
+	t.Helper()
+	out, err := op.Apply(doc)
+	if err != nil {
+		t.Fatalf("applying %v to %q: %v", op.Components, doc, err)
+	}
+	return out
+}
+
+func TestTransformConverges(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		a, b splice
+		// want is the text both orders must reach. Where a and b insert at
+		// the same position, a's text comes first.
+		want string
+	}{
+		{name: "inserts apart", doc: "abc", a: splice{0, 0, "X"}, b: splice{3, 0, "Y"}, want: "XabcY"},
+		{name: "inserts at the same position", doc: "abc", a: splice{1, 0, "X"}, b: splice{1, 0, "Y"}, want: "aXYbc"},
+		{name: "inserts into an empty document", doc: "", a: splice{0, 0, "X"}, b: splice{0, 0, "Y"}, want: "XY"},
+		{name: "insert inside a delete", doc: "abc", a: splice{0, 3, ""}, b: splice{1, 0, "X"}, want: "X"},
+		{name: "overlapping deletes", doc: "abcdef", a: splice{1, 3, ""}, b: splice{2, 3, ""}, want: "af"},
+		{name: "identical deletes", doc: "abcdef", a: splice{1, 2, ""}, b: splice{1, 2, ""}, want: "adef"},
+		{name: "delete containing a delete", doc: "abcdef", a: splice{0, 6, ""}, b: splice{2, 2, ""}, want: ""},
+		{name: "overlapping replaces", doc: "abcdef", a: splice{1, 2, "X"}, b: splice{2, 2, "Y"}, want: "aXYef"},
+		{name: "insert after a surrogate pair", doc: "a😀b", a: splice{3, 0, "X"}, b: splice{1, 2, ""}, want: "aXb"},
+		{name: "surrogate pairs on both sides", doc: "😀😀", a: splice{0, 2, ""}, b: splice{4, 0, "🎉"}, want: "😀🎉"},
+		{name: "inserted surrogate pairs", doc: "ab", a: splice{1, 0, "😀"}, b: splice{1, 1, "🎉"}, want: "a😀🎉"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := tc.a.operation(t, tc.doc), tc.b.operation(t, tc.doc)
+			aPrime, bPrime, err := Transform(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ab := apply(t, bPrime, apply(t, a, tc.doc))
+			ba := apply(t, aPrime, apply(t, b, tc.doc))
+			if ab != ba {
+				t.Fatalf("diverged: a then b' gives %q, b then a' gives %q", ab, ba)
+			}
+			if ab != tc.want {
+				t.Fatalf("converged on %q, want %q", ab, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransformRejectsDifferentBases(t *testing.T) {
+	a := (&Operation{}).Retain(3)
+	b := (&Operation{}).Retain(4)
+	if _, _, err := Transform(a, b); !errors.Is(err, ErrIncompatibleOps) {
+		t.Fatalf("got %v, want ErrIncompatibleOps", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		op   *Operation
+		want string
+		err  error
+	}{
+		{name: "splice", doc: "hello", op: (&Operation{}).Retain(1).Delete(3).Insert("ipp").Retain(1), want: "hippo"},
+		{name: "surrogate pair counts as two", doc: "a😀b", op: (&Operation{}).Retain(3).Insert("X").Retain(1), want: "a😀Xb"},
+		{name: "delete a surrogate pair", doc: "a😀b", op: (&Operation{}).Retain(1).Delete(2).Retain(1), want: "ab"},
+		{name: "too short", doc: "a😀b", op: (&Operation{}).Retain(3), err: ErrBaseLengthMismatch},
+		{name: "too long", doc: "ab", op: (&Operation{}).Retain(3), err: ErrBaseLengthMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.op.Apply(tc.doc)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransformPosition(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		edit splice
+		pos  int
+		want int
+	}{
+		{name: "insert before", doc: "abcdef", edit: splice{1, 0, "XY"}, pos: 3, want: 5},
+		{name: "insert at", doc: "abcdef", edit: splice{3, 0, "XY"}, pos: 3, want: 5},
+		{name: "insert after", doc: "abcdef", edit: splice{4, 0, "XY"}, pos: 3, want: 3},
+		{name: "delete before", doc: "abcdef", edit: splice{0, 2, ""}, pos: 3, want: 1},
+		{name: "delete across", doc: "abcdef", edit: splice{2, 3, ""}, pos: 3, want: 2},
+		{name: "delete after", doc: "abcdef", edit: splice{3, 2, ""}, pos: 3, want: 3},
+		{name: "surrogate pair inserted before", doc: "ab", edit: splice{0, 0, "😀"}, pos: 1, want: 3},
+		{name: "surrogate pair deleted before", doc: "😀ab", edit: splice{0, 2, ""}, pos: 3, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.edit.operation(t, tc.doc).TransformPosition(tc.pos); got != tc.want {
+				t.Fatalf("moved %d to %d, want %d", tc.pos, got, tc.want)
+			}
+		})
+	}
+}
+
+// otSplice is an op message with a splice against revision.
+func otSplice(revision int, s splice) *Message {
+	return &Message{Type: TypeOp, Revision: revision, Position: s.position, Length: s.length, Text: s.text}
+}
+
+func TestOTIntegrate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// applied are integrated one after the other, each against the
+		// revision before it.
+		applied []splice
+		// edit is integrated against revision.
+		revision int
+		edit     splice
+		want     string
+		err      error
+	}{
+		{name: "current revision", applied: []splice{{0, 0, "X"}}, revision: 1, edit: splice{4, 0, "Y"}, want: "XabcY"},
+		{name: "stale insert", applied: []splice{{0, 0, "X"}}, revision: 0, edit: splice{3, 0, "Y"}, want: "XabcY"},
+		{name: "stale insert at the same position", applied: []splice{{1, 0, "X"}}, revision: 0, edit: splice{1, 0, "Y"}, want: "aYXbc"},
+		{name: "stale across several", applied: []splice{{0, 0, "X"}, {3, 1, ""}, {0, 1, "Z"}}, revision: 0, edit: splice{1, 1, "B"}, want: "ZaB"},
+		{name: "stale delete of deleted text", applied: []splice{{0, 2, ""}}, revision: 0, edit: splice{1, 2, ""}, want: ""},
+		{name: "future revision", revision: 1, edit: splice{0, 0, "Y"}, err: errors.New("unknown revision 1")},
+		{name: "out of range", revision: 0, edit: splice{2, 2, ""}, err: errors.New("splice 2+2 is out of range for document of length 3")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := newOTDocument("abc")
+			for i, s := range tc.applied {
+				if _, err := doc.Integrate(otSplice(i, s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := doc.Integrate(otSplice(tc.revision, tc.edit))
+			if fmt.Sprint(err) != fmt.Sprint(tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if doc.Content() != tc.want || doc.Revision() != len(tc.applied)+1 {
+				t.Fatalf("got %q at revision %d, want %q at revision %d", doc.Content(), doc.Revision(), tc.want, len(tc.applied)+1)
+			}
+		})
+	}
+}
+
+func TestOTIntegrateBeyondHistory(t *testing.T) {
+	doc := newOTDocument("")
+	for i := range maxHistory + 1 {
+		if _, err := doc.Integrate(otSplice(i, splice{i, 0, "x"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := doc.Integrate(otSplice(0, splice{0, 0, "y"})); !errors.Is(err, ErrRevisionTooOld) {
+		t.Fatalf("got %v, want ErrRevisionTooOld", err)
+	}
+	// The oldest revision still in the history can be transformed.
+	if _, err := doc.Integrate(otSplice(1, splice{0, 0, "y"})); err != nil {
+		t.Fatal(err)
+	}
+	if want := "y" + strings.Repeat("x", maxHistory+1); doc.Content() != want {
+		t.Fatalf("got %d characters, want %d starting with y", textLen(doc.Content()), textLen(want))
+	}
+
+	// Resetting drops the history altogether.
+	doc.Reset("abc")
+	if _, err := doc.Integrate(otSplice(doc.Revision()-1, splice{0, 0, "y"})); !errors.Is(err, ErrRevisionTooOld) {
+		t.Fatalf("got %v after a reset, want ErrRevisionTooOld", err)
+	}
+}
+
+func TestRoomTransformsStaleOps(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice", "bob")
+	if err := storage.Member.Set(context.Background(), &store.Member{DocID: doc.DocID, UserID: users[1].ID, Role: store.RoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+	hub, srv := newTestHub(t, storage, NewMemoryBroker())
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	bob, _ := dial(t, srv, doc.DocID, users[1].ID, store.RoleEditor)
+
+	// Both edit revision 0; bob's arrives second and is transformed.
+	alice.splice(0, 1, 0, "X")
+	alice.expect(TypeAck)
+	bob.expect(TypeOp)
+	bob.splice(0, 1, 1, "Y")
+	if msg := bob.expect(TypeAck); msg.Revision != 2 {
+		t.Fatalf("acked revision %d, want 2", msg.Revision)
+	}
+
+	// alice reaches the same text by applying the relayed op.
+	relay := alice.expect(TypeOp)
+	op := &Operation{}
+	if err := op.UnmarshalJSON(relay.Ops); err != nil {
+		t.Fatal(err)
+	}
+	got := apply(t, op, "aXbc")
+	content, err := hub.Content(context.Background(), doc.DocID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != content || content != "aYXc" {
+		t.Fatalf("alice has %q and the room %q, want %q", got, content, "aYXc")
+	}
+}
@@ -0,0 +1,292 @@
+// internal/websocket/persister.go
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+const (
+	persistRetryMin = 250 * time.Millisecond
+	persistRetryMax = 30 * time.Second
+)
+
+// snapshot is a document's content as of a room revision, and its merge
+// state once the room has supplied it.
+type snapshot struct {
+	revision int
+	content  string
+	state    []byte
+	userID   int64
+}
+
+// persister writes a room's content behind the edits. Saves are debounced
+// so a burst of typing becomes one write, and since a single goroutine does
+// the writing in revision order, an older content can never land after a
+// newer one. A burst only merges edits by the same user: when the editor
+// changes, the previous editor's snapshot is kept and written first, so
+// every revision is credited to whoever made it. Failed writes are retried
+// with exponential backoff until they succeed.
+//
+// For documents that keep a merge state, encoding it is left until a write
+// is due: the persister asks for it on stateDue and the room hands it over
+// with SaveState. Only the last snapshot of a write carries it; the others
+// leave the stored state alone.
+type persister struct {
+	docID      string
+	storage    *store.Storage
+	debounce   time.Duration
+	maxDelay   time.Duration
+	keepsState bool
+	stateDue   chan struct{}
+
+	mu sync.Mutex
+	// pending holds the snapshots not yet written, oldest first, with
+	// consecutive ones by different users.
+	pending []*snapshot
+	saved   int
+
+	wake    chan struct{}
+	flushes chan chan error
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newPersister(docID string, storage *store.Storage, config Config, keepsState bool) *persister {
+	p := &persister{
+		docID:      docID,
+		storage:    storage,
+		debounce:   config.PersistDebounce,
+		maxDelay:   config.PersistMaxDelay,
+		keepsState: keepsState,
+		stateDue:   make(chan struct{}, 1),
+		wake:       make(chan struct{}, 1),
+		flushes:    make(chan chan error),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Save queues content as of revision to be written. Older snapshots than
+// the ones already queued are ignored. A newer snapshot by the same user
+// as the last queued one replaces it.
+func (p *persister) Save(revision int, content string, userID int64) {
+	p.mu.Lock()
+	last := len(p.pending) - 1
+	if revision <= p.saved || (last >= 0 && revision <= p.pending[last].revision) {
+		p.mu.Unlock()
+		return
+	}
+	snap := &snapshot{revision: revision, content: content, userID: userID}
+	switch {
+	case last < 0:
+		persistPending.Add(1)
+		p.pending = append(p.pending, snap)
+	case p.pending[last].userID == userID:
+		p.pending[last] = snap
+	default:
+		p.pending = append(p.pending, snap)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SaveState supplies the merge state as of revision, for the last queued
+// snapshot if it is still of that revision.
+func (p *persister) SaveState(revision int, state []byte) {
+	if !p.keepsState {
+		return
+	}
+	p.mu.Lock()
+	if last := len(p.pending) - 1; last >= 0 && p.pending[last].revision == revision {
+		p.pending[last].state = state
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes whatever is queued right away and waits for it. The last
+// snapshot goes without a merge state unless the room supplied it first.
+func (p *persister) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case p.flushes <- reply:
+	case <-p.done:
+		return ErrRoomClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop ends the writer goroutine, dropping anything not flushed.
+func (p *persister) Stop() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+	p.mu.Lock()
+	if len(p.pending) > 0 {
+		p.pending = nil
+		persistPending.Add(-1)
+	}
+	p.mu.Unlock()
+}
+
+func (p *persister) run() {
+	defer close(p.done)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	var deadline time.Time
+	backoff := time.Duration(0)
+
+	for {
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return
+
+		case <-p.wake:
+			// Wait for typing to pause, but never longer than maxDelay
+			// since the first unsaved edit, and not at all once someone
+			// else has taken over. Retries keep their backoff.
+			if backoff > 0 {
+				continue
+			}
+			now := time.Now()
+			if deadline.IsZero() {
+				deadline = now.Add(p.maxDelay)
+			}
+			if p.ready() {
+				deadline = now
+			}
+			timer.Reset(min(p.debounce, max(deadline.Sub(now), 0)))
+
+		case <-timer.C:
+			if p.awaitingState() {
+				select {
+				case p.stateDue <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if err := p.write(context.Background()); err != nil {
+				backoff = min(max(2*backoff, persistRetryMin), persistRetryMax)
+				log.Printf("Failed to persist document %s, retrying in %s: %v", p.docID, backoff, err)
+				timer.Reset(backoff)
+				continue
+			}
+			deadline, backoff = time.Time{}, 0
+
+		case reply := <-p.flushes:
+			timer.Stop()
+			err := p.write(context.Background())
+			if err == nil {
+				deadline, backoff = time.Time{}, 0
+			} else {
+				backoff = min(max(2*backoff, persistRetryMin), persistRetryMax)
+				timer.Reset(backoff)
+			}
+			reply <- err
+		}
+	}
+}
+
+func (p *persister) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+// ready reports whether the queue should be written without waiting for
+// typing to pause: someone else has taken over, or the room has just
+// supplied the state it was asked for.
+func (p *persister) ready() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending) > 1 || (p.keepsState && len(p.pending) == 1 && p.pending[0].state != nil)
+}
+
+// awaitingState reports whether the last snapshot is still missing the
+// merge state it should be written with.
+func (p *persister) awaitingState() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last := len(p.pending) - 1
+	return p.keepsState && last >= 0 && p.pending[last].state == nil
+}
+
+// write stores the pending snapshots, oldest first, and stops at the first
+// that fails.
+func (p *persister) write(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		var snap *snapshot
+		if len(p.pending) > 0 {
+			snap = p.pending[0]
+		}
+		p.mu.Unlock()
+		if snap == nil {
+			return nil
+		}
+		if err := p.writeSnapshot(ctx, snap); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.saved = snap.revision
+		// Stop may have dropped the queue in the meantime.
+		if len(p.pending) > 0 && p.pending[0] == snap {
+			p.pending = p.pending[1:]
+			if len(p.pending) == 0 {
+				p.pending = nil
+				persistPending.Add(-1)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *persister) writeSnapshot(ctx context.Context, snap *snapshot) error {
+	ctx, cancel := context.WithTimeout(ctx, store.QueryTimeoutDuration)
+	defer cancel()
+	var err error
+	if snap.state != nil {
+		_, err = p.storage.Document.UpdateDocumentWithState(ctx, p.docID, snap.content, snap.state, snap.userID)
+	} else {
+		_, err = p.storage.Document.UpdateDocument(ctx, p.docID, snap.content, snap.userID)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		// The document is gone; there is nothing left to save it to.
+		log.Printf("Dropping unsaved changes to deleted document %s", p.docID)
+		err = nil
+	}
+	if err != nil {
+		persistFailures.Add(1)
+		return err
+	}
+	persistFlushes.Add(1)
+	return nil
+}
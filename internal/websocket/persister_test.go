@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// newTestStorage returns a memory storage with a user for every name and
+// a document owned by the first, which is returned with it.
+func newTestStorage(t *testing.T, strategy, content string, names ...string) (*store.Storage, *store.Document, []*store.User) {
+	t.Helper()
+	ctx := context.Background()
+	storage := store.NewMemoryStorage()
+	users := make([]*store.User, len(names))
+	for i, name := range names {
+		users[i] = &store.User{Username: name, Email: name + "@example.com"}
+		if err := storage.User.Create(ctx, users[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	doc := &store.Document{DocID: "doc", Content: content, MergeStrategy: strategy}
+	if err := storage.Document.CreateDocument(ctx, doc, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	return &storage, doc, users
+}
+
+func TestPersisterCreditsEveryEditor(t *testing.T) {
+	storage, doc, users := newTestStorage(t, "ot", "", "alice", "bob")
+	alice, bob := users[0].ID, users[1].ID
+	p := newPersister(doc.DocID, storage, Config{PersistDebounce: time.Hour, PersistMaxDelay: time.Hour}, false)
+	defer p.Stop()
+
+	p.Save(1, "a", alice)
+	p.Save(2, "ab", alice)
+	p.Save(3, "abc", bob)
+	p.Save(4, "abcd", bob)
+	p.Save(5, "abcde", alice)
+	p.Save(4, "stale", bob)
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := storage.Revision.List(context.Background(), doc.DocID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		content string
+		userID  int64
+	}{{"abcde", alice}, {"abcd", bob}, {"ab", alice}, {"", alice}}
+	if len(revisions) != len(want) {
+		t.Fatalf("got %d revisions, want %d", len(revisions), len(want))
+	}
+	for i, w := range want {
+		rev, err := storage.Revision.Get(context.Background(), doc.DocID, revisions[i].Revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev.Content != w.content || *rev.UserID != w.userID {
+			t.Errorf("revision %d is %q by %d, want %q by %d", rev.Revision, rev.Content, *rev.UserID, w.content, w.userID)
+		}
+	}
+}
+
+func TestPersisterWritesPromptlyWhenTheEditorChanges(t *testing.T) {
+	storage, doc, users := newTestStorage(t, "ot", "", "alice", "bob")
+	p := newPersister(doc.DocID, storage, Config{PersistDebounce: time.Hour, PersistMaxDelay: time.Hour}, false)
+	defer p.Stop()
+
+	p.Save(1, "a", users[0].ID)
+	p.Save(2, "ab", users[1].ID)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.queued() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("snapshots by two editors were not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPersisterAsksForTheStateWhenItWrites(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyCRDT, "", "alice")
+	p := newPersister(doc.DocID, storage, Config{PersistDebounce: time.Millisecond, PersistMaxDelay: time.Hour}, true)
+	defer p.Stop()
+
+	p.Save(1, "a", users[0].ID)
+	select {
+	case <-p.stateDue:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the persister did not ask for the state")
+	}
+	if stored, err := storage.Document.GetDocumentByDocID(context.Background(), doc.DocID); err != nil || stored.Content != "" {
+		t.Fatalf("written before the state arrived: %v, %v", stored, err)
+	}
+
+	// A state for an older revision than the queued one is not used.
+	p.SaveState(0, []byte(`["stale"]`))
+	state := []byte(`[{"id":{"clock":1,"site":"1"},"value":"a"}]`)
+	p.SaveState(1, state)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.queued() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the snapshot was not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stored, err := storage.Document.GetDocumentByDocID(context.Background(), doc.DocID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Content != "a" || string(stored.MergeState) != string(state) {
+		t.Fatalf("stored %q with state %s", stored.Content, stored.MergeState)
+	}
+}
@@ -0,0 +1,119 @@
+// internal/websocket/presence.go
+package websocket
+
+import (
+	"cmp"
+	"log"
+	"slices"
+)
+
+// Presence events, carried in the Event field of presence messages. Clients
+// send idle and active themselves; join and leave come from the server when
+// a user's first connection arrives or their last one goes.
+const (
+	PresenceJoin   = "join"
+	PresenceLeave  = "leave"
+	PresenceIdle   = "idle"
+	PresenceActive = "active"
+)
+
+// Presence describes a user connected to a room. A user is idle only when
+// every one of their connections is.
+type Presence struct {
+	UserID      int64  `json:"user_id"`
+	Username    string `json:"username"`
+	Idle        bool   `json:"idle"`
+	Connections int    `json:"connections"`
+}
+
+// Presence returns who is connected to the room, ordered by user ID.
+func (r *Room) Presence() []Presence {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.roster()
+}
+
+// roster lists the room's users. r.Mu must be held.
+func (r *Room) roster() []Presence {
+	byUser := make(map[int64]*Presence)
+	for client := range r.Clients {
+		p, ok := byUser[client.UserID]
+		if !ok {
+			p = &Presence{UserID: client.UserID, Username: client.Username, Idle: true}
+			byUser[client.UserID] = p
+		}
+		p.Connections++
+		p.Idle = p.Idle && client.idle
+	}
+	users := make([]Presence, 0, len(byUser))
+	for _, p := range byUser {
+		users = append(users, *p)
+	}
+	slices.SortFunc(users, func(a, b Presence) int { return cmp.Compare(a.UserID, b.UserID) })
+	return users
+}
+
+// userPresence returns the presence of one user, and false if they have no
+// connection left. r.Mu must be held.
+func (r *Room) userPresence(userID int64) (Presence, bool) {
+	p := Presence{UserID: userID, Idle: true}
+	for client := range r.Clients {
+		if client.UserID == userID {
+			p.Username = client.Username
+			p.Connections++
+			p.Idle = p.Idle && client.idle
+		}
+	}
+	return p, p.Connections > 0
+}
+
+// joined announces client's user to everyone else if this is their first
+// connection to the room.
+func (r *Room) joined(client *Client) {
+	r.Mu.Lock()
+	p, _ := r.userPresence(client.UserID)
+	r.Mu.Unlock()
+	if p.Connections == 1 {
+		r.announce(client, PresenceJoin, client)
+	}
+}
+
+// left announces that client's user has gone once their last connection
+// to the room has.
+func (r *Room) left(client *Client) {
+	r.Mu.Lock()
+	_, connected := r.userPresence(client.UserID)
+	r.Mu.Unlock()
+	if !connected {
+		r.announce(client, PresenceLeave, nil)
+	}
+}
+
+// setIdle records whether client is idle and announces the change if it
+// changes whether its user as a whole is.
+func (r *Room) setIdle(client *Client, idle bool) {
+	r.Mu.Lock()
+	before, _ := r.userPresence(client.UserID)
+	client.idle = idle
+	after, _ := r.userPresence(client.UserID)
+	r.Mu.Unlock()
+	if before.Idle == after.Idle {
+		return
+	}
+	event := PresenceActive
+	if after.Idle {
+		event = PresenceIdle
+	}
+	r.announce(client, event, client)
+}
+
+// announce broadcasts a presence event about client's user to everyone
+// except skip.
+func (r *Room) announce(client *Client, event string, skip *Client) {
+	msg := r.newMessage(TypePresence, client.userTag())
+	msg.Username = client.Username
+	msg.Event = event
+	if err := r.broadcast(msg, skip); err != nil {
+		log.Printf("Error announcing presence in room %s: %v", r.ID, err)
+	}
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// expectPresence reads the next presence message, skipping cursors, and
+// checks that it reports event for userID.
+func (c *testConn) expectPresence(event string, userID int64) *Message {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("waiting for presence %s: %v", event, err)
+		}
+		if msg.Type == TypeCursor {
+			continue
+		}
+		if msg.Type != TypePresence || msg.Event != event || msg.UserID != (&Client{UserID: userID}).userTag() {
+			c.t.Fatalf("got %s message %q from %s, want presence %s from %d", msg.Type, msg.Event, msg.UserID, event, userID)
+		}
+		return &msg
+	}
+}
+
+func TestPresence(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice", "bob")
+	alice, bob := users[0], users[1]
+	if err := storage.Member.Set(context.Background(), &store.Member{DocID: doc.DocID, UserID: bob.ID, Role: store.RoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+	hub, srv := newTestHub(t, storage, NewMemoryBroker())
+	presence := func() []Presence {
+		t.Helper()
+		users, err := hub.Presence(context.Background(), doc.DocID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return users
+	}
+
+	aliceConn, sync := dial(t, srv, doc.DocID, alice.ID, store.RoleOwner)
+	if len(sync.Users) != 1 || sync.Users[0].UserID != alice.ID {
+		t.Fatalf("alice's sync lists %+v, want only alice", sync.Users)
+	}
+
+	bobConn, sync := dial(t, srv, doc.DocID, bob.ID, store.RoleEditor)
+	if len(sync.Users) != 2 {
+		t.Fatalf("bob's sync lists %+v, want alice and bob", sync.Users)
+	}
+	if msg := aliceConn.expectPresence(PresenceJoin, bob.ID); msg.Username != "bob" {
+		t.Fatalf("bob joined as %q", msg.Username)
+	}
+
+	// A second connection of bob's is not announced, and bob is only idle
+	// once both connections are.
+	bobPhone, _ := dial(t, srv, doc.DocID, bob.ID, store.RoleEditor)
+	bobConn.send(&Message{Type: TypePresence, Event: PresenceIdle})
+	bobPhone.send(&Message{Type: TypePresence, Event: PresenceIdle})
+	aliceConn.expectPresence(PresenceIdle, bob.ID)
+	want := []Presence{
+		{UserID: alice.ID, Username: "alice", Connections: 1},
+		{UserID: bob.ID, Username: "bob", Idle: true, Connections: 2},
+	}
+	if got := presence(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("presence is %+v, want %+v", got, want)
+	}
+
+	// Editing makes bob active again.
+	bobPhone.splice(0, 3, 0, "d")
+	aliceConn.expectPresence(PresenceActive, bob.ID)
+	aliceConn.expect(TypeOp)
+
+	// bob leaves with their last connection.
+	bobPhone.conn.Close()
+	bobConn.conn.Close()
+	aliceConn.expectPresence(PresenceLeave, bob.ID)
+	if got := presence(); len(got) != 1 || got[0].UserID != alice.ID {
+		t.Fatalf("presence is %+v after bob left, want only alice", got)
+	}
+}
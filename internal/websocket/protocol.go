@@ -0,0 +1,125 @@
+// internal/websocket/protocol.go
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// ProtocolVersion is the newest protocol version the server speaks, and
+// MinProtocolVersion the oldest it still accepts.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Error codes carried by error messages.
+const (
+	CodeBadMessage         = "bad_message"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeReadOnly           = "read_only"
+	CodeResyncRequired     = "resync_required"
+	CodePending            = "pending"
+	CodeRejected           = "rejected"
+	CodeNotFound           = "not_found"
+	CodeUnavailable        = "unavailable"
+	CodeInternal           = "internal"
+)
+
+var ErrUnsupportedVersion = errors.New("no supported protocol version offered")
+
+// ProtocolError is a message from the client the server could not accept.
+type ProtocolError struct {
+	Code string
+	Err  error
+}
+
+func (e *ProtocolError) Error() string { return e.Err.Error() }
+
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+func badMessage(format string, args ...any) error {
+	return &ProtocolError{Code: CodeBadMessage, Err: fmt.Errorf(format, args...)}
+}
+
+// errorCode picks the code an error is reported to the client with.
+func errorCode(err error) string {
+	var protoErr *ProtocolError
+	switch {
+	case errors.As(err, &protoErr):
+		return protoErr.Code
+	case errors.Is(err, ErrReadOnly):
+		return CodeReadOnly
+	case errors.Is(err, ErrOpsPending):
+		return CodePending
+	case errors.Is(err, ErrRevisionTooOld), errors.Is(err, ErrTooManyPendingOps):
+		return CodeResyncRequired
+	case errors.Is(err, store.ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrShuttingDown), errors.Is(err, ErrRoomClosed):
+		return CodeUnavailable
+	default:
+		return CodeRejected
+	}
+}
+
+// DecodeMessage strictly decodes a message sent by a client for the room
+// of docID: unknown fields, trailing data, unknown types and messages meant
+// for another document are all rejected with a ProtocolError.
+func DecodeMessage(data []byte, docID string) (*Message, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var msg Message
+	if err := dec.Decode(&msg); err != nil {
+		return nil, badMessage("invalid message: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, badMessage("invalid message: unexpected data after message")
+	}
+	if msg.DocID != "" && msg.DocID != docID {
+		return nil, badMessage("message is for document %q, not %q", msg.DocID, docID)
+	}
+
+	switch msg.Type {
+	case TypeHello:
+		if len(msg.Versions) == 0 {
+			return nil, badMessage("hello must list the protocol versions supported")
+		}
+	case TypeOp:
+		if msg.Revision < 0 {
+			return nil, badMessage("revision must not be negative")
+		}
+		if len(msg.Ops) == 0 && (msg.Position < 0 || msg.Length < 0) {
+			return nil, badMessage("position and length must not be negative")
+		}
+	case TypeCursor:
+		if msg.Revision < 0 || msg.Position < 0 || msg.Length < 0 {
+			return nil, badMessage("cursor revision, position and length must not be negative")
+		}
+	case TypePresence:
+		if msg.Event != PresenceIdle && msg.Event != PresenceActive {
+			return nil, badMessage("presence event must be %q or %q", PresenceIdle, PresenceActive)
+		}
+	case "":
+		return nil, badMessage("message type is missing")
+	default:
+		return nil, badMessage("unexpected message type %q", msg.Type)
+	}
+	return &msg, nil
+}
+
+// negotiateVersion picks the newest version offered that the server speaks.
+func negotiateVersion(offered []int) (int, error) {
+	for v := ProtocolVersion; v >= MinProtocolVersion; v-- {
+		if slices.Contains(offered, v) {
+			return v, nil
+		}
+	}
+	return 0, &ProtocolError{Code: CodeUnsupportedVersion, Err: ErrUnsupportedVersion}
+}
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		// code is the ProtocolError code wanted, if any.
+		code string
+	}{
+		{name: "hello", data: `{"type":"hello","versions":[1]}`},
+		{name: "op", data: `{"type":"op","docID":"doc","revision":3,"position":1,"text":"x"}`},
+		{name: "presence", data: `{"type":"presence","event":"idle"}`},
+		{name: "cursor", data: `{"type":"cursor","revision":0,"position":2}`},
+		{name: "hello without versions", data: `{"type":"hello"}`, code: CodeBadMessage},
+		{name: "unknown field", data: `{"type":"op","colour":"red"}`, code: CodeBadMessage},
+		{name: "trailing data", data: `{"type":"op"}{}`, code: CodeBadMessage},
+		{name: "not json", data: `op`, code: CodeBadMessage},
+		{name: "another document", data: `{"type":"op","docID":"other"}`, code: CodeBadMessage},
+		{name: "negative revision", data: `{"type":"op","revision":-1}`, code: CodeBadMessage},
+		{name: "negative position", data: `{"type":"op","position":-1}`, code: CodeBadMessage},
+		{name: "negative cursor", data: `{"type":"cursor","length":-1}`, code: CodeBadMessage},
+		{name: "unknown presence event", data: `{"type":"presence","event":"away"}`, code: CodeBadMessage},
+		{name: "missing type", data: `{}`, code: CodeBadMessage},
+		{name: "unknown type", data: `{"type":"sync"}`, code: CodeBadMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeMessage([]byte(tc.data), "doc")
+			if tc.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var protoErr *ProtocolError
+			if !errors.As(err, &protoErr) || protoErr.Code != tc.code {
+				t.Fatalf("got %v, want a %s ProtocolError", err, tc.code)
+			}
+		})
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if v, err := negotiateVersion([]int{ProtocolVersion + 1, ProtocolVersion, MinProtocolVersion}); err != nil || v != ProtocolVersion {
+		t.Fatalf("negotiated %d (%v), want %d", v, err, ProtocolVersion)
+	}
+	if _, err := negotiateVersion([]int{ProtocolVersion + 1}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("got %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice")
+	cfg := testConfig
+	cfg.HandshakeTimeout = 50 * time.Millisecond
+	_, srv := newTestHubWithConfig(t, storage, NewMemoryBroker(), cfg)
+	connect := func() *testConn {
+		return dialRaw(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	}
+
+	t.Run("negotiates a version", func(t *testing.T) {
+		c := connect()
+		c.send(&Message{Type: TypeHello, Versions: []int{ProtocolVersion + 1, ProtocolVersion}})
+		if msg := c.expect(TypeHello); msg.Version != ProtocolVersion {
+			t.Fatalf("agreed on version %d, want %d", msg.Version, ProtocolVersion)
+		}
+		c.expect(TypeSync)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		c := connect()
+		c.send(&Message{Type: TypeHello, Versions: []int{ProtocolVersion + 1}})
+		if msg := c.expect(TypeError); msg.Code != CodeUnsupportedVersion {
+			t.Fatalf("got error %q, want %q", msg.Code, CodeUnsupportedVersion)
+		}
+		c.expectClose(CloseUnsupportedVersion)
+	})
+
+	t.Run("no hello", func(t *testing.T) {
+		c := connect()
+		c.splice(0, 0, 0, "x")
+		if msg := c.expect(TypeError); msg.Code != CodeBadMessage {
+			t.Fatalf("got error %q, want %q", msg.Code, CodeBadMessage)
+		}
+		c.expectClose(ClosePolicyViolation)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c := connect()
+		c.expectClose(websocket.CloseAbnormalClosure)
+	})
+
+	t.Run("second hello", func(t *testing.T) {
+		c, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+		c.send(&Message{Type: TypeHello, Versions: []int{ProtocolVersion}})
+		if msg := c.expect(TypeError); msg.Code != CodeBadMessage {
+			t.Fatalf("got error %q, want %q", msg.Code, CodeBadMessage)
+		}
+		// The connection survives a bad message.
+		c.splice(0, 3, 0, "d")
+		c.expect(TypeAck)
+	})
+}
@@ -0,0 +1,139 @@
+// internal/websocket/queue.go
+package websocket
+
+import "sync"
+
+// Slow-consumer policies, applied when a client's send queue is full.
+const (
+	// SlowConsumerResync drops what the client has queued and sends it a
+	// fresh sync in its place.
+	SlowConsumerResync = "resync"
+	// SlowConsumerDisconnect closes the connection with CloseSlowConsumer.
+	SlowConsumerDisconnect = "disconnect"
+)
+
+type queuedMessage struct {
+	msgType string
+	data    []byte
+}
+
+// sendQueue is a client's outbound queue. Pushing never blocks, so one slow
+// client cannot hold up the room; instead the queue reports when it is full
+// and the room applies its slow-consumer policy.
+//
+// A sync carries the whole document, so queuing one discards any sync, op,
+// ack or cursor still waiting to be written: the client would only throw
+// them away, and cursors based on the old content would point at the
+// wrong text.
+type sendQueue struct {
+	mu     sync.Mutex
+	items  []queuedMessage
+	limit  int
+	closed bool
+	// code and reason, if code is set, are sent as a close frame once the
+	// queue is closed.
+	code   int
+	reason string
+	ready  chan struct{}
+}
+
+func newSendQueue(limit int) *sendQueue {
+	return &sendQueue{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// push appends a message. It returns false if the queue is full or closed.
+func (q *sendQueue) push(msgType string, data []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.items) >= q.limit {
+		return false
+	}
+	q.items = append(q.items, queuedMessage{msgType: msgType, data: data})
+	q.notify()
+	return true
+}
+
+// pushSync appends a sync, dropping the document messages it supersedes.
+// It always fits unless the queue is closed.
+func (q *sendQueue) pushSync(data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	kept := q.items[:0]
+	for _, item := range q.items {
+		switch item.msgType {
+		case TypeSync, TypeOp, TypeAck, TypeCursor:
+			syncsCoalesced.Add(1)
+		default:
+			kept = append(kept, item)
+		}
+	}
+	clear(q.items[len(kept):])
+	q.items = append(kept, queuedMessage{msgType: TypeSync, data: data})
+	q.notify()
+}
+
+// pop removes the oldest message. ok is false when the queue is empty.
+func (q *sendQueue) pop() (data []byte, ok bool) {
+	item, ok := q.next()
+	return item.data, ok
+}
+
+// next is pop for callers that also need the message type.
+func (q *sendQueue) next() (queuedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return queuedMessage{}, false
+	}
+	item := q.items[0]
+	q.items[0] = queuedMessage{}
+	q.items = q.items[1:]
+	return item, true
+}
+
+// close stops the queue. Messages already queued are still written.
+func (q *sendQueue) close() {
+	q.closeWith(0, "")
+}
+
+// closeWith stops the queue, discarding whatever is queued, and has the
+// writer send a close frame with code and reason.
+func (q *sendQueue) closeWith(code int, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	if code != 0 {
+		q.items = nil
+		q.code, q.reason = code, reason
+	}
+	q.notify()
+}
+
+// closing reports whether the queue has been closed and, if so, the close
+// frame to send.
+func (q *sendQueue) closing() (closed bool, code int, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed, q.code, q.reason
+}
+
+// depth returns the number of messages waiting to be written.
+func (q *sendQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// notify wakes the writer. q.mu must be held.
+func (q *sendQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
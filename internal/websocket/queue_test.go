@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// queued returns the types of the messages waiting in q, emptying it.
+func queued(q *sendQueue) []string {
+	var types []string
+	for {
+		item, ok := q.next()
+		if !ok {
+			return types
+		}
+		types = append(types, item.msgType)
+	}
+}
+
+func TestSendQueueIsBounded(t *testing.T) {
+	q := newSendQueue(2)
+	if !q.push(TypeOp, nil) || !q.push(TypeOp, nil) {
+		t.Fatal("queue refused a message below its limit")
+	}
+	if q.push(TypeOp, nil) {
+		t.Fatal("queue took a message beyond its limit")
+	}
+	// A sync always fits, replacing the ops it supersedes.
+	q.pushSync(nil)
+	if got := queued(q); !slices.Equal(got, []string{TypeSync}) {
+		t.Fatalf("queued %v, want a single sync", got)
+	}
+}
+
+func TestSendQueueSyncSupersedesDocumentMessages(t *testing.T) {
+	q := newSendQueue(10)
+	for _, msgType := range []string{TypeOp, TypePresence, TypeAck, TypeSync, TypeCursor, TypeRole, TypeError} {
+		q.push(msgType, nil)
+	}
+	q.pushSync(nil)
+	want := []string{TypePresence, TypeRole, TypeError, TypeSync}
+	if got := queued(q); !slices.Equal(got, want) {
+		t.Fatalf("queued %v, want %v", got, want)
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	q := newSendQueue(10)
+	q.push(TypeOp, nil)
+	q.close()
+	if q.push(TypeOp, nil) {
+		t.Fatal("closed queue took a message")
+	}
+	if closed, code, _ := q.closing(); !closed || code != 0 {
+		t.Fatalf("closing() = %v, %d, want closed without a close frame", closed, code)
+	}
+	if got := queued(q); len(got) != 1 {
+		t.Fatalf("close dropped queued messages, leaving %v", got)
+	}
+
+	q = newSendQueue(10)
+	q.push(TypeOp, nil)
+	q.closeWith(CloseSlowConsumer, "client too slow")
+	if closed, code, _ := q.closing(); !closed || code != CloseSlowConsumer {
+		t.Fatalf("closing() = %v, %d, want closed with %d", closed, code, CloseSlowConsumer)
+	}
+	if got := queued(q); len(got) != 0 {
+		t.Fatalf("closeWith kept %v", got)
+	}
+}
+
+// newSlowRoom returns a room on "abc" with one client, whose queue holds
+// two messages and who is treated according to policy when it is full.
+func newSlowRoom(t *testing.T, policy string) (*Room, *Client) {
+	t.Helper()
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice")
+	room, err := NewRoom(doc, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig
+	cfg.SendQueueSize, cfg.SlowConsumerPolicy = 2, policy
+	client := &Client{UserID: users[0].ID, Role: store.RoleOwner, config: cfg, queue: newSendQueue(cfg.SendQueueSize)}
+	room.Clients[client] = true
+	return room, client
+}
+
+func TestSlowConsumerIsResynced(t *testing.T) {
+	room, client := newSlowRoom(t, SlowConsumerResync)
+	for range 3 {
+		room.send(client, room.newMessage(TypeOp, "1"))
+	}
+	item, ok := client.queue.next()
+	if !ok || item.msgType != TypeSync {
+		t.Fatalf("queued %q, want a sync in place of the ops", item.msgType)
+	}
+	var sync Message
+	if err := json.Unmarshal(item.data, &sync); err != nil {
+		t.Fatal(err)
+	}
+	if sync.Text != "abc" {
+		t.Fatalf("resynced to %q, want %q", sync.Text, "abc")
+	}
+	if _, ok := client.queue.next(); ok {
+		t.Fatal("more than the sync was queued")
+	}
+	if !room.Clients[client] {
+		t.Fatal("resynced client was removed from the room")
+	}
+}
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	room, client := newSlowRoom(t, SlowConsumerDisconnect)
+	for range 3 {
+		room.send(client, room.newMessage(TypeOp, "1"))
+	}
+	if closed, code, _ := client.queue.closing(); !closed || code != CloseSlowConsumer {
+		t.Fatalf("closing() = %v, %d, want closed with %d", closed, code, CloseSlowConsumer)
+	}
+	if room.Clients[client] {
+		t.Fatal("disconnected client is still in the room")
+	}
+}
@@ -0,0 +1,410 @@
+// internal/websocket/remote.go
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// followerTimeoutBeats is how many heartbeats a follower waits to hear
+// from the owner before it presumes it gone.
+const followerTimeoutBeats = 3
+
+// errNotOwner is returned for edits made through a follower room. The hub
+// sends those to the owner instead, so it is never seen outside.
+var errNotOwner = errors.New("room does not own its document")
+
+// follower is the state of a room whose document is owned by another
+// instance. It holds no copy of the document: its clients' messages are
+// forwarded to the owner, which sends back what to deliver to each of them.
+type follower struct {
+	// conns are the room's clients by connection ID.
+	conns map[string]*Client
+	// outbox holds envelopes for the owner, in order, for sendToOwner.
+	outbox    chan *envelope
+	lastHeard time.Time
+	// overflow is signalled when envelopes from the owner had to be
+	// dropped because inbox was full.
+	overflow chan struct{}
+}
+
+// newFollowerRoom creates a room that forwards its clients to the owner of
+// docID on another instance.
+func newFollowerRoom(docID string, h *Hub) *Room {
+	r := &Room{
+		ID:          docID,
+		Clients:     make(map[*Client]bool),
+		Broadcast:   make(chan BroadcastMessage),
+		Register:    make(chan *Client),
+		Unregister:  make(chan *Client),
+		Storage:     h.Storage,
+		edits:       make(chan editRequest),
+		roles:       make(chan roleRequest),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		hub:         h,
+		idleTimeout: h.Config.RoomIdleTimeout,
+		heartbeat:   h.Config.OwnerHeartbeat,
+		inbox:       make(chan *envelope, subscriptionBuffer),
+		follower: &follower{
+			conns:    make(map[string]*Client),
+			outbox:   make(chan *envelope, subscriptionBuffer),
+			overflow: make(chan struct{}, 1),
+		},
+	}
+	go r.sendToOwner()
+	return r
+}
+
+// runFollower is Run for follower rooms.
+func (r *Room) runFollower() {
+	f := r.follower
+	defer close(f.outbox)
+	var checkC <-chan time.Time
+	if r.heartbeat > 0 {
+		check := time.NewTicker(r.heartbeat)
+		defer check.Stop()
+		checkC = check.C
+	}
+	r.checkIdle()
+	for {
+		select {
+		case <-r.idleC():
+			r.hub.remove(r)
+			return
+
+		case <-r.quit:
+			r.Mu.Lock()
+			for client := range r.Clients {
+				client.closeWith(r.closeCode, r.closeReason)
+				r.dropConn(client, 0, "")
+			}
+			r.Mu.Unlock()
+			return
+
+		case req := <-r.edits:
+			req.result <- errNotOwner
+
+		case req := <-r.roles:
+			req.result <- errNotOwner
+
+		case client := <-r.Register:
+			if len(r.Clients) == 0 {
+				f.lastHeard = time.Now()
+			}
+			r.Mu.Lock()
+			r.Clients[client] = true
+			r.Mu.Unlock()
+			f.conns[client.id] = client
+			trackClient(client, r.ID)
+			r.toOwner(&envelope{
+				Kind:     envJoin,
+				Conn:     client.id,
+				UserID:   client.UserID,
+				Username: client.Username,
+				Role:     client.Role,
+			})
+
+		case client := <-r.Unregister:
+			r.Mu.Lock()
+			if _, ok := r.Clients[client]; ok {
+				r.dropConn(client, 0, "")
+			}
+			r.Mu.Unlock()
+
+		case bmsg := <-r.Broadcast:
+			env := &envelope{Kind: envMessage, Conn: bmsg.Sender.id, Msg: bmsg.Msg}
+			if bmsg.Err != nil {
+				env.Error, env.ErrorCode = bmsg.Err.Error(), errorCode(bmsg.Err)
+			}
+			r.toOwner(env)
+
+		case env := <-r.inbox:
+			f.lastHeard = time.Now()
+			if r.fromOwner(env) {
+				r.hub.remove(r)
+				return
+			}
+
+		case <-f.overflow:
+			// Deliveries from the owner were lost, and there is no copy of
+			// the document here to resync from, so ask the owner.
+			f.lastHeard = time.Now()
+			log.Printf("Follower room %s fell behind its owner, resyncing", r.ID)
+			for conn := range f.conns {
+				r.toOwner(&envelope{Kind: envResync, Conn: conn})
+			}
+
+		case <-checkC:
+			if len(r.Clients) > 0 && time.Since(f.lastHeard) > followerTimeoutBeats*r.heartbeat {
+				log.Printf("Owner of room %s stopped responding", r.ID)
+				r.hub.remove(r)
+				r.Mu.Lock()
+				for client := range r.Clients {
+					r.dropConn(client, CloseGoingAway, "document owner unavailable")
+				}
+				r.Mu.Unlock()
+				return
+			}
+		}
+		r.checkIdle()
+	}
+}
+
+// fromOwner acts on an envelope from the owner. It reports whether the
+// owner has closed the room.
+func (r *Room) fromOwner(env *envelope) bool {
+	f := r.follower
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	switch env.Kind {
+	case envDeliver:
+		client, ok := f.conns[env.Conn]
+		if !ok {
+			return false
+		}
+		if env.MsgType == TypeSync {
+			client.queue.pushSync(env.Data)
+		} else if !client.queue.push(env.MsgType, env.Data) {
+			// Without a copy of the document there is no sync to offer.
+			wsMessagesDropped.Add(1)
+			wsSlowConsumerDisconnects.Add(1)
+			r.dropConn(client, CloseSlowConsumer, "client too slow")
+		}
+	case envKick:
+		if client, ok := f.conns[env.Conn]; ok {
+			r.dropConn(client, env.Code, env.Reason)
+		}
+	case envClosed:
+		for client := range r.Clients {
+			r.dropConn(client, env.Code, env.Reason)
+		}
+		return true
+	}
+	return false
+}
+
+// dropConn removes a client from a follower room, closing its connection
+// with code if set, and tells the owner it has gone. r.Mu must be held.
+func (r *Room) dropConn(client *Client, code int, reason string) {
+	delete(r.Clients, client)
+	delete(r.follower.conns, client.id)
+	untrackClient(client)
+	if code != 0 {
+		client.queue.closeWith(code, reason)
+	} else {
+		client.queue.close()
+	}
+	r.toOwner(&envelope{Kind: envLeave, Conn: client.id})
+}
+
+// toOwner queues an envelope for the owner.
+func (r *Room) toOwner(env *envelope) {
+	env.DocID, env.Instance = r.ID, r.hub.instance
+	r.follower.outbox <- env
+}
+
+// sendToOwner publishes queued envelopes to the owner one at a time, so
+// they arrive in the order they were sent.
+func (r *Room) sendToOwner() {
+	for env := range r.follower.outbox {
+		r.hub.publish(docTopic(r.ID), env)
+	}
+}
+
+// pump feeds what followers publish to the owner's inbox.
+func (r *Room) pump() {
+	for data := range r.sub.C() {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			log.Printf("Invalid envelope for room %s: %v", r.ID, err)
+			continue
+		}
+		select {
+		case r.inbox <- &env:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// handleEnvelope acts on an envelope a follower sent the owner.
+func (r *Room) handleEnvelope(env *envelope) {
+	key := env.Instance + "/" + env.Conn
+	switch env.Kind {
+	case envJoin:
+		if _, ok := r.proxies[key]; ok {
+			return
+		}
+		proxy := &Client{
+			UserID:   env.UserID,
+			Username: env.Username,
+			Role:     env.Role,
+			config:   r.hub.Config,
+			queue:    newSendQueue(r.hub.Config.SendQueueSize),
+			id:       env.Conn,
+			instance: env.Instance,
+		}
+		r.proxies[key] = proxy
+		go r.forward(proxy)
+		r.register(proxy)
+
+	case envLeave:
+		if proxy, ok := r.proxies[key]; ok {
+			r.unregister(proxy)
+		}
+
+	case envMessage:
+		proxy, ok := r.proxies[key]
+		if !ok {
+			return
+		}
+		bmsg := BroadcastMessage{Sender: proxy, Msg: env.Msg}
+		if env.Error != "" {
+			bmsg.Err = &ProtocolError{Code: env.ErrorCode, Err: errors.New(env.Error)}
+		} else if env.Msg == nil {
+			return
+		}
+		r.handleMessage(bmsg)
+
+	case envResync:
+		if proxy, ok := r.proxies[key]; ok {
+			r.send(proxy, r.syncMessage())
+			return
+		}
+		// The follower missed that the connection was dropped.
+		kick := &envelope{Kind: envKick, DocID: r.ID, Conn: env.Conn, Code: CloseSlowConsumer, Reason: "client too slow"}
+		go r.hub.publish(instanceTopic(env.Instance), kick)
+
+	case envRequest:
+		r.handleRequest(env)
+	}
+}
+
+// handleRequest carries out a request another instance made of the owner
+// and answers it.
+func (r *Room) handleRequest(env *envelope) {
+	resp := &envelope{Kind: envResponse, DocID: r.ID, ID: env.ID}
+	var err error
+	switch env.Request {
+	case requestReplace:
+		err = r.replace(env.Content, env.UserID)
+	case requestRestore:
+		err = r.restore(env.Content, env.UserID)
+	case requestRole:
+		r.setRole(env.UserID, env.Role)
+	case requestPresence:
+		r.Mu.Lock()
+		resp.Users = r.roster()
+		r.Mu.Unlock()
+	case requestContent:
+		resp.Content = r.doc.Content()
+	case requestClose:
+		// Run stops once this returns, so answer when it has, with the
+		// outcome of saving if that was asked for.
+		r.hub.remove(r)
+		r.closeOnce.Do(func() {
+			r.closeCode, r.closeReason, r.closeFlush = env.Code, env.Reason, env.Save
+			close(r.quit)
+		})
+		go func() {
+			<-r.done
+			if r.closeErr != nil {
+				resp.Error = r.closeErr.Error()
+			}
+			r.hub.publish(instanceTopic(env.Instance), resp)
+		}()
+		return
+	default:
+		err = errors.New("unknown request " + env.Request)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	go r.hub.publish(instanceTopic(env.Instance), resp)
+}
+
+// forward publishes what the owner queues for a proxy to the follower its
+// client is connected to, and tells the follower if the owner drops it.
+func (r *Room) forward(proxy *Client) {
+	topic := instanceTopic(proxy.instance)
+	for range proxy.queue.ready {
+		for {
+			item, ok := proxy.queue.next()
+			if !ok {
+				break
+			}
+			r.hub.publish(topic, &envelope{
+				Kind:    envDeliver,
+				DocID:   r.ID,
+				Conn:    proxy.id,
+				MsgType: item.msgType,
+				Data:    item.data,
+			})
+		}
+		if closed, code, reason := proxy.queue.closing(); closed {
+			if code != 0 {
+				r.hub.publish(topic, &envelope{Kind: envKick, DocID: r.ID, Conn: proxy.id, Code: code, Reason: reason})
+			}
+			return
+		}
+	}
+}
+
+// forget drops client from the owner's proxies if it stands in for one on
+// another instance.
+func (r *Room) forget(client *Client) {
+	if client.isProxy() {
+		delete(r.proxies, client.instance+"/"+client.id)
+	}
+}
+
+// publishToFollowers sends env to every instance with clients in the room,
+// in the background so that a slow broker does not hold up Run.
+func (r *Room) publishToFollowers(env *envelope) {
+	instances := make(map[string]bool)
+	for _, proxy := range r.proxies {
+		instances[proxy.instance] = true
+	}
+	if len(instances) == 0 {
+		return
+	}
+	r.hub.publishing.Add(1)
+	go func() {
+		defer r.hub.publishing.Done()
+		for instance := range instances {
+			r.hub.publish(instanceTopic(instance), env)
+		}
+	}()
+}
+
+// retire gives up ownership once the room has stopped: followers are told
+// to disconnect their clients with code and reason, and the lease is
+// released so another instance can take over the document. The lease is
+// released before Run returns, so that a room opened for the document
+// right after can take it.
+func (r *Room) retire(code int, reason string) {
+	if r.hub == nil {
+		return
+	}
+	r.publishToFollowers(&envelope{Kind: envClosed, DocID: r.ID, Code: code, Reason: reason})
+	for key, proxy := range r.proxies {
+		proxy.queue.close()
+		delete(r.proxies, key)
+	}
+	if r.sub != nil {
+		r.sub.Close()
+	}
+	if r.lease != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), store.QueryTimeoutDuration)
+		defer cancel()
+		if err := r.lease.Release(ctx); err != nil {
+			log.Printf("Failed to release ownership of document %s: %v", r.ID, err)
+		}
+	}
+}
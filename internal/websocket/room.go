@@ -4,16 +4,29 @@ package websocket
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/vlkhvnn/DocCollab/internal/store"
 )
 
+var (
+	// ErrReadOnly is reported to clients whose role does not allow editing.
+	ErrReadOnly = errors.New("you do not have permission to edit this document")
+	// ErrRoomClosed is returned when a room has stopped running.
+	ErrRoomClosed = errors.New("room is closed")
+)
+
+// BroadcastMessage is a message decoded by a client's ReadPump, or the
+// error decoding it, on its way to the room.
 type BroadcastMessage struct {
 	Sender *Client
-	Data   []byte
+	Msg    *Message
+	Err    error
 }
 
 type Room struct {
@@ -23,96 +36,619 @@ type Room struct {
 	Register   chan *Client
 	Unregister chan *Client
 	Mu         sync.Mutex
-	Content    string
 	Storage    *store.Storage
+
+	// doc merges edits using the document's configured strategy. It is
+	// only changed from Run, and read elsewhere under Mu.
+	doc Merger
+
+	edits       chan editRequest
+	roles       chan roleRequest
+	quit        chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+	// closeFlush asks Run to save the content before stopping; closeErr
+	// holds the outcome and is safe to read once done is closed.
+	closeFlush bool
+	closeErr   error
+
+	// hub is told when the room goes idle so it can drop it.
+	hub         *Hub
+	idleTimeout time.Duration
+
+	idle *time.Timer
+
+	// cursorInterval throttles how often each client's cursor is relayed,
+	// and cursorTimer fires when a held-back cursor is due.
+	cursorInterval time.Duration
+	cursorTimer    *time.Timer
+
+	persister *persister
+
+	// inbox receives envelopes from other instances: from followers while
+	// the room owns the document, from the owner while it follows.
+	inbox chan *envelope
+	// heartbeat is how often the owner tells followers it is alive.
+	heartbeat time.Duration
+	// lease and sub are held while the room owns the document; sub feeds
+	// inbox with what followers send. proxies stand in for the clients of
+	// followers, keyed by instance and connection.
+	lease   Lease
+	sub     Subscription
+	proxies map[string]*Client
+	// follower is set instead when another instance owns the document.
+	follower *follower
 }
 
-func NewRoom(docID string, storage *store.Storage) *Room {
+// editRequest asks Run to swap the document content on behalf of a user,
+// either as an ordinary edit or by restoring it wholesale.
+type editRequest struct {
+	content string
+	userID  int64
+	restore bool
+	result  chan error
+}
+
+// roleRequest asks Run to apply a change to a user's role on the document.
+type roleRequest struct {
+	userID int64
+	role   store.Role
+	result chan error
+}
+
+// NewRoom creates a room for a stored document, starting from its content.
+func NewRoom(document *store.Document, storage *store.Storage) (*Room, error) {
+	doc, err := NewMerger(document.MergeStrategy, document.Content, document.MergeState)
+	if err != nil {
+		return nil, err
+	}
+	cursorTimer := time.NewTimer(time.Hour)
+	cursorTimer.Stop()
 	return &Room{
-		ID:         docID,
-		Clients:    make(map[*Client]bool),
-		Broadcast:  make(chan BroadcastMessage),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Content:    "",
-		Storage:    storage,
+		ID:          document.DocID,
+		Clients:     make(map[*Client]bool),
+		Broadcast:   make(chan BroadcastMessage),
+		Register:    make(chan *Client),
+		Unregister:  make(chan *Client),
+		Storage:     storage,
+		doc:         doc,
+		edits:       make(chan editRequest),
+		roles:       make(chan roleRequest),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		cursorTimer: cursorTimer,
+		inbox:       make(chan *envelope, subscriptionBuffer),
+		proxies:     make(map[string]*Client),
+	}, nil
+}
+
+// Join registers client with the room. It returns false if the room has
+// already stopped.
+func (r *Room) Join(client *Client) bool {
+	select {
+	case r.Register <- client:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// leave unregisters client unless the room has already stopped.
+func (r *Room) leave(client *Client) {
+	select {
+	case r.Unregister <- client:
+	case <-r.done:
+	}
+}
+
+// submit hands a message to Run. It returns false if the room has stopped.
+func (r *Room) submit(msg BroadcastMessage) bool {
+	select {
+	case r.Broadcast <- msg:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// Replace swaps the whole document content as if userID had typed it. The
+// change is relayed to connected clients and persisted like any other edit.
+func (r *Room) Replace(content string, userID int64) error {
+	return r.edit(editRequest{content: content, userID: userID})
+}
+
+// Restore resets the document to content, for example an earlier revision.
+// It is persisted as a new revision before returning, and every connected
+// client is sent a fresh sync because edits in flight no longer apply.
+func (r *Room) Restore(content string, userID int64) error {
+	return r.edit(editRequest{content: content, userID: userID, restore: true})
+}
+
+func (r *Room) edit(req editRequest) error {
+	req.result = make(chan error, 1)
+	select {
+	case r.edits <- req:
+	case <-r.done:
+		return ErrRoomClosed
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-r.done:
+		return ErrRoomClosed
+	}
+}
+
+// SetRole applies a change to userID's role to their connections: their
+// ops are checked against role from then on, and they are sent it in a
+// role message. An empty role means the user lost access to the document,
+// and their connections are closed with CloseAccessRevoked.
+func (r *Room) SetRole(userID int64, role store.Role) error {
+	req := roleRequest{userID: userID, role: role, result: make(chan error, 1)}
+	select {
+	case r.roles <- req:
+	case <-r.done:
+		return ErrRoomClosed
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-r.done:
+		return ErrRoomClosed
+	}
+}
+
+// Close disconnects every client with the given websocket close code and
+// reason, stops the room and waits for Run to return. Unless save is set,
+// unsaved content is discarded, which is what deleting a document wants;
+// otherwise it returns the outcome of saving it.
+func (r *Room) Close(code int, reason string, save bool) error {
+	r.closeOnce.Do(func() {
+		r.closeCode, r.closeReason, r.closeFlush = code, reason, save
+		close(r.quit)
+	})
+	<-r.done
+	return r.closeErr
+}
+
+// Shutdown tells every client the server is going away, saves the content
+// and stops the room. It gives up waiting when ctx is done.
+func (r *Room) Shutdown(ctx context.Context) error {
+	r.closeOnce.Do(func() {
+		r.closeCode, r.closeReason = websocket.CloseGoingAway, "server going away"
+		r.closeFlush = true
+		close(r.quit)
+	})
+	select {
+	case <-r.done:
+		return r.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// Content returns the current document text.
+func (r *Room) Content() string {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.doc.Content()
+}
+
+// Run processes the room's events until it is closed or has had no
+// clients for its idle timeout, in which case it flushes its content and
+// removes itself from the hub. Rooms following another instance's room
+// run the follower loop instead.
 func (r *Room) Run() {
+	defer close(r.done)
+	if r.follower != nil {
+		r.runFollower()
+		return
+	}
+
+	var lost <-chan struct{}
+	if r.lease != nil {
+		lost = r.lease.Lost()
+	}
+	var heartbeatC <-chan time.Time
+	if r.heartbeat > 0 {
+		heartbeat := time.NewTicker(r.heartbeat)
+		defer heartbeat.Stop()
+		heartbeatC = heartbeat.C
+	}
+	r.checkIdle()
 	for {
 		select {
-		case client := <-r.Register:
-			r.Mu.Lock()
-			r.Clients[client] = true
-			r.Mu.Unlock()
-			log.Printf("Client joined room %s. Total clients: %d", r.ID, len(r.Clients))
-			// When a client joins, send the current content.
-			syncMsg := map[string]interface{}{
-				"type":      "sync",
-				"docID":     r.ID,
-				"position":  0,
-				"text":      r.Content,
-				"userID":    "server",
-				"timestamp": time.Now().Format(time.RFC3339),
+		case <-r.idleC():
+			r.idle = nil
+			if r.evict() {
+				r.retire(CloseGoingAway, "room closed")
+				return
 			}
-			data, _ := json.Marshal(syncMsg)
-			client.Send <- data
 
-		case client := <-r.Unregister:
-			r.Mu.Lock()
-			if _, ok := r.Clients[client]; ok {
-				delete(r.Clients, client)
-				close(client.Send)
-				log.Printf("Client left room %s. Total clients: %d", r.ID, len(r.Clients))
+		case <-r.quit:
+			r.disconnectAll(r.closeCode, r.closeReason)
+			if r.closeFlush {
+				r.closeErr = r.flush()
 			}
-			r.Mu.Unlock()
+			r.cursorTimer.Stop()
+			r.persister.Stop()
+			r.retire(r.closeCode, r.closeReason)
+			log.Printf("Room %s closed: %s", r.ID, r.closeReason)
+			return
 
-		case bmsg := <-r.Broadcast:
-			// Assume the message is an "update" message.
-			var msg map[string]interface{}
-			if err := json.Unmarshal(bmsg.Data, &msg); err != nil {
-				log.Printf("Error parsing message in room %s: %v", r.ID, err)
-				continue
-			}
-			if msg["type"] == "update" {
-				newContent, ok := msg["text"].(string)
-				if ok {
-					// Update in-memory content.
-					r.Mu.Lock()
-					r.Content = newContent
-					r.Mu.Unlock()
-
-					// Persist the update to the database.
-					// Here, you can update asynchronously if desired.
-					go func() {
-						if err := r.Storage.Document.UpdateDocument(context.Background(), r.ID, newContent); err != nil {
-							log.Printf("Failed to update document %s: %v", r.ID, err)
-						}
-					}()
-
-					// Broadcast a sync message with the updated content.
-					syncMsg := map[string]interface{}{
-						"type":      "sync",
-						"docID":     r.ID,
-						"position":  0,
-						"text":      r.Content,
-						"userID":    msg["userID"],
-						"timestamp": time.Now().Format(time.RFC3339),
-					}
-					data, err := json.Marshal(syncMsg)
-					if err != nil {
-						log.Printf("Error marshalling sync message: %v", err)
-						continue
-					}
-					r.Mu.Lock()
-					for client := range r.Clients {
-						// Optionally, you might skip sending to the sender if desired.
-						client.Send <- data
-					}
-					r.Mu.Unlock()
-				}
+		case <-lost:
+			// Another instance may already be merging edits; saving ours
+			// now could overwrite them.
+			r.hub.remove(r)
+			r.disconnectAll(CloseGoingAway, "document moved to another server")
+			r.persister.Stop()
+			r.retire(CloseGoingAway, "document moved to another server")
+			log.Printf("Room %s lost ownership of its document", r.ID)
+			return
+
+		case now := <-r.cursorTimer.C:
+			r.flushCursors(now)
+
+		case <-r.persister.stateDue:
+			r.saveState()
+
+		case <-heartbeatC:
+			r.publishToFollowers(&envelope{Kind: envHeartbeat, DocID: r.ID})
+
+		case req := <-r.edits:
+			if req.restore {
+				req.result <- r.restore(req.content, req.userID)
+			} else {
+				req.result <- r.replace(req.content, req.userID)
 			}
+
+		case req := <-r.roles:
+			r.setRole(req.userID, req.role)
+			req.result <- nil
+
+		case client := <-r.Register:
+			r.register(client)
+
+		case client := <-r.Unregister:
+			r.unregister(client)
+
+		case bmsg := <-r.Broadcast:
+			r.handleMessage(bmsg)
+
+		case env := <-r.inbox:
+			r.handleEnvelope(env)
 		}
+		r.checkIdle()
+	}
+}
+
+// idleC fires when the idle timer, if running, expires.
+func (r *Room) idleC() <-chan time.Time {
+	if r.idle == nil {
+		return nil
+	}
+	return r.idle.C
+}
+
+// checkIdle runs the idle timer while the room has no clients.
+func (r *Room) checkIdle() {
+	switch {
+	case len(r.Clients) > 0 && r.idle != nil:
+		r.idle.Stop()
+		r.idle = nil
+	case len(r.Clients) == 0 && r.idle == nil && r.idleTimeout > 0:
+		r.idle = time.NewTimer(r.idleTimeout)
+	}
+}
+
+func (r *Room) register(client *Client) {
+	r.Mu.Lock()
+	r.Clients[client] = true
+	r.Mu.Unlock()
+	trackClient(client, r.ID)
+	log.Printf("Client joined room %s. Total clients: %d", r.ID, len(r.Clients))
+	// When a client joins, send the current content and who else is here,
+	// then tell everyone else about them.
+	r.send(client, r.syncMessage())
+	r.joined(client)
+}
+
+func (r *Room) unregister(client *Client) {
+	r.Mu.Lock()
+	_, ok := r.Clients[client]
+	if ok {
+		delete(r.Clients, client)
+		client.queue.close()
+		untrackClient(client)
+		log.Printf("Client left room %s. Total clients: %d", r.ID, len(r.Clients))
+	}
+	r.Mu.Unlock()
+	if ok {
+		r.forget(client)
+		r.left(client)
+	}
+}
+
+// disconnectAll closes every client's connection with code and reason.
+func (r *Room) disconnectAll(code int, reason string) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	for client := range r.Clients {
+		// Followers are told once for all their clients by retire.
+		if !client.isProxy() {
+			client.closeWith(code, reason)
+		}
+		delete(r.Clients, client)
+		client.queue.close()
+		untrackClient(client)
+	}
+}
+
+// handleMessage acts on a message a client sent.
+func (r *Room) handleMessage(bmsg BroadcastMessage) {
+	if bmsg.Err != nil {
+		r.send(bmsg.Sender, r.errorMessage(bmsg.Err))
+		return
+	}
+	// Never trust the sender's claim about who it is.
+	bmsg.Msg.UserID = bmsg.Sender.userTag()
+	switch bmsg.Msg.Type {
+	case TypeOp:
+		r.handleOp(bmsg.Sender, bmsg.Msg)
+	case TypePresence:
+		r.setIdle(bmsg.Sender, bmsg.Msg.Event == PresenceIdle)
+	case TypeCursor:
+		r.handleCursor(bmsg.Sender, bmsg.Msg)
+	}
+}
+
+// handleOp applies an op from a client, or tells the client why it could
+// not be and sends it a fresh sync to start again from.
+func (r *Room) handleOp(sender *Client, msg *Message) {
+	if sender.idle {
+		r.setIdle(sender, false)
+	}
+	if !sender.Role.CanEdit() {
+		r.send(sender, r.errorMessage(ErrReadOnly))
+		return
+	}
+	if err := r.applyOp(sender, sender.UserID, msg); err != nil {
+		log.Printf("Rejected op in room %s: %v", r.ID, err)
+		r.send(sender, r.errorMessage(err))
+		r.send(sender, r.syncMessage())
+	}
+}
+
+// applyOp merges an incoming edit into the document, acknowledges it to
+// the sender and relays whatever was integrated to everyone else. An edit
+// that has to wait for ops the server has not seen is not acknowledged;
+// the sender is told it is pending instead, and it is relayed once it has
+// been integrated. Edits made by the server on behalf of userID have no
+// sender.
+func (r *Room) applyOp(sender *Client, userID int64, msg *Message) error {
+	r.Mu.Lock()
+	ops, err := r.doc.Integrate(msg)
+	content := r.doc.Content()
+	r.Mu.Unlock()
+	pending := errors.Is(err, ErrOpsPending)
+	if err != nil && !pending {
+		return err
+	}
+
+	if sender != nil {
+		if pending {
+			r.send(sender, r.errorMessage(err))
+		} else {
+			r.send(sender, r.newMessage(TypeAck, msg.UserID))
+		}
+	}
+	if ops == nil {
+		return nil
+	}
+
+	r.persister.Save(r.doc.Revision(), content, userID)
+
+	relay := r.newMessage(TypeOp, msg.UserID)
+	relay.Ops = ops
+	return r.broadcast(relay, sender)
+}
+
+// replace swaps the whole document content as if userID had typed it.
+func (r *Room) replace(content string, userID int64) error {
+	position, length, text := spliceBetween(r.doc.Content(), content)
+	msg := &Message{
+		Type:     TypeOp,
+		Revision: r.doc.Revision(),
+		Position: position,
+		Length:   length,
+		Text:     text,
+		UserID:   strconv.FormatInt(userID, 10),
+	}
+	return r.applyOp(nil, userID, msg)
+}
+
+// restore resets the document to content and persists it before
+// returning so the caller can report the stored revision.
+func (r *Room) restore(content string, userID int64) error {
+	r.Mu.Lock()
+	r.doc.Reset(content)
+	r.Mu.Unlock()
+
+	r.persister.Save(r.doc.Revision(), content, userID)
+	if err := r.flush(); err != nil {
+		return err
+	}
+	return r.broadcast(r.syncMessage(), nil)
+}
+
+// saveState hands the persister the merge state for the content it last
+// queued, which it asks for when a write is due.
+func (r *Room) saveState() {
+	state, err := r.doc.State()
+	if err != nil {
+		log.Printf("Error encoding merge state for room %s: %v", r.ID, err)
+		return
+	}
+	r.persister.SaveState(r.doc.Revision(), state)
+}
+
+// setRole updates the role of userID's clients, or disconnects them if
+// role is empty.
+func (r *Room) setRole(userID int64, role store.Role) {
+	r.Mu.Lock()
+	var clients []*Client
+	for client := range r.Clients {
+		if client.UserID == userID {
+			clients = append(clients, client)
+		}
+	}
+	r.Mu.Unlock()
+
+	if role == "" {
+		for _, client := range clients {
+			r.disconnect(client, CloseAccessRevoked, "access to the document was revoked")
+		}
+		return
+	}
+	msg := r.newMessage(TypeRole, "server")
+	msg.Role = role
+	for _, client := range clients {
+		client.Role = role
+		r.send(client, msg)
+	}
+}
+
+// broadcast sends msg to every client except skip.
+func (r *Room) broadcast(msg *Message, skip *Client) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	r.Mu.Lock()
+	clients := make([]*Client, 0, len(r.Clients))
+	for client := range r.Clients {
+		if client != skip {
+			clients = append(clients, client)
+		}
+	}
+	r.Mu.Unlock()
+	for _, client := range clients {
+		r.deliver(client, msg.Type, data)
+	}
+	return nil
+}
+
+// flush writes any unsaved content, with the merge state, to the store and
+// waits for it.
+func (r *Room) flush() error {
+	r.saveState()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*store.QueryTimeoutDuration)
+	defer cancel()
+	return r.persister.Flush(ctx)
+}
+
+// evict flushes an idle room and removes it from the hub. Run is not
+// receiving while this happens, so a client that got hold of the room in
+// the meantime fails to join once it stops and asks the hub again, by
+// which time the store is up to date. It reports whether the room stopped.
+func (r *Room) evict() bool {
+	if err := r.flush(); err != nil {
+		log.Printf("Failed to flush idle room %s, keeping it: %v", r.ID, err)
+		return false
+	}
+	r.hub.remove(r)
+	r.persister.Stop()
+	log.Printf("Room %s evicted after %s idle", r.ID, r.idleTimeout)
+	return true
+}
+
+func (r *Room) newMessage(msgType, userID string) *Message {
+	return &Message{
+		Type:      msgType,
+		DocID:     r.ID,
+		Revision:  r.doc.Revision(),
+		UserID:    userID,
+		Timestamp: time.Now(),
+	}
+}
+
+func (r *Room) syncMessage() *Message {
+	msg := r.newMessage(TypeSync, "server")
+	msg.Text = r.doc.Content()
+	state, err := r.doc.State()
+	if err != nil {
+		log.Printf("Error encoding merge state for room %s: %v", r.ID, err)
+	}
+	msg.Ops = state
+	r.Mu.Lock()
+	msg.Users = r.roster()
+	r.Mu.Unlock()
+	return msg
+}
+
+func (r *Room) errorMessage(err error) *Message {
+	msg := r.newMessage(TypeError, "server")
+	msg.Text = err.Error()
+	msg.Code = errorCode(err)
+	return msg
+}
+
+// send delivers a single message to one client.
+func (r *Room) send(client *Client, msg *Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshalling %s message: %v", msg.Type, err)
+		return
+	}
+	r.deliver(client, msg.Type, data)
+}
+
+// deliver queues data for client without blocking. A client whose queue is
+// full has fallen behind, and depending on the slow-consumer policy either
+// gets a fresh sync in place of everything it has queued or is disconnected.
+func (r *Room) deliver(client *Client, msgType string, data []byte) {
+	if msgType == TypeSync {
+		client.queue.pushSync(data)
+		return
+	}
+	if client.queue.push(msgType, data) {
+		return
+	}
+	wsMessagesDropped.Add(1)
+
+	if client.config.SlowConsumerPolicy == SlowConsumerDisconnect {
+		if r.disconnect(client, CloseSlowConsumer, "client too slow") {
+			log.Printf("Disconnected slow client %s from room %s", client.userTag(), r.ID)
+			wsSlowConsumerDisconnects.Add(1)
+		}
+		return
+	}
+
+	resync, err := json.Marshal(r.syncMessage())
+	if err != nil {
+		log.Printf("Error marshalling sync message: %v", err)
+		return
+	}
+	log.Printf("Resyncing slow client %s in room %s", client.userTag(), r.ID)
+	wsSlowConsumerResyncs.Add(1)
+	client.queue.pushSync(resync)
+}
+
+// disconnect removes client from the room and closes its connection with
+// code and reason. For a proxy, the follower it stands in for is told to
+// close the connection. It reports whether client was still in the room.
+func (r *Room) disconnect(client *Client, code int, reason string) bool {
+	r.Mu.Lock()
+	_, ok := r.Clients[client]
+	delete(r.Clients, client)
+	r.Mu.Unlock()
+	if ok {
+		client.queue.closeWith(code, reason)
+		untrackClient(client)
+		r.forget(client)
+		r.left(client)
 	}
+	return ok
 }
@@ -0,0 +1,129 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vlkhvnn/DocCollab/internal/store"
+)
+
+// eventually polls cond until it holds or a few seconds have passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRoomLoadsStoredContent(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "stored", "alice")
+	broker := NewMemoryBroker()
+	hub, srv := newTestHub(t, storage, broker)
+	alice, sync := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	if sync.Text != "stored" {
+		t.Fatalf("synced %q, want the stored content", sync.Text)
+	}
+	alice.splice(sync.Revision, 6, 0, "!")
+	alice.expect(TypeAck)
+
+	// A restarted server picks up where the last one left off.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, srv = newTestHub(t, storage, broker)
+	_, sync = dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	if sync.Text != "stored!" {
+		t.Fatalf("synced %q after a restart, want %q", sync.Text, "stored!")
+	}
+}
+
+func TestGetRoomOfMissingDocument(t *testing.T) {
+	storage, _, _ := newTestStorage(t, StrategyOT, "", "alice")
+	broker := NewMemoryBroker()
+	hub, _ := newTestHub(t, storage, broker)
+	ctx := context.Background()
+
+	if _, err := hub.GetRoom(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("got %v, want store.ErrNotFound", err)
+	}
+	if _, ok := hub.Lookup("missing"); ok {
+		t.Fatal("a room was kept for the missing document")
+	}
+	if owner, err := broker.Owner(ctx, "missing"); err != nil || owner != "" {
+		t.Fatalf("missing document is owned by %q (%v), want no owner", owner, err)
+	}
+}
+
+// unreadableDocuments fails every attempt to load a document.
+type unreadableDocuments struct {
+	store.DocumentRepository
+}
+
+func (unreadableDocuments) GetDocumentByDocID(context.Context, string) (*store.Document, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRoomThatFailsToLoadRejectsTheClient(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice")
+	storage.Document = unreadableDocuments{storage.Document}
+	_, srv := newTestHub(t, storage, NewMemoryBroker())
+
+	alice := dialRaw(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	alice.send(&Message{Type: TypeHello, Versions: []int{ProtocolVersion}})
+	alice.expect(TypeHello)
+	if msg := alice.expect(TypeError); msg.Code != CodeRejected {
+		t.Fatalf("got error %q, want %q", msg.Code, CodeRejected)
+	}
+	alice.expectClose(CloseInternalError)
+}
+
+func TestIdleRoomIsFlushedAndEvicted(t *testing.T) {
+	storage, doc, users := newTestStorage(t, StrategyOT, "abc", "alice")
+	broker := NewMemoryBroker()
+	cfg := testConfig
+	cfg.PersistDebounce, cfg.PersistMaxDelay = time.Hour, time.Hour
+	cfg.RoomIdleTimeout = 50 * time.Millisecond
+	hub, srv := newTestHubWithConfig(t, storage, broker, cfg)
+	ctx := context.Background()
+
+	alice, _ := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	alice.splice(0, 3, 0, "d")
+	alice.expect(TypeAck)
+
+	// A connected client keeps the room open however quiet it is.
+	time.Sleep(3 * cfg.RoomIdleTimeout)
+	if _, ok := hub.Lookup(doc.DocID); !ok {
+		t.Fatal("room with a client was evicted")
+	}
+
+	alice.conn.Close()
+	eventually(t, "the room to be evicted", func() bool {
+		_, ok := hub.Lookup(doc.DocID)
+		return !ok
+	})
+	stored, err := storage.Document.GetDocumentByDocID(ctx, doc.DocID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Content != "abcd" {
+		t.Fatalf("stored %q on eviction, want %q", stored.Content, "abcd")
+	}
+	eventually(t, "the lease to be released", func() bool {
+		owner, err := broker.Owner(ctx, doc.DocID)
+		return err == nil && owner == ""
+	})
+
+	// The next client gets a fresh room with the flushed content.
+	_, sync := dial(t, srv, doc.DocID, users[0].ID, store.RoleOwner)
+	if sync.Text != "abcd" {
+		t.Fatalf("synced %q after eviction, want %q", sync.Text, "abcd")
+	}
+}
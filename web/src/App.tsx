@@ -1,19 +1,40 @@
 // src/App.tsx
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import { Navigate, Route, Routes } from 'react-router-dom';
 import AuthForm, { AuthMode } from './components/AuthForm';
 import CreateDocumentForm from './components/CreateDocumentForm';
 import Editor from './components/Editor';
+import { refreshTokens, TokenPair } from './utils/api';
+
+// Refresh the access token this long before it expires.
+const REFRESH_MARGIN_MS = 60 * 1000;
 
 const App: React.FC = () => {
-  // Holds the JWT token. If token exists, user is authenticated.
-  const [token, setToken] = useState<string>('');
+  // Holds the JWT tokens. If they exist, user is authenticated.
+  const [tokens, setTokens] = useState<TokenPair | null>(null);
+  const token = tokens?.access_token ?? '';
   // For simplicity, generate a random user ID on initial login.
   // In a real app, you might decode this from the token.
   const [userID] = useState<string>(() => Math.random().toString(36).substring(2, 10));
   // Manage authentication mode: either 'login' or 'register'
   const [authMode, setAuthMode] = useState<AuthMode>('login');
 
+  // Swap the access token for a new one shortly before it expires. If the
+  // refresh token is rejected the login has ended, so log out.
+  useEffect(() => {
+    if (!tokens) return;
+    const delay = Math.max(new Date(tokens.expires_at).getTime() - Date.now() - REFRESH_MARGIN_MS, 0);
+    const timer = setTimeout(() => {
+      refreshTokens(tokens.refresh_token)
+        .then(setTokens)
+        .catch((err) => {
+          console.error('Token refresh failed:', err);
+          setTokens(null);
+        });
+    }, delay);
+    return () => clearTimeout(timer);
+  }, [tokens]);
+
   return (
     <Routes>
       {/* If not authenticated, route to /auth */}
@@ -23,7 +44,7 @@ const App: React.FC = () => {
           element={
             <AuthForm
               mode={authMode}
-              onAuthSuccess={(t: string) => setToken(t)}
+              onAuthSuccess={(t: TokenPair) => setTokens(t)}
               switchMode={(mode: AuthMode) => setAuthMode(mode)}
             />
           }
@@ -1,12 +1,12 @@
 // src/components/AuthForm.tsx
 import React, { useState } from 'react';
-import { loginUser, registerUser } from '../utils/api';
+import { loginUser, registerUser, TokenPair } from '../utils/api';
 
 export type AuthMode = 'login' | 'register';
 
 interface AuthFormProps {
   mode: AuthMode;
-  onAuthSuccess: (token: string) => void;
+  onAuthSuccess: (tokens: TokenPair) => void;
   switchMode: (mode: AuthMode) => void;
 }
 
@@ -26,7 +26,7 @@ const AuthForm: React.FC<AuthFormProps> = ({ mode, onAuthSuccess, switchMode })
         switchMode('login');
       } else {
         const data = await loginUser(email, password);
-        // Extract the token from the "data" field.
+        // Extract the tokens from the "data" field.
         onAuthSuccess(data.data);
       }
     } catch (err: any) {
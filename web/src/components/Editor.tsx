@@ -1,44 +1,183 @@
 // src/components/Editor.tsx
-import React, { useEffect, useState } from 'react';
+import React, { useEffect, useRef, useState } from 'react';
 import { useParams } from 'react-router-dom';
-import { Message } from '../types/message';
+import { Message, Presence, PROTOCOL_VERSIONS } from '../types/message';
+import { apply, diff, Operation, transform, transformPosition } from '../utils/ot';
+
+// OT client state: the last server revision we know of, the op awaiting an
+// ack and local edits made since it was sent.
+interface OTState {
+  revision: number;
+  pending: Operation | null;
+  buffer: Operation | null;
+  bufferBase: string;
+}
+
+// A collaborator's caret or selection in our local copy of the text.
+interface RemoteCursor {
+  username: string;
+  start: number;
+  end: number;
+}
 
 interface EditorProps {
   token: string;
   userID: string;
 }
 
+// applyPresence updates the roster with a presence event.
+function applyPresence(users: Presence[], msg: Message): Presence[] {
+  const id = Number(msg.userID);
+  const others = users.filter((u) => u.user_id !== id);
+  const existing = users.find((u) => u.user_id === id);
+  switch (msg.event) {
+    case 'join':
+      return [...others, { user_id: id, username: msg.username || '', idle: false, connections: 1 }];
+    case 'leave':
+      return others;
+    case 'idle':
+    case 'active':
+      if (!existing) return users;
+      return users.map((u) => (u.user_id === id ? { ...u, idle: msg.event === 'idle' } : u));
+    default:
+      return users;
+  }
+}
+
+// moveCursors shifts every collaborator's cursor through an edit.
+function moveCursors(cursors: Record<string, RemoteCursor>, op: Operation): Record<string, RemoteCursor> {
+  const moved: Record<string, RemoteCursor> = {};
+  for (const [id, c] of Object.entries(cursors)) {
+    moved[id] = { ...c, start: transformPosition(op, c.start), end: transformPosition(op, c.end) };
+  }
+  return moved;
+}
+
 const Editor: React.FC<EditorProps> = ({ token, userID }) => {
   const { docID } = useParams<{ docID: string }>();
   const [ws, setWs] = useState<WebSocket | null>(null);
   const [connectionStatus, setConnectionStatus] = useState<string>('Disconnected');
   const [content, setContent] = useState<string>('');
+  const [users, setUsers] = useState<Presence[]>([]);
+  const [cursors, setCursors] = useState<Record<string, RemoteCursor>>({});
+  const contentRef = useRef<string>('');
+  const ot = useRef<OTState>({ revision: 0, pending: null, buffer: null, bufferBase: '' });
 
-  // Construct the WebSocket URL including token and docID.
-  const wsUrl = `ws://localhost:8080/v1/ws?docID=${encodeURIComponent(docID || '')}&token=${encodeURIComponent(token)}`;
+  // The token is only checked when connecting, so a refreshed token must
+  // not reconnect; keep the latest one for the next connection instead.
+  const tokenRef = useRef<string>(token);
+  tokenRef.current = token;
 
   useEffect(() => {
     if (!docID) return;
+    // Construct the WebSocket URL including token and docID.
+    const wsUrl = `ws://localhost:8080/v1/ws?docID=${encodeURIComponent(docID)}&token=${encodeURIComponent(tokenRef.current)}`;
     const socket = new WebSocket(wsUrl);
     setWs(socket);
 
     socket.onopen = () => {
       setConnectionStatus('Connected');
       console.log(`Connected to ${wsUrl}`);
+      const hello: Message = {
+        type: 'hello',
+        docID: docID || '',
+        position: 0,
+        text: '',
+        revision: 0,
+        userID: userID,
+        timestamp: new Date().toISOString(),
+        versions: PROTOCOL_VERSIONS,
+      };
+      socket.send(JSON.stringify(hello));
     };
 
     socket.onmessage = (event) => {
       try {
         const msg: Message = JSON.parse(event.data);
-        if (msg.type === 'sync') {
-          console.log('Sync received:', msg);
-          setContent(msg.text);
+        const state = ot.current;
+        switch (msg.type) {
+          case 'hello':
+            console.log('Speaking protocol version', msg.version);
+            break;
+          case 'sync':
+            console.log('Sync received:', msg);
+            ot.current = { revision: msg.revision, pending: null, buffer: null, bufferBase: '' };
+            updateContent(msg.text);
+            setUsers(msg.users || []);
+            setCursors({});
+            break;
+          case 'presence':
+            setUsers((current) => applyPresence(current, msg));
+            if (msg.event === 'leave') {
+              setCursors(({ [msg.userID]: _, ...rest }) => rest);
+            }
+            break;
+          case 'cursor': {
+            // The server rebased it onto its latest revision; move it
+            // through our own edits it has not seen yet.
+            let start = msg.position;
+            let end = msg.position + (msg.length || 0);
+            for (const local of [state.pending, state.buffer]) {
+              if (local) {
+                start = transformPosition(local, start);
+                end = transformPosition(local, end);
+              }
+            }
+            const cursor = { username: msg.username || msg.userID, start, end };
+            setCursors((current) => ({ ...current, [msg.userID]: cursor }));
+            break;
+          }
+          case 'ack':
+            state.revision = msg.revision;
+            state.pending = state.buffer;
+            state.buffer = null;
+            if (state.pending) {
+              sendOp(socket, state.pending, state.revision);
+            }
+            break;
+          case 'op': {
+            let remote = msg.ops || [];
+            if (state.pending) {
+              [state.pending, remote] = transform(state.pending, remote);
+            }
+            if (state.buffer) {
+              state.bufferBase = apply(state.bufferBase, remote);
+              [state.buffer, remote] = transform(state.buffer, remote);
+            }
+            state.revision = msg.revision;
+            updateContent(apply(contentRef.current, remote));
+            setCursors((current) => moveCursors(current, remote));
+            break;
+          }
+          case 'error':
+            console.error(`Server rejected message (${msg.code}):`, msg.text);
+            break;
+          case 'role':
+            console.log('Our role on this document is now', msg.role);
+            break;
         }
       } catch (err) {
         console.error('Error parsing message:', err);
       }
     };
 
+    // Tell the others when this tab is in the background.
+    const onVisibilityChange = () => {
+      if (socket.readyState !== WebSocket.OPEN) return;
+      const presence: Message = {
+        type: 'presence',
+        docID: docID || '',
+        position: 0,
+        text: '',
+        revision: 0,
+        userID: userID,
+        timestamp: new Date().toISOString(),
+        event: document.hidden ? 'idle' : 'active',
+      };
+      socket.send(JSON.stringify(presence));
+    };
+    document.addEventListener('visibilitychange', onVisibilityChange);
+
     socket.onerror = (err) => {
       console.error('WebSocket error:', err);
     };
@@ -49,24 +188,64 @@ const Editor: React.FC<EditorProps> = ({ token, userID }) => {
     };
 
     return () => {
+      document.removeEventListener('visibilitychange', onVisibilityChange);
       socket.close();
     };
-  }, [wsUrl, docID]);
+  }, [docID]);
+
+  function updateContent(text: string) {
+    contentRef.current = text;
+    setContent(text);
+  }
+
+  function sendOp(socket: WebSocket, op: Operation, revision: number) {
+    const message: Message = {
+      type: 'op',
+      docID: docID || '',
+      position: 0,
+      text: '',
+      revision: revision,
+      ops: op,
+      userID: userID,
+      timestamp: new Date().toISOString(),
+    };
+    socket.send(JSON.stringify(message));
+  }
+
+  // Share our selection, but only while no edit is in flight: until the
+  // server has acknowledged it, our positions do not match any revision.
+  const handleSelect = (e: React.SyntheticEvent<HTMLTextAreaElement>) => {
+    const state = ot.current;
+    if (!ws || ws.readyState !== WebSocket.OPEN || state.pending) return;
+    const { selectionStart, selectionEnd } = e.currentTarget;
+    const message: Message = {
+      type: 'cursor',
+      docID: docID || '',
+      position: selectionStart,
+      length: selectionEnd - selectionStart,
+      text: '',
+      revision: state.revision,
+      userID: userID,
+      timestamp: new Date().toISOString(),
+    };
+    ws.send(JSON.stringify(message));
+  };
 
   const handleContentChange = (e: React.ChangeEvent<HTMLTextAreaElement>) => {
     const newContent = e.target.value;
-    setContent(newContent);
-    if (ws && ws.readyState === WebSocket.OPEN) {
-      const message: Message = {
-        type: 'update',
-        docID: docID || '',
-        position: 0, // Not used in this simple example.
-        text: newContent,
-        userID: userID,
-        timestamp: new Date().toISOString(),
-      };
-      ws.send(JSON.stringify(message));
+    const state = ot.current;
+    const op = diff(contentRef.current, newContent);
+    if (state.pending) {
+      if (!state.buffer) {
+        state.bufferBase = contentRef.current;
+      }
+      state.buffer = diff(state.bufferBase, newContent);
+    } else if (ws && ws.readyState === WebSocket.OPEN) {
+      state.pending = op;
+      sendOp(ws, op, state.revision);
     }
+    updateContent(newContent);
+    setCursors((current) => moveCursors(current, op));
   };
 
   return (
@@ -75,9 +254,21 @@ const Editor: React.FC<EditorProps> = ({ token, userID }) => {
       <p>Status: {connectionStatus}</p>
       <p>Your User ID: {userID}</p>
       <p>Editing Document: {docID}</p>
+      <p>
+        Here now:{' '}
+        {users.map((u) => `${u.username}${u.idle ? ' (idle)' : ''}`).join(', ') || 'nobody'}
+      </p>
+      <ul>
+        {Object.entries(cursors).map(([id, c]) => (
+          <li key={id}>
+            {c.username}: {c.start === c.end ? `at ${c.start}` : `selecting ${c.start}-${c.end}`}
+          </li>
+        ))}
+      </ul>
       <textarea
         value={content}
         onChange={handleContentChange}
+        onSelect={handleSelect}
         style={{ width: '100%', height: '300px', padding: '10px', fontSize: '16px' }}
         placeholder="Start editing the shared document..."
       />
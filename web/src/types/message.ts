@@ -1,9 +1,31 @@
 // src/types/message.ts
+import { Operation } from '../utils/ot';
+
 export interface Message {
-    type: string;      // "update" for client updates, "sync" for document sync
+    type: string;      // "hello", "op", "ack", "sync", "error", "presence", "cursor" or "role"
     docID: string;
-    position: number;  // not used in this example
+    position: number;
+    length?: number;
     text: string;
+    revision: number;  // base revision for client ops, resulting revision from the server
+    ops?: Operation;
     userID: string;
     timestamp: string;
-  }
\ No newline at end of file
+    versions?: number[]; // protocol versions offered in the client's hello
+    version?: number;    // protocol version chosen in the server's hello
+    code?: string;       // why an error message was sent
+    event?: string;      // presence: "join", "leave", "idle" or "active"
+    username?: string;
+    users?: Presence[];  // everyone in the room, sent with sync
+    role?: string;       // our new role on the document, sent with role
+  }
+
+export interface Presence {
+    user_id: number;
+    username: string;
+    idle: boolean;
+    connections: number;
+  }
+
+// PROTOCOL_VERSIONS lists the protocol versions this client speaks.
+export const PROTOCOL_VERSIONS = [1];
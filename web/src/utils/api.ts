@@ -13,6 +13,13 @@ export async function registerUser(username: string, email: string, password: st
   return await res.json();
 }
 
+// TokenPair is what logging in and refreshing return.
+export interface TokenPair {
+  access_token: string;
+  refresh_token: string;
+  expires_at: string;
+}
+
 export async function loginUser(email: string, password: string) {
   const res = await fetch(`${backendUrl}/v1/auth/token`, {
     method: 'POST',
@@ -24,4 +31,18 @@ export async function loginUser(email: string, password: string) {
   }
   // Option 2: The token is returned under the "data" property.
   return await res.json();
-}
\ No newline at end of file
+}
+
+// refreshTokens exchanges a refresh token for a new pair. Each refresh token
+// only works once.
+export async function refreshTokens(refreshToken: string): Promise<TokenPair> {
+  const res = await fetch(`${backendUrl}/v1/auth/refresh`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ refresh_token: refreshToken }),
+  });
+  if (!res.ok) {
+    throw new Error(await res.text());
+  }
+  return (await res.json()).data;
+}
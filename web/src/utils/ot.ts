@@ -0,0 +1,114 @@
+// src/utils/ot.ts
+// Compact text operations matching the server format: positive numbers
+// retain, negative numbers delete and strings insert.
+export type Component = number | string;
+export type Operation = Component[];
+
+const isRetain = (c: Component | undefined): c is number => typeof c === 'number' && c > 0;
+const isDelete = (c: Component | undefined): c is number => typeof c === 'number' && c < 0;
+const isInsert = (c: Component | undefined): c is string => typeof c === 'string';
+
+function push(op: Operation, c: Component) {
+  if (c === 0 || c === '') return;
+  const last = op[op.length - 1];
+  if (isRetain(last) && isRetain(c)) op[op.length - 1] = last + c;
+  else if (isDelete(last) && isDelete(c)) op[op.length - 1] = last + c;
+  else if (isInsert(last) && isInsert(c)) op[op.length - 1] = last + c;
+  else op.push(c);
+}
+
+export function apply(doc: string, op: Operation): string {
+  let out = '';
+  let i = 0;
+  for (const c of op) {
+    if (isRetain(c)) {
+      out += doc.slice(i, i + c);
+      i += c;
+    } else if (isDelete(c)) {
+      i -= c;
+    } else {
+      out += c;
+    }
+  }
+  return out;
+}
+
+// diff builds a single splice operation turning oldText into newText.
+export function diff(oldText: string, newText: string): Operation {
+  let start = 0;
+  while (start < oldText.length && start < newText.length && oldText[start] === newText[start]) start++;
+  let end = 0;
+  while (
+    end < oldText.length - start &&
+    end < newText.length - start &&
+    oldText[oldText.length - 1 - end] === newText[newText.length - 1 - end]
+  ) end++;
+  const op: Operation = [];
+  push(op, start);
+  push(op, -(oldText.length - start - end));
+  push(op, newText.slice(start, newText.length - end));
+  push(op, end);
+  return op;
+}
+
+// transform returns [a', b'] such that apply(apply(d, a), b') equals
+// apply(apply(d, b), a'). Inserts from a win ties, as on the server.
+export function transform(a: Operation, b: Operation): [Operation, Operation] {
+  const aPrime: Operation = [];
+  const bPrime: Operation = [];
+  let i = 0;
+  let j = 0;
+  let ac = a[i++];
+  let bc = b[j++];
+  while (ac !== undefined || bc !== undefined) {
+    if (isInsert(ac)) {
+      push(aPrime, ac);
+      push(bPrime, ac.length);
+      ac = a[i++];
+      continue;
+    }
+    if (isInsert(bc)) {
+      push(aPrime, bc.length);
+      push(bPrime, bc);
+      bc = b[j++];
+      continue;
+    }
+    if (ac === undefined || bc === undefined) throw new Error('incompatible operations');
+    const n = Math.min(Math.abs(ac), Math.abs(bc));
+    if (isRetain(ac) && isRetain(bc)) {
+      push(aPrime, n);
+      push(bPrime, n);
+    } else if (isDelete(ac) && isRetain(bc)) {
+      push(aPrime, -n);
+    } else if (isRetain(ac) && isDelete(bc)) {
+      push(bPrime, -n);
+    }
+    ac = Math.abs(ac) === n ? a[i++] : ac - Math.sign(ac) * n;
+    bc = Math.abs(bc) === n ? b[j++] : bc - Math.sign(bc) * n;
+  }
+  return [aPrime, bPrime];
+}
+
+// compose merges a followed by b into a single operation.
+export function compose(doc: string, a: Operation, b: Operation): Operation {
+  return diff(doc, apply(apply(doc, a), b));
+}
+
+// transformPosition moves a caret through op so that it stays next to the
+// same character. Inserts exactly at the caret push it forward.
+export function transformPosition(op: Operation, pos: number): number {
+  let index = 0;
+  let newPos = pos;
+  for (const c of op) {
+    if (index > pos) break;
+    if (isRetain(c)) {
+      index += c;
+    } else if (isInsert(c)) {
+      newPos += c.length;
+    } else {
+      newPos -= Math.min(-c, pos - index);
+      index -= c;
+    }
+  }
+  return newPos;
+}